@@ -4,16 +4,15 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/ryankurte/go-u2f"
 )
 
-const appID = "https://lxc1:3483"
-
-var trustedFacets = []string{appID}
-
 type DeviceData struct {
 	Name string `json:"name" mapstructure:"name" structs:"name"`
 
@@ -23,13 +22,290 @@ type DeviceData struct {
 
 	Version string `json:"version"`
 
-	AppID string `json:app_id`
+	AppID string `json:"app_id"`
 
-	Registration []u2f.Registration `json:"registration"`
-
-	Challenge *u2f.Challenge `json: challenge`
+	Registration []RegistrationEntry `json:"registration"`
 
 	RoleName string `json:"role_name"`
+
+	// UserName is the user owning the device, empty for devices registered
+	// before users were introduced
+	UserName string `json:"user_name,omitempty"`
+
+	UserHandle []byte `json:"user_handle,omitempty"`
+
+	Credentials []WebAuthnCredential `json:"webauthn_credentials,omitempty"`
+
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+
+	// Metadata is set by administrators and added to the token and alias
+	// metadata at login
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	DisabledState
+
+	LoginFailures
+}
+
+// RegistrationEntry is a key registered to a device. The embedded
+// u2f.Registration keeps the JSON layout of earlier versions.
+type RegistrationEntry struct {
+	u2f.Registration
+
+	Quarantined bool `json:"quarantined,omitempty"`
+
+	QuarantinedAt time.Time `json:"quarantined_at,omitempty"`
+
+	Attestation
+
+	KeyUsage
+
+	DisabledState
+
+	Rotation
+
+	LoginFailures
+}
+
+// WebAuthnCredential is a WebAuthn credential registered to a device.
+type WebAuthnCredential struct {
+	// ID is the base64url encoded credential ID
+	ID string `json:"id"`
+
+	// PublicKey is the COSE encoded credential public key
+	PublicKey []byte `json:"public_key"`
+
+	SignCount uint32 `json:"sign_count"`
+
+	AAGUID string `json:"aaguid,omitempty"`
+
+	AttestationFormat string `json:"attestation_format"`
+
+	// AppID is set for credentials upgraded from a u2f registration, which
+	// stay scoped to the u2f application ID rather than the RP ID
+	AppID string `json:"app_id,omitempty"`
+
+	Quarantined bool `json:"quarantined,omitempty"`
+
+	QuarantinedAt time.Time `json:"quarantined_at,omitempty"`
+
+	Attestation
+
+	KeyUsage
+
+	DisabledState
+
+	Rotation
+
+	LoginFailures
+}
+
+func (c *WebAuthnCredential) quarantine() {
+	c.Quarantined = true
+	c.QuarantinedAt = time.Now()
+}
+
+// usable reports whether the credential may be used to log in.
+func (c *WebAuthnCredential) usable() bool {
+	return !c.Quarantined && !c.Disabled && !c.retired(time.Now())
+}
+
+// DisabledState records that an administrator disabled a device or a key.
+type DisabledState struct {
+	Disabled bool `json:"disabled,omitempty"`
+
+	DisabledReason string `json:"disabled_reason,omitempty"`
+
+	DisabledAt time.Time `json:"disabled_at,omitempty"`
+}
+
+func (s *DisabledState) disable(reason string) {
+	s.Disabled = true
+	s.DisabledReason = reason
+	s.DisabledAt = time.Now()
+}
+
+func (s *DisabledState) enable() {
+	*s = DisabledState{}
+}
+
+// Rotation links a key to the key it replaced and the key it was replaced
+// by. A replaced key keeps working until RetiresAt.
+type Rotation struct {
+	Replaces string `json:"replaces,omitempty"`
+
+	ReplacedBy string `json:"replaced_by,omitempty"`
+
+	ReplacedAt time.Time `json:"replaced_at,omitempty"`
+
+	RetiresAt time.Time `json:"retires_at,omitempty"`
+}
+
+// replace records that the key was replaced, ending its grace period after
+// gracePeriod, or immediately when it is zero.
+func (r *Rotation) replace(keyHandle string, gracePeriod time.Duration) {
+	r.ReplacedBy = keyHandle
+	r.ReplacedAt = time.Now()
+	r.RetiresAt = r.ReplacedAt.Add(gracePeriod)
+}
+
+// retired reports whether the key was replaced and its grace period is over.
+func (r *Rotation) retired(now time.Time) bool {
+	return r.ReplacedBy != "" && !now.Before(r.RetiresAt)
+}
+
+// KeyUsage records who enrolled a key and when it was last used.
+type KeyUsage struct {
+	EnrolledAt time.Time `json:"enrolled_at,omitempty"`
+
+	// EnrolledBy is the display name of the token that enrolled the key
+	EnrolledBy string `json:"enrolled_by,omitempty"`
+
+	EnrolledByAccessor string `json:"enrolled_by_accessor,omitempty"`
+
+	// SelfEnrolled is set for keys added by their user, EnrolledWith is then
+	// the key handle that authorized it
+	SelfEnrolled bool `json:"self_enrolled,omitempty"`
+
+	EnrolledWith string `json:"enrolled_with,omitempty"`
+
+	// EnrollmentCode is the ID of the enrollment code the key was
+	// registered with
+	EnrollmentCode string `json:"enrollment_code,omitempty"`
+
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+
+	LastUsedFrom string `json:"last_used_from,omitempty"`
+}
+
+func (u *KeyUsage) enrolled(req *logical.Request) {
+	u.EnrolledAt = time.Now()
+	u.EnrolledBy = req.DisplayName
+	u.EnrolledByAccessor = req.ClientTokenAccessor
+}
+
+func (u *KeyUsage) selfEnrolled(keyHandle string) {
+	u.EnrolledAt = time.Now()
+	u.SelfEnrolled = true
+	u.EnrolledWith = keyHandle
+}
+
+// enrolledWithCode records a key registered with an enrollment code, on
+// behalf of the token that issued the code.
+func (u *KeyUsage) enrolledWithCode(code *EnrollmentCodeEntry) {
+	u.EnrolledAt = time.Now()
+	u.EnrolledBy = code.CreatedBy
+	u.EnrolledByAccessor = code.CreatedByAccessor
+	u.EnrollmentCode = code.ID
+}
+
+func (u *KeyUsage) used(req *logical.Request) {
+	u.LastUsedAt = time.Now()
+	if req.Connection != nil {
+		u.LastUsedFrom = req.Connection.RemoteAddr
+	}
+}
+
+// Attestation records the attestation certificate a key was registered
+// with.
+type Attestation struct {
+	AttestationSubject string `json:"attestation_subject,omitempty"`
+
+	AttestationSerial string `json:"attestation_serial,omitempty"`
+
+	AttestationVerified bool `json:"attestation_verified,omitempty"`
+
+	AttestationKeyID string `json:"attestation_key_id,omitempty"`
+}
+
+func (r *RegistrationEntry) quarantine() {
+	r.Quarantined = true
+	r.QuarantinedAt = time.Now()
+}
+
+// usable reports whether the key may be used to log in.
+func (r *RegistrationEntry) usable() bool {
+	return !r.Quarantined && !r.Disabled && !r.retired(time.Now())
+}
+
+// registration returns the registration with the given key handle.
+func (d *DeviceData) registration(keyHandle string) *RegistrationEntry {
+	for i := range d.Registration {
+		if d.Registration[i].KeyHandle == keyHandle {
+			return &d.Registration[i]
+		}
+	}
+	return nil
+}
+
+// credential returns the WebAuthn credential with the given ID.
+func (d *DeviceData) credential(id string) *WebAuthnCredential {
+	for i := range d.Credentials {
+		if d.Credentials[i].ID == id {
+			return &d.Credentials[i]
+		}
+	}
+	return nil
+}
+
+// upgradeRegistration replaces the u2f registration with the same key handle
+// by the WebAuthn credential.
+func (d *DeviceData) upgradeRegistration(cred *WebAuthnCredential) {
+	registrations := d.Registration[:0]
+	for _, reg := range d.Registration {
+		if reg.KeyHandle != cred.ID {
+			registrations = append(registrations, reg)
+		}
+	}
+	d.Registration = registrations
+	d.Credentials = append(d.Credentials, *cred)
+}
+
+// u2fRegistrations returns every key known under the u2f app ID, used to
+// exclude them when registering a new one. That includes the u2f
+// registrations upgraded to WebAuthn credentials.
+func (d *DeviceData) u2fRegistrations() []u2f.Registration {
+	var registrations []u2f.Registration
+	for _, reg := range d.Registration {
+		registrations = append(registrations, reg.Registration)
+	}
+	for _, cred := range d.Credentials {
+		if cred.AppID != "" {
+			registrations = append(registrations, u2f.Registration{KeyHandle: cred.ID})
+		}
+	}
+	return registrations
+}
+
+// activeRegistrations returns the keys that may be used to log in.
+func (d *DeviceData) activeRegistrations() []u2f.Registration {
+	var registrations []u2f.Registration
+	if d.Disabled {
+		return registrations
+	}
+	for _, reg := range d.Registration {
+		if !reg.usable() {
+			continue
+		}
+		registrations = append(registrations, reg.Registration)
+	}
+	return registrations
+}
+
+// activeCredentials returns the WebAuthn credentials that may be used to log
+// in.
+func (d *DeviceData) activeCredentials() []WebAuthnCredential {
+	var credentials []WebAuthnCredential
+	if d.Disabled {
+		return credentials
+	}
+	for _, cred := range d.Credentials {
+		if !cred.usable() {
+			continue
+		}
+		credentials = append(credentials, cred)
+	}
+	return credentials
 }
 
 // Factory returns a configured instance of the backend.
@@ -43,24 +319,63 @@ func Factory(ctx context.Context, c *logical.BackendConfig) (logical.Backend, er
 
 func Backend() *backend {
 	var b backend
+	b.locks = locksutil.CreateLocks()
 	b.Backend = &framework.Backend{
 		BackendType: logical.TypeCredential,
 		//AuthRenew:   b.pathLoginRenew,
-		Help: backendHelp,
+		Help:           backendHelp,
+		PeriodicFunc:   b.periodicFunc,
+		InitializeFunc: b.initialize,
+		Invalidate:     b.invalidate,
 		PathsSpecial: &logical.Paths{
 			Unauthenticated: []string{
+				"facets",
 				"signRequest/*",
 				"signResponse/*",
+				"webauthn/loginBegin/*",
+				"webauthn/loginFinish/*",
+				"selfEnrollRequest/*",
+				"selfEnrollResponse/*",
+				"enrollRequest/*",
+				"enrollResponse/*",
+				"recoveryLogin/*",
 			},
 		},
-		Paths: append([]*framework.Path{
+		Paths: []*framework.Path{
+			pathConfig(&b),
+			pathFacets(&b),
+			pathRotateChallengeKey(&b),
+			pathConfigAttestation(&b),
+			pathConfigMDS(&b),
 			pathRoles(&b),
 			pathRolesList(&b),
+			pathDevicesList(&b),
+			pathDevices(&b),
+			pathDevicesDisable(&b),
+			pathDevicesEnable(&b),
+			pathDevicesRename(&b),
+			pathDevicesLockout(&b),
+			pathLockoutsList(&b),
+			pathUsersList(&b),
+			pathUsers(&b),
+			pathUsersRename(&b),
 			pathRegistrationRequest(&b),
 			pathRegistrationResponse(&b),
 			pathSignRequest(&b),
 			pathSignResponse(&b),
-		}),
+			pathSelfEnrollRequest(&b),
+			pathSelfEnrollResponse(&b),
+			pathEnrollmentCodesList(&b),
+			pathEnrollmentCodes(&b),
+			pathEnrollRequest(&b),
+			pathEnrollResponse(&b),
+			pathRecoveryCodes(&b),
+			pathRecoveryLogin(&b),
+			pathWebAuthnRegisterBegin(&b),
+			pathWebAuthnRegisterFinish(&b),
+			pathWebAuthnLoginBegin(&b),
+			pathWebAuthnLoginFinish(&b),
+		},
 	}
 
 	return &b
@@ -68,13 +383,51 @@ func Backend() *backend {
 
 type backend struct {
 	*framework.Backend
+
+	lock sync.RWMutex
+
+	// locks guard the devices, users and challenges being modified, see
+	// lockKeys
+	locks []*locksutil.LockEntry
+
+	// keyIndexLock guards the key index, it is taken after the locks of the
+	// device being registered and never before, and held until the device
+	// is stored
+	keyIndexLock sync.Mutex
+
+	rateLimiters rateLimiters
+
+	usedChallenges usedChallenges
+
+	cachedChallengeKeys *challengeKeyEntry
+}
+
+func (b *backend) invalidate(ctx context.Context, key string) {
+	switch key {
+	case challengeKeyStoragePath:
+		b.lock.Lock()
+		b.cachedChallengeKeys = nil
+		b.lock.Unlock()
+	}
+}
+
+// periodicFunc is invoked by Vault on the active node to tidy up state that
+// expired without being consumed.
+func (b *backend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	b.rateLimiters.tidy(time.Now())
+	b.usedChallenges.tidy(time.Now())
+	if err := b.tidyChallenges(ctx, req.Storage); err != nil {
+		return err
+	}
+	return b.tidyEnrollmentCodes(ctx, req.Storage)
 }
 
 const backendHelp = `
 The "u2f" credential provider allows authentication using
 a u2f enabled device. No additional factors are supported.
 
-The device  is configured using the "device/" and "roles/"
+The backend is configured using the "config" endpoint and the
+device is configured using the "device/" and "roles/"
 endpoints by a user with the correct access.
  Authentication is then done by suppying the fields for "requestSign" and "responseSign" endpoints.
 `
@@ -111,3 +464,7 @@ func (b *backend) setDevice(ctx context.Context, s logical.Storage, name string,
 
 	return s.Put(ctx, entry)
 }
+
+func (b *backend) deleteDevice(ctx context.Context, s logical.Storage, name string) error {
+	return s.Delete(ctx, "devices/"+strings.ToLower(name))
+}
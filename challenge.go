@@ -0,0 +1,169 @@
+package u2fauth
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/ryankurte/go-u2f"
+)
+
+const (
+	challengeTypeRegister = "register"
+	challengeTypeSign     = "sign"
+
+	challengeTypeWebAuthnRegister = "webauthn.register"
+	challengeTypeWebAuthnLogin    = "webauthn.login"
+
+	// defaultChallengeTTL is also the longest TTL accepted, as the u2f library
+	// rejects challenges older than five minutes on its own.
+	defaultChallengeTTL = 5 * time.Minute
+)
+
+var (
+	errChallengeNotFound = fmt.Errorf("unknown or already used challenge")
+	errChallengeExpired  = fmt.Errorf("challenge has expired")
+
+	errChallengeKeyMissing = fmt.Errorf("stateless challenge key has not been generated")
+)
+
+// ChallengeEntry is an outstanding challenge handed to a client. It is
+// stored under "challenges/<id>" and deleted once a response consumes it.
+type ChallengeEntry struct {
+	ID string `json:"id"`
+
+	Type string `json:"type"`
+
+	// DeviceName is the device being registered, or the user logging in
+	DeviceName string `json:"device_name"`
+
+	RoleName string `json:"role_name,omitempty"`
+
+	// UserName is the user owning the device being registered
+	UserName string `json:"user_name,omitempty"`
+
+	// EnrollmentCode is the ID of the code a registration was started with
+	EnrollmentCode string `json:"enrollment_code,omitempty"`
+
+	// ReplacesKey is the key handle the registered key replaces, which
+	// keeps working for GracePeriod
+	ReplacesKey string `json:"replaces_key,omitempty"`
+
+	GracePeriod time.Duration `json:"grace_period,omitempty"`
+
+	// UserHandle is the WebAuthn user handle offered to a new device
+	UserHandle []byte `json:"user_handle,omitempty"`
+
+	Challenge *u2f.Challenge `json:"challenge"`
+
+	IssuedAt time.Time `json:"issued_at"`
+
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (c *ChallengeEntry) expired(now time.Time) bool {
+	return !now.Before(c.ExpiresAt)
+}
+
+// issueChallenge assigns an ID and expiry to the challenge and stores it.
+func (b *backend) issueChallenge(ctx context.Context, s logical.Storage, config *ConfigEntry, cEntry *ChallengeEntry) error {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	cEntry.ID = id
+	cEntry.IssuedAt = now
+	cEntry.ExpiresAt = now.Add(config.challengeTTL())
+
+	return b.setChallenge(ctx, s, cEntry)
+}
+
+// consumeChallenge loads and deletes the challenge so it can only be
+// answered once, then checks it was issued for this device and purpose.
+// The caller must not hold other locks.
+func (b *backend) consumeChallenge(ctx context.Context, s logical.Storage, id, typ, name string) (*ChallengeEntry, error) {
+	unlock := b.lockKeys(challengeLockKey(id))
+	defer unlock()
+
+	cEntry, err := b.challenge(ctx, s, id)
+	if err != nil {
+		return nil, err
+	}
+	if cEntry == nil {
+		return nil, errChallengeNotFound
+	}
+
+	if err := s.Delete(ctx, "challenges/"+cEntry.ID); err != nil {
+		return nil, err
+	}
+
+	if cEntry.Type != typ || cEntry.DeviceName != name {
+		return nil, errChallengeNotFound
+	}
+	if cEntry.expired(time.Now()) {
+		return nil, errChallengeExpired
+	}
+
+	return cEntry, nil
+}
+
+func (b *backend) challenge(ctx context.Context, s logical.Storage, id string) (*ChallengeEntry, error) {
+	if id == "" {
+		return nil, nil
+	}
+	if _, err := uuid.ParseUUID(id); err != nil {
+		return nil, nil
+	}
+
+	entry, err := s.Get(ctx, "challenges/"+id)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result ChallengeEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func (b *backend) setChallenge(ctx context.Context, s logical.Storage, cEntry *ChallengeEntry) error {
+	entry, err := logical.StorageEntryJSON("challenges/"+cEntry.ID, cEntry)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+// tidyChallenges removes challenges that expired without being answered.
+func (b *backend) tidyChallenges(ctx context.Context, s logical.Storage) error {
+	ids, err := s.List(ctx, "challenges/")
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, id := range ids {
+		cEntry, err := b.challenge(ctx, s, id)
+		if err != nil {
+			return err
+		}
+		if cEntry == nil || !cEntry.expired(now) {
+			continue
+		}
+		if err := s.Delete(ctx, "challenges/"+id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
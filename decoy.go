@@ -0,0 +1,199 @@
+package u2fauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/ryankurte/go-u2f"
+)
+
+const decoyKeyStoragePath = "config/decoy_key"
+
+// decoyKeyEntry holds the secret fake key handles are derived from. Unlike
+// the challenge key it is never rotated, the key handles offered for an
+// unknown name must not change over time.
+type decoyKeyEntry struct {
+	Key []byte `json:"key"`
+}
+
+var (
+	decoyPublicKeyOnce sync.Once
+	decoyPublicKey     string
+	decoyPublicKeyErr  error
+)
+
+// ensureDecoyKey creates the secret of the mount if it does not have one yet.
+func (b *backend) ensureDecoyKey(ctx context.Context, s logical.Storage) error {
+	key, err := b.decoyKey(ctx, s)
+	if err != nil || key != nil {
+		return err
+	}
+
+	secret, err := newChallengeKey()
+	if err != nil {
+		return err
+	}
+	entry, err := logical.StorageEntryJSON(decoyKeyStoragePath, &decoyKeyEntry{Key: secret})
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+func (b *backend) decoyKey(ctx context.Context, s logical.Storage) (*decoyKeyEntry, error) {
+	entry, err := s.Get(ctx, decoyKeyStoragePath)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result decoyKeyEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// decoyRegistrations returns the fake keys offered for a name without any
+// usable key. They are derived from the mount secret so that every sign
+// request for the name offers the same one or two key handles, as for a
+// real user. The public key is random, no signature verifies against it.
+func (b *backend) decoyRegistrations(ctx context.Context, s logical.Storage, name string) ([]u2f.Registration, error) {
+	key, err := b.decoyKey(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, fmt.Errorf("decoy key has not been generated")
+	}
+
+	decoyPublicKeyOnce.Do(func() {
+		var priv *ecdsa.PrivateKey
+		priv, decoyPublicKeyErr = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if decoyPublicKeyErr == nil {
+			decoyPublicKey = base64.RawURLEncoding.EncodeToString(elliptic.Marshal(priv.Curve, priv.X, priv.Y))
+		}
+	})
+	if decoyPublicKeyErr != nil {
+		return nil, decoyPublicKeyErr
+	}
+
+	count := 1 + int(decoyMAC(key.Key, name, "count")[0]%2)
+	var registrations []u2f.Registration
+	for i := 0; i < count; i++ {
+		registrations = append(registrations, u2f.Registration{
+			KeyHandle: base64.RawURLEncoding.EncodeToString(decoyMAC(key.Key, name, strconv.Itoa(i))),
+			PublicKey: decoyPublicKey,
+		})
+	}
+	return registrations, nil
+}
+
+// decoyMAC returns 64 bytes, the length of the key handles of common
+// authenticators.
+func decoyMAC(key []byte, name, label string) []byte {
+	mac := hmac.New(sha512.New, key)
+	mac.Write([]byte(name))
+	mac.Write([]byte{0})
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// decoyAuthenticate answers a sign response for a name without any usable
+// key. It verifies the response against the fake keys offered for the
+// name, so that it fails with the same error and after the same work as a
+// wrong signature for a real user.
+func (b *backend) decoyAuthenticate(ctx context.Context, req *logical.Request, name string, c *u2f.Challenge, resp u2f.SignResponse) (*logical.Response, error) {
+	registrations, err := b.decoyRegistrations(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	c.RegisteredKeys = registrations
+
+	if _, err = c.Authenticate(resp); err == nil {
+		// Cannot happen, the private key of the decoys is discarded
+		err = u2f.ErrWrongKeyHandle
+	}
+	b.Logger().Error("authenticate", "user", name, "error", "no usable key, answered with a decoy")
+	return logical.ErrorResponse("Authentication failed: " + err.Error()), nil
+}
+
+// decoyWebAuthnAuthenticate answers a WebAuthn assertion for a name without
+// any usable key. The fake key handles are verified as u2f registrations
+// used through the appid extension, like the real ones they stand for.
+func (b *backend) decoyWebAuthnAuthenticate(ctx context.Context, req *logical.Request, config *ConfigEntry, name string, cEntry *ChallengeEntry, d *framework.FieldData) (*logical.Response, error) {
+	registrations, err := b.decoyRegistrations(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	credID := strings.TrimRight(d.Get("id").(string), "=")
+	var cred *WebAuthnCredential
+	for _, reg := range registrations {
+		if reg.KeyHandle == credID {
+			cred, err = legacyCredential(&RegistrationEntry{Registration: reg}, config.AppID)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	b.Logger().Error("WebAuthnLoginFinish", "user", name, "error", "no usable key, answered with a decoy")
+	if cred == nil {
+		return logical.ErrorResponse("Authentication failed: unknown credential"), nil
+	}
+
+	clientDataJSON, rawAuthData, signature, _, errResp := decodeAssertion(d)
+	if errResp != nil {
+		return errResp, logical.ErrInvalidRequest
+	}
+	err = verifyClientData(clientDataJSON, webauthnTypeGet, cEntry.Challenge.Challenge, config.webauthnOrigins())
+	var authData *authenticatorData
+	if err == nil {
+		authData, err = parseAuthenticatorData(rawAuthData)
+	}
+	if err == nil {
+		err = authData.verify(config.rpID(), cred.AppID, false)
+	}
+	if err == nil {
+		err = verifyAssertion(cred, rawAuthData, clientDataJSON, signature)
+	}
+	if err == nil {
+		// Cannot happen, the private key of the decoys is discarded
+		err = errWebAuthnVerification
+	}
+	return logical.ErrorResponse("Authentication failed: " + err.Error()), nil
+}
+
+// hasActiveRegistrations reports whether any of the devices has a key that
+// may be used to log in.
+func hasActiveRegistrations(devices []*DeviceData) bool {
+	for _, dEntry := range devices {
+		if len(dEntry.activeRegistrations()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hasActiveKeys reports whether any of the devices has a u2f registration or
+// a WebAuthn credential that may be used to log in.
+func hasActiveKeys(devices []*DeviceData) bool {
+	for _, dEntry := range devices {
+		if len(dEntry.activeRegistrations()) > 0 || len(dEntry.activeCredentials()) > 0 {
+			return true
+		}
+	}
+	return false
+}
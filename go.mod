@@ -3,12 +3,18 @@ module github.com/bruj0/vault-plugin-auth-u2f
 go 1.14
 
 require (
+	github.com/armon/go-metrics v0.0.0-20180917152333-f0300d1749da
 	github.com/davecgh/go-spew v1.1.1
+	github.com/fxamacker/cbor/v2 v2.4.0
 	github.com/hashicorp/go-hclog v0.14.1
 	github.com/hashicorp/go-sockaddr v1.0.2
+	github.com/hashicorp/go-uuid v1.0.1
 	github.com/hashicorp/vault/api v1.0.4
 	github.com/hashicorp/vault/sdk v0.1.13
 	github.com/mitchellh/mapstructure v1.1.2
 	github.com/ryankurte/go-u2f v0.1.4
 	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a // indirect
+	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
+	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
+	gopkg.in/square/go-jose.v2 v2.3.1
 )
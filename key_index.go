@@ -0,0 +1,243 @@
+package u2fauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	keyHandleIndexPrefix = "key-index/key-handles/"
+	publicKeyIndexPrefix = "key-index/public-keys/"
+)
+
+var errKeyAlreadyRegistered = errors.New("key is already registered")
+
+// KeyIndexEntry points from the key handle or the public key of a u2f
+// registration or WebAuthn credential to the device holding it, so that an
+// authenticator can not be registered again under any device name. It is
+// stored under the SHA-256 hash of the key handle and of the PKIX encoded
+// public key.
+type KeyIndexEntry struct {
+	DeviceName string `json:"device_name"`
+
+	KeyHandle string `json:"key_handle"`
+}
+
+// registrationPublicKey returns the public key of a u2f registration.
+func registrationPublicKey(regEntry *RegistrationEntry) (crypto.PublicKey, error) {
+	point, err := decodeBase64URL(regEntry.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), point)
+	if x == nil {
+		return nil, fmt.Errorf("invalid u2f public key")
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+}
+
+// credentialPublicKey returns the public key of a WebAuthn credential.
+func credentialPublicKey(cred *WebAuthnCredential) (crypto.PublicKey, error) {
+	pub, _, err := parseCOSEKey(cred.PublicKey)
+	return pub, err
+}
+
+// keyIndexPaths returns the storage paths indexing a key. A key whose
+// public key can not be parsed is only indexed by its key handle.
+func keyIndexPaths(keyHandle string, pub crypto.PublicKey) []string {
+	sum := sha256.Sum256([]byte(keyHandle))
+	paths := []string{keyHandleIndexPrefix + hex.EncodeToString(sum[:])}
+	if pub != nil {
+		if der, err := x509.MarshalPKIXPublicKey(pub); err == nil {
+			sum := sha256.Sum256(der)
+			paths = append(paths, publicKeyIndexPrefix+hex.EncodeToString(sum[:]))
+		}
+	}
+	return paths
+}
+
+// deviceKeyIndexPaths returns the key handles of the keys of a device along
+// with the storage paths indexing them.
+func deviceKeyIndexPaths(dEntry *DeviceData) map[string][]string {
+	paths := map[string][]string{}
+	for i := range dEntry.Registration {
+		reg := &dEntry.Registration[i]
+		pub, _ := registrationPublicKey(reg)
+		paths[reg.KeyHandle] = keyIndexPaths(reg.KeyHandle, pub)
+	}
+	for i := range dEntry.Credentials {
+		cred := &dEntry.Credentials[i]
+		pub, _ := credentialPublicKey(cred)
+		paths[cred.ID] = keyIndexPaths(cred.ID, pub)
+	}
+	return paths
+}
+
+// holdsKey reports whether the device has a u2f registration or a WebAuthn
+// credential with the given key handle.
+func (d *DeviceData) holdsKey(keyHandle string) bool {
+	return d.registration(keyHandle) != nil || d.credential(keyHandle) != nil
+}
+
+// keyClaim is a key recorded in the index for a registration whose device
+// is not stored yet. The index stays locked until the claim is released, and
+// a claim released before the device is stored is removed from the index, so
+// that no entry points to a device without the key.
+type keyClaim struct {
+	b      *backend
+	paths  []string
+	stored bool
+}
+
+// keep tells the claim that the device holding the key has been stored.
+func (c *keyClaim) keep() {
+	c.stored = true
+}
+
+// release unlocks the index, removing the entries of the claim unless the
+// device was stored.
+func (c *keyClaim) release(ctx context.Context, s logical.Storage) {
+	defer c.b.keyIndexLock.Unlock()
+	if c.stored {
+		return
+	}
+	for _, path := range c.paths {
+		if err := s.Delete(ctx, path); err != nil {
+			c.b.Logger().Error("keyClaim", "path", path, "error", err)
+		}
+	}
+}
+
+// claimKey records in the index that the device holds the key. If another
+// device, or the device itself, already holds the key nothing is recorded
+// and that device is returned. Entries left by a device that no longer
+// holds the key are taken over.
+//
+// Otherwise the index is left locked until the returned claim is released,
+// which the caller does once it has stored the device, or failed to. The
+// index lock is taken while the caller holds the lock of the device.
+func (b *backend) claimKey(ctx context.Context, s logical.Storage, deviceName, keyHandle string, pub crypto.PublicKey) (*keyClaim, *DeviceData, error) {
+	paths := keyIndexPaths(keyHandle, pub)
+
+	b.keyIndexLock.Lock()
+	for _, path := range paths {
+		entry, err := b.keyIndexEntry(ctx, s, path)
+		if err != nil {
+			b.keyIndexLock.Unlock()
+			return nil, nil, err
+		}
+		if entry == nil {
+			continue
+		}
+		owner, err := b.device(ctx, s, entry.DeviceName)
+		if err != nil {
+			b.keyIndexLock.Unlock()
+			return nil, nil, err
+		}
+		if owner != nil && owner.holdsKey(entry.KeyHandle) {
+			b.keyIndexLock.Unlock()
+			owner.Name = entry.DeviceName
+			return nil, owner, nil
+		}
+	}
+
+	claim := &keyClaim{b: b, paths: paths}
+	for _, path := range paths {
+		if err := b.setKeyIndexEntry(ctx, s, path, &KeyIndexEntry{DeviceName: deviceName, KeyHandle: keyHandle}); err != nil {
+			claim.release(ctx, s)
+			return nil, nil, err
+		}
+	}
+	return claim, nil, nil
+}
+
+// indexKeys points the index entries of the keys of the device to it, for
+// devices renamed or registered before the index existed.
+func (b *backend) indexKeys(ctx context.Context, s logical.Storage, name string, dEntry *DeviceData) error {
+	b.keyIndexLock.Lock()
+	defer b.keyIndexLock.Unlock()
+
+	for keyHandle, paths := range deviceKeyIndexPaths(dEntry) {
+		for _, path := range paths {
+			entry, err := b.keyIndexEntry(ctx, s, path)
+			if err != nil {
+				return err
+			}
+			if entry != nil && entry.DeviceName == name && entry.KeyHandle == keyHandle {
+				continue
+			}
+			if err := b.setKeyIndexEntry(ctx, s, path, &KeyIndexEntry{DeviceName: name, KeyHandle: keyHandle}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// releaseKeys removes the index entries of the keys of a device being
+// deleted.
+func (b *backend) releaseKeys(ctx context.Context, s logical.Storage, name string, dEntry *DeviceData) error {
+	b.keyIndexLock.Lock()
+	defer b.keyIndexLock.Unlock()
+
+	for _, paths := range deviceKeyIndexPaths(dEntry) {
+		for _, path := range paths {
+			entry, err := b.keyIndexEntry(ctx, s, path)
+			if err != nil {
+				return err
+			}
+			if entry == nil || entry.DeviceName != name {
+				continue
+			}
+			if err := s.Delete(ctx, path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// duplicateKeyResponse refuses a key that is already registered. Only
+// administrators are told which device holds it, the unauthenticated
+// enrollment endpoints must not reveal device and user names.
+func (b *backend) duplicateKeyResponse(owner *DeviceData, keyHandle string, admin bool) *logical.Response {
+	userName := deviceOwner(owner, owner.Name)
+	b.Logger().Warn("duplicateKeyResponse", "key_handle", keyHandle, "error", errKeyAlreadyRegistered, "device", owner.Name, "user", userName)
+	if !admin {
+		return logical.ErrorResponse(errKeyAlreadyRegistered.Error())
+	}
+	return logical.ErrorResponse(fmt.Sprintf("%s to device %q of user %q", errKeyAlreadyRegistered, owner.Name, userName))
+}
+
+func (b *backend) keyIndexEntry(ctx context.Context, s logical.Storage, path string) (*KeyIndexEntry, error) {
+	entry, err := s.Get(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result KeyIndexEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (b *backend) setKeyIndexEntry(ctx context.Context, s logical.Storage, path string, kEntry *KeyIndexEntry) error {
+	entry, err := logical.StorageEntryJSON(path, kEntry)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
@@ -0,0 +1,134 @@
+package u2fauth
+
+import (
+	"errors"
+	"time"
+)
+
+const defaultLockoutDuration = 15 * time.Minute
+
+var errLockedOut = errors.New("too many failed logins, try again later")
+
+// LoginFailures counts the consecutive failed logins of a device or key.
+// After each failure further attempts are refused until LockedUntil, for a
+// backoff that doubles with every failure and for the lockout duration
+// once the threshold is reached.
+type LoginFailures struct {
+	FailedLogins int `json:"failed_logins,omitempty"`
+
+	LastFailedLoginAt time.Time `json:"last_failed_login_at,omitempty"`
+
+	LockedUntil time.Time `json:"locked_until,omitempty"`
+}
+
+func (f *LoginFailures) locked(now time.Time) bool {
+	return now.Before(f.LockedUntil)
+}
+
+func (f *LoginFailures) failed(p lockoutPolicy) {
+	now := time.Now()
+	f.FailedLogins++
+	f.LastFailedLoginAt = now
+
+	if f.FailedLogins >= p.Threshold {
+		f.LockedUntil = now.Add(p.Duration)
+		return
+	}
+	backoff := p.Backoff
+	for i := 1; i < f.FailedLogins && backoff < p.Duration; i++ {
+		backoff *= 2
+	}
+	if backoff > p.Duration {
+		backoff = p.Duration
+	}
+	f.LockedUntil = now.Add(backoff)
+}
+
+func (f *LoginFailures) reset() {
+	*f = LoginFailures{}
+}
+
+// lockoutPolicy is the lockout configuration that applies to a login.
+type lockoutPolicy struct {
+	// Threshold is the number of consecutive failures that lock a device or
+	// key out, zero disables lockouts
+	Threshold int
+
+	Backoff time.Duration
+
+	Duration time.Duration
+}
+
+func (p lockoutPolicy) enabled() bool {
+	return p.Threshold > 0
+}
+
+// lockoutPolicyFor returns the lockout settings of the mount, overridden by
+// those set on the role. A negative role threshold disables lockouts for the
+// role.
+func lockoutPolicyFor(config *ConfigEntry, roleEntry *RoleEntry) lockoutPolicy {
+	p := lockoutPolicy{
+		Threshold: config.LockoutThreshold,
+		Backoff:   config.LockoutBackoff,
+		Duration:  config.LockoutDuration,
+	}
+	if roleEntry != nil {
+		if roleEntry.LockoutThreshold != 0 {
+			p.Threshold = roleEntry.LockoutThreshold
+		}
+		if roleEntry.LockoutBackoff != 0 {
+			p.Backoff = roleEntry.LockoutBackoff
+		}
+		if roleEntry.LockoutDuration != 0 {
+			p.Duration = roleEntry.LockoutDuration
+		}
+	}
+	if p.Duration == 0 {
+		p.Duration = defaultLockoutDuration
+	}
+	return p
+}
+
+// keyLoginFailures returns the failed logins of the u2f registration or
+// WebAuthn credential with the given key handle.
+func (d *DeviceData) keyLoginFailures(keyHandle string) *LoginFailures {
+	if reg := d.registration(keyHandle); reg != nil {
+		return &reg.LoginFailures
+	}
+	if cred := d.credential(keyHandle); cred != nil {
+		return &cred.LoginFailures
+	}
+	return nil
+}
+
+// lockedOut reports whether the device or the key may not be used to log in
+// at the moment.
+func (d *DeviceData) lockedOut(keyHandle string) bool {
+	now := time.Now()
+	if d.LoginFailures.locked(now) {
+		return true
+	}
+	f := d.keyLoginFailures(keyHandle)
+	return f != nil && f.locked(now)
+}
+
+// loginFailed counts a failed login against the device and the key. It
+// reports whether a failure was counted, the caller then stores the device.
+func (d *DeviceData) loginFailed(p lockoutPolicy, keyHandle string) bool {
+	if !p.enabled() {
+		return false
+	}
+	d.LoginFailures.failed(p)
+	if f := d.keyLoginFailures(keyHandle); f != nil {
+		f.failed(p)
+	}
+	return true
+}
+
+// loginSucceeded resets the failed logins of the device and the key.
+func (d *DeviceData) loginSucceeded(keyHandle string) {
+	d.LoginFailures.reset()
+	if f := d.keyLoginFailures(keyHandle); f != nil {
+		f.reset()
+	}
+}
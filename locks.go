@@ -0,0 +1,118 @@
+package u2fauth
+
+import (
+	"context"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// Storage has no transactions, so the entries that are read, modified and
+// written back are guarded by striped locks. A device and the user owning
+// it are both guarded by the lock of the user, since logins work on all the
+// devices of a user. Creating, renaming or deleting a device also takes the
+// lock of the device name, which is unique across users.
+
+func userLockKey(name string) string {
+	return "users/" + name
+}
+
+func deviceLockKey(name string) string {
+	return "devices/" + name
+}
+
+func enrollmentCodeLockKey(id string) string {
+	return "enrollment-codes/" + id
+}
+
+func challengeLockKey(id string) string {
+	return "challenges/" + id
+}
+
+// lockKeys takes the locks of the keys and returns the function releasing
+// them. The locks are always taken in the same order, keys sharing a lock
+// do not deadlock.
+func (b *backend) lockKeys(keys ...string) func() {
+	locks := locksutil.LocksForKeys(b.locks, keys)
+	for _, lock := range locks {
+		lock.Lock()
+	}
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+	}
+}
+
+// deviceOwner returns the user owning a device, a device registered before
+// users were introduced and not migrated yet is a user of its own.
+func deviceOwner(dEntry *DeviceData, name string) string {
+	if dEntry != nil && dEntry.UserName != "" {
+		return dEntry.UserName
+	}
+	return name
+}
+
+// lockDevice takes the locks of a device, of its owner and of the extra
+// keys, and returns the device read under them, nil if it does not exist.
+// The owner is only known once the device is read, so it is read again in
+// case it was moved to another user meanwhile.
+func (b *backend) lockDevice(ctx context.Context, s logical.Storage, name string, keys ...string) (*DeviceData, func(), error) {
+	for {
+		dEntry, err := b.device(ctx, s, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		owner := deviceOwner(dEntry, name)
+
+		lockKeys := append([]string{userLockKey(owner), deviceLockKey(name)}, keys...)
+		unlock := b.lockKeys(lockKeys...)
+		dEntry, err = b.device(ctx, s, name)
+		if err != nil {
+			unlock()
+			return nil, nil, err
+		}
+		if deviceOwner(dEntry, name) == owner {
+			return dEntry, unlock, nil
+		}
+		unlock()
+	}
+}
+
+// lockUser takes the locks of a user, of each of its devices and of the
+// extra keys, and returns the user read under them, nil if it does not
+// exist. The devices are only known once the user is read, so it is read
+// again in case one was added or removed meanwhile.
+func (b *backend) lockUser(ctx context.Context, s logical.Storage, name string, keys ...string) (*UserEntry, func(), error) {
+	for {
+		uEntry, err := b.user(ctx, s, name)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		lockKeys := append([]string{userLockKey(name)}, keys...)
+		if uEntry != nil {
+			for _, deviceName := range uEntry.Devices {
+				lockKeys = append(lockKeys, deviceLockKey(deviceName))
+			}
+		}
+		unlock := b.lockKeys(lockKeys...)
+		locked, err := b.user(ctx, s, name)
+		if err != nil {
+			unlock()
+			return nil, nil, err
+		}
+		if sameDevices(uEntry, locked) {
+			return locked, unlock, nil
+		}
+		unlock()
+	}
+}
+
+func sameDevices(a, b *UserEntry) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return strings.Join(a.Devices, "/") == strings.Join(b.Devices, "/")
+}
@@ -0,0 +1,197 @@
+package u2fauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/ryankurte/go-u2f"
+)
+
+// concurrently calls fn from n goroutines at once and reports the errors
+// they return, t may not be used to fail from them.
+func concurrently(t *testing.T, n int, fn func(i int) error) {
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			if err := fn(i); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func handle(b logical.Backend, req *logical.Request) (*logical.Response, error) {
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err == nil && resp != nil && resp.IsError() {
+		err = resp.Error()
+	}
+	return resp, err
+}
+
+// registerConcurrently registers vk for the device without failing the test.
+func registerConcurrently(b logical.Backend, s logical.Storage, vk *virtualKey, name string) error {
+	resp, err := handle(b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "registerRequest/" + name,
+		Storage:   s,
+		Data: map[string]interface{}{
+			"role_name": "my-role",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	var registerReq registerRequestMessage
+	if err := json.Unmarshal([]byte(resp.Data[logical.HTTPRawBody].(string)), &registerReq); err != nil {
+		return err
+	}
+	vkResp, err := vk.HandleRegisterRequest(*registerReq.RegisterRequestMessage)
+	if err != nil {
+		return err
+	}
+
+	_, err = handle(b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "registerResponse/" + name,
+		Storage:   s,
+		Data: map[string]interface{}{
+			"challengeId":      registerReq.ChallengeID,
+			"registrationData": vkResp.RegistrationData,
+			"clientData":       vkResp.ClientData,
+		},
+	})
+	return err
+}
+
+// loginConcurrently logs in with vk without failing the test.
+func loginConcurrently(b logical.Backend, s logical.Storage, vk *virtualKey, name string) error {
+	signReq, err := signRequestConcurrently(b, s, name)
+	if err != nil {
+		return err
+	}
+	signResp, err := vk.HandleAuthenticationRequest(*signReq.SignRequestMessage)
+	if err != nil {
+		return err
+	}
+	resp, err := signResponse(b, s, name, signReq.ChallengeID, signResp)
+	if err == nil && (resp == nil || resp.Auth == nil) {
+		err = fmt.Errorf("login failed: %#v", resp)
+	}
+	return err
+}
+
+func signRequestConcurrently(b logical.Backend, s logical.Storage, name string) (*signRequestMessage, error) {
+	resp, err := handle(b, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "signRequest/" + name,
+		Storage:   s,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var signReq signRequestMessage
+	if err := json.Unmarshal([]byte(resp.Data[logical.HTTPRawBody].(string)), &signReq); err != nil {
+		return nil, err
+	}
+	return &signReq, nil
+}
+
+func TestLocks_ConcurrentRegistrations(t *testing.T) {
+	b, storage := getBackend(t)
+	configureBackend(t, b, storage)
+	createRole(t, b, storage, "my-role", "c,d")
+
+	const keys = 16
+	concurrently(t, keys, func(i int) error {
+		vk, err := newVirtualKey()
+		if err != nil {
+			return err
+		}
+		return registerConcurrently(b, storage, vk, "shared")
+	})
+
+	// No registration overwrote another
+	if registrations := readDevice(t, b, storage, "shared")["registrations"].([]map[string]interface{}); len(registrations) != keys {
+		t.Fatalf("expected %d registrations, got %d", keys, len(registrations))
+	}
+}
+
+func TestLocks_ConcurrentLogins(t *testing.T) {
+	b, storage := getBackend(t)
+	configureBackend(t, b, storage)
+	createRole(t, b, storage, "my-role", "c,d")
+
+	const keys, logins = 8, 5
+	vks := make([]*virtualKey, keys)
+	for i := range vks {
+		vk, err := newVirtualKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		registerDevice(t, b, storage, vk, "shared", "my-role")
+		vks[i] = vk
+	}
+
+	// Each key logs in on its own, all of them update the same device
+	concurrently(t, keys, func(i int) error {
+		for j := 0; j < logins; j++ {
+			if err := loginConcurrently(b, storage, vks[i], "shared"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	for _, reg := range readDevice(t, b, storage, "shared")["registrations"].([]map[string]interface{}) {
+		if reg["counter"] != uint(logins) {
+			t.Fatalf("expected every counter to be %d, got %#v", logins, reg)
+		}
+	}
+}
+
+func TestLocks_ChallengeAnsweredOnce(t *testing.T) {
+	b, storage, vk := setupDevice(t, "my-device")
+
+	signReq := signRequest(t, b, storage, "my-device")
+	signResp, err := vk.HandleAuthenticationRequest(*signReq.SignRequestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	var tokens int
+	concurrently(t, 16, func(i int) error {
+		resp, err := signResponse(b, storage, "my-device", signReq.ChallengeID, &u2f.SignResponse{
+			KeyHandle:     signResp.KeyHandle,
+			SignatureData: signResp.SignatureData,
+			ClientData:    signResp.ClientData,
+		})
+		if err != nil {
+			return err
+		}
+		if resp != nil && resp.Auth != nil {
+			lock.Lock()
+			tokens++
+			lock.Unlock()
+		}
+		return nil
+	})
+	if tokens != 1 {
+		t.Fatalf("expected a single login, got %d", tokens)
+	}
+}
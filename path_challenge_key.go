@@ -0,0 +1,318 @@
+package u2fauth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/ryankurte/go-u2f"
+)
+
+const challengeKeyStoragePath = "config/challenge_key"
+
+// challengeKeyEntry holds the keys used to MAC stateless challenges. The
+// previous key stays valid for one challenge TTL after a rotation so that
+// challenges issued just before it can still be answered.
+type challengeKeyEntry struct {
+	Current []byte `json:"current"`
+
+	Previous []byte `json:"previous,omitempty"`
+
+	RotatedAt time.Time `json:"rotated_at"`
+}
+
+// signedChallenge is the payload of a stateless challenge token.
+type signedChallenge struct {
+	Type string `json:"t"`
+
+	DeviceName string `json:"d"`
+
+	AppID string `json:"a"`
+
+	Challenge []byte `json:"c"`
+
+	IssuedAt int64 `json:"i"`
+
+	ExpiresAt int64 `json:"e"`
+}
+
+// usedChallenges records the stateless challenges already answered until
+// they expire, so that a sign response can not be replayed. The record is
+// kept in memory by each node and tidied up periodically.
+type usedChallenges struct {
+	lock sync.Mutex
+	used map[string]time.Time
+}
+
+// use marks the challenge as answered. It reports false if it already was.
+func (u *usedChallenges) use(c *ChallengeEntry) bool {
+	key := base64.RawURLEncoding.EncodeToString(c.Challenge.Challenge)
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if _, ok := u.used[key]; ok {
+		return false
+	}
+	if u.used == nil {
+		u.used = make(map[string]time.Time)
+	}
+	u.used[key] = c.ExpiresAt
+	return true
+}
+
+// tidy drops the challenges that have expired, they are refused anyway.
+func (u *usedChallenges) tidy(now time.Time) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	for key, expiresAt := range u.used {
+		if now.After(expiresAt) {
+			delete(u.used, key)
+		}
+	}
+}
+
+func pathRotateChallengeKey(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/rotate-challenge-key",
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathRotateChallengeKey,
+				Summary:  "Rotate the key used to sign stateless challenges",
+			},
+		},
+
+		HelpSynopsis:    pathRotateChallengeKeyHelpSyn,
+		HelpDescription: pathRotateChallengeKeyHelpDesc,
+	}
+}
+
+func (b *backend) pathRotateChallengeKey(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	keys, err := b.loadChallengeKeys(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := newChallengeKey()
+	if err != nil {
+		return nil, err
+	}
+
+	newKeys := &challengeKeyEntry{
+		Current:   current,
+		RotatedAt: time.Now(),
+	}
+	if keys != nil {
+		newKeys.Previous = keys.Current
+	}
+
+	return nil, b.storeChallengeKeys(ctx, req.Storage, newKeys)
+}
+
+func newChallengeKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ensureChallengeKeys creates the MAC key if the mount does not have one yet.
+func (b *backend) ensureChallengeKeys(ctx context.Context, s logical.Storage) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	keys, err := b.loadChallengeKeys(ctx, s)
+	if err != nil || keys != nil {
+		return err
+	}
+
+	current, err := newChallengeKey()
+	if err != nil {
+		return err
+	}
+
+	return b.storeChallengeKeys(ctx, s, &challengeKeyEntry{
+		Current:   current,
+		RotatedAt: time.Now(),
+	})
+}
+
+func (b *backend) challengeKeys(ctx context.Context, s logical.Storage) (*challengeKeyEntry, error) {
+	b.lock.RLock()
+	keys := b.cachedChallengeKeys
+	b.lock.RUnlock()
+	if keys != nil {
+		return keys, nil
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.cachedChallengeKeys != nil {
+		return b.cachedChallengeKeys, nil
+	}
+	keys, err := b.loadChallengeKeys(ctx, s)
+	if err != nil || keys == nil {
+		return nil, err
+	}
+	b.cachedChallengeKeys = keys
+	return keys, nil
+}
+
+// loadChallengeKeys reads the keys from storage. The caller holds b.lock.
+func (b *backend) loadChallengeKeys(ctx context.Context, s logical.Storage) (*challengeKeyEntry, error) {
+	entry, err := s.Get(ctx, challengeKeyStoragePath)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result challengeKeyEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// storeChallengeKeys writes the keys and caches them. The caller holds
+// b.lock.
+func (b *backend) storeChallengeKeys(ctx context.Context, s logical.Storage, keys *challengeKeyEntry) error {
+	entry, err := logical.StorageEntryJSON(challengeKeyStoragePath, keys)
+	if err != nil {
+		return err
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return err
+	}
+
+	b.cachedChallengeKeys = keys
+	return nil
+}
+
+// signChallenge packs the challenge into a token MAC'd with the current key,
+// so that it can be verified later without being stored.
+func (b *backend) signChallenge(ctx context.Context, s logical.Storage, config *ConfigEntry, typ, name string, c *u2f.Challenge) (string, error) {
+	keys, err := b.challengeKeys(ctx, s)
+	if err != nil {
+		return "", err
+	}
+	if keys == nil {
+		return "", errChallengeKeyMissing
+	}
+
+	payload, err := json.Marshal(signedChallenge{
+		Type:       typ,
+		DeviceName: name,
+		AppID:      c.AppID,
+		Challenge:  c.Challenge,
+		IssuedAt:   c.Timestamp.Unix(),
+		ExpiresAt:  c.Timestamp.Add(config.challengeTTL()).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	mac := challengeMAC(keys.Current, encoded)
+
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac), nil
+}
+
+// verifySignedChallenge checks the token MAC against the current key, or the
+// previous one within a TTL of the last rotation, and rebuilds the challenge.
+// Like a stored challenge, a token can only be answered once.
+func (b *backend) verifySignedChallenge(ctx context.Context, s logical.Storage, config *ConfigEntry, token, typ, name string) (*ChallengeEntry, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errChallengeNotFound
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errChallengeNotFound
+	}
+
+	keys, err := b.challengeKeys(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		return nil, errChallengeNotFound
+	}
+
+	valid := hmac.Equal(mac, challengeMAC(keys.Current, parts[0]))
+	if !valid && keys.Previous != nil && time.Since(keys.RotatedAt) < config.challengeTTL() {
+		valid = hmac.Equal(mac, challengeMAC(keys.Previous, parts[0]))
+	}
+	if !valid {
+		return nil, errChallengeNotFound
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errChallengeNotFound
+	}
+	var sc signedChallenge
+	if err := json.Unmarshal(payload, &sc); err != nil {
+		return nil, errChallengeNotFound
+	}
+	if sc.Type != typ || sc.DeviceName != name || sc.AppID != config.AppID {
+		return nil, errChallengeNotFound
+	}
+
+	cEntry := &ChallengeEntry{
+		Type:       sc.Type,
+		DeviceName: sc.DeviceName,
+		Challenge: &u2f.Challenge{
+			Challenge:     sc.Challenge,
+			Timestamp:     time.Unix(sc.IssuedAt, 0),
+			AppID:         sc.AppID,
+			TrustedFacets: config.TrustedFacets,
+		},
+		IssuedAt:  time.Unix(sc.IssuedAt, 0),
+		ExpiresAt: time.Unix(sc.ExpiresAt, 0),
+	}
+	if cEntry.expired(time.Now()) {
+		return nil, errChallengeExpired
+	}
+	if !b.usedChallenges.use(cEntry) {
+		return nil, errChallengeNotFound
+	}
+
+	return cEntry, nil
+}
+
+func challengeMAC(key []byte, payload string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+const pathRotateChallengeKeyHelpSyn = `
+Rotate the key used to sign stateless challenges
+`
+
+const pathRotateChallengeKeyHelpDesc = `
+When "stateless_challenges" is enabled on the config endpoint, sign challenges
+are not stored but handed to the client as a token MAC'd with a key held by
+the backend. This endpoint replaces that key. The previous key is still
+accepted for one challenge TTL so outstanding challenges remain valid.
+Answered challenges are remembered in memory by each node until they expire,
+so that a sign response can not be replayed.
+`
@@ -0,0 +1,208 @@
+package u2fauth
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/ryankurte/go-u2f"
+)
+
+func enableStatelessChallenges(t *testing.T, b logical.Backend, s logical.Storage) {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"stateless_challenges": true,
+		},
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+}
+
+func rotateChallengeKey(t *testing.T, b logical.Backend, s logical.Storage) {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config/rotate-challenge-key",
+		Storage:   s,
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+}
+
+func TestStatelessChallenges_Login(t *testing.T) {
+	b, storage, vk := setupDevice(t, "my-device")
+	enableStatelessChallenges(t, b, storage)
+
+	signReq := signRequest(t, b, storage, "my-device")
+	ids, err := storage.List(context.Background(), "challenges/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Fatalf("bad: stateless sign request stored challenges: %v", ids)
+	}
+
+	signResp, err := vk.HandleAuthenticationRequest(*signReq.SignRequestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := signResponse(b, storage, "my-device", signReq.ChallengeID, signResp)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if resp.Auth == nil {
+		t.Fatalf("bad: missing auth: %#v", resp)
+	}
+
+	// A tampered token is refused
+	tampered := signReq.ChallengeID[:len(signReq.ChallengeID)-2] + "AA"
+	resp, err = signResponse(b, storage, "my-device", tampered, signResp)
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected tampered token to be rejected, got err:%v resp:%#v", err, resp)
+	}
+}
+
+func TestStatelessChallenges_Rotation(t *testing.T) {
+	b, storage, vk := setupDevice(t, "my-device")
+	enableStatelessChallenges(t, b, storage)
+
+	first := signRequest(t, b, storage, "my-device")
+	rotateChallengeKey(t, b, storage)
+	second := signRequest(t, b, storage, "my-device")
+
+	// Challenges signed with the previous key are valid for one TTL
+	for _, signReq := range []*signRequestMessage{first, second} {
+		signResp, err := vk.HandleAuthenticationRequest(*signReq.SignRequestMessage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := signResponse(b, storage, "my-device", signReq.ChallengeID, signResp)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v", err, resp)
+		}
+	}
+
+	// Once the rotation is older than the TTL the previous key is dropped
+	third := signRequest(t, b, storage, "my-device")
+	rotateChallengeKey(t, b, storage)
+	keys, err := b.(*backend).challengeKeys(context.Background(), storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys.RotatedAt = time.Now().Add(-defaultChallengeTTL)
+	b.(*backend).lock.Lock()
+	err = b.(*backend).storeChallengeKeys(context.Background(), storage, keys)
+	b.(*backend).lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signResp, err := vk.HandleAuthenticationRequest(*third.SignRequestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := signResponse(b, storage, "my-device", third.ChallengeID, signResp)
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected token from a retired key to be rejected, got err:%v resp:%#v", err, resp)
+	}
+}
+
+func TestStatelessChallenges_Replay(t *testing.T) {
+	b, storage, vk := setupDevice(t, "my-device")
+	enableStatelessChallenges(t, b, storage)
+	writeConfig(t, b, storage, map[string]interface{}{
+		"counter_policy": counterPolicyIgnore,
+	})
+
+	signReq := signRequest(t, b, storage, "my-device")
+	signResp, err := vk.HandleAuthenticationRequest(*signReq.SignRequestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := signResponse(b, storage, "my-device", signReq.ChallengeID, signResp)
+	if err != nil || resp == nil || resp.Auth == nil {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	// The token is refused the second time, whatever the counter policy
+	resp, err = signResponse(b, storage, "my-device", signReq.ChallengeID, signResp)
+	if err != nil || resp == nil || resp.Data["error"] != errChallengeNotFound.Error() {
+		t.Fatalf("expected the replay to be rejected, got err:%v resp:%#v", err, resp)
+	}
+}
+
+// keyWritesStorage records the challenge keys written through it, and takes
+// its time to write them.
+type keyWritesStorage struct {
+	logical.Storage
+	lock   *sync.Mutex
+	writes *[]challengeKeyEntry
+}
+
+func (s keyWritesStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	if entry.Key == challengeKeyStoragePath {
+		var keys challengeKeyEntry
+		if err := entry.DecodeJSON(&keys); err != nil {
+			return err
+		}
+		s.lock.Lock()
+		*s.writes = append(*s.writes, keys)
+		s.lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	return s.Storage.Put(ctx, entry)
+}
+
+func TestStatelessChallenges_ConcurrentRotation(t *testing.T) {
+	b, storage, _ := setupDevice(t, "my-device")
+	enableStatelessChallenges(t, b, storage)
+
+	var writes []challengeKeyEntry
+	recording := keyWritesStorage{Storage: storage, lock: &sync.Mutex{}, writes: &writes}
+	concurrently(t, 8, func(i int) error {
+		_, err := handle(b, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "config/rotate-challenge-key",
+			Storage:   recording,
+		})
+		return err
+	})
+
+	// Every rotation kept the key written by the one before it
+	for i := 1; i < len(writes); i++ {
+		if string(writes[i].Previous) != string(writes[i-1].Current) {
+			t.Fatalf("rotation %d lost the previous key", i)
+		}
+	}
+}
+
+func TestStatelessChallenges_TidyUsed(t *testing.T) {
+	var used usedChallenges
+	expired := &ChallengeEntry{
+		Challenge: &u2f.Challenge{Challenge: []byte("expired")},
+		ExpiresAt: time.Now().Add(-time.Minute),
+	}
+	live := &ChallengeEntry{
+		Challenge: &u2f.Challenge{Challenge: []byte("live")},
+		ExpiresAt: time.Now().Add(time.Minute),
+	}
+	if !used.use(expired) || !used.use(live) {
+		t.Fatal("expected new challenges to be accepted")
+	}
+
+	used.tidy(time.Now())
+	if len(used.used) != 1 {
+		t.Fatalf("bad: used challenges after tidy: %v", used.used)
+	}
+	if used.use(live) {
+		t.Fatal("expected a challenge that has not expired to stay used")
+	}
+}
@@ -0,0 +1,533 @@
+package u2fauth
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	counterPolicyStrict = "strict"
+	counterPolicyWarn   = "warn"
+	counterPolicyIgnore = "ignore"
+)
+
+const (
+	aliasNameSourceUserName = "user_name"
+	aliasNameSourceUserID   = "user_id"
+)
+
+const (
+	androidFacetPrefix = "android:apk-key-hash:"
+	iosFacetPrefix     = "ios:bundle-id:"
+)
+
+var bundleIDRegex = regexp.MustCompile(`^[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)+$`)
+
+// ConfigEntry holds the mount-wide settings used to build and verify
+// u2f challenges.
+type ConfigEntry struct {
+	AppID string `json:"app_id"`
+
+	TrustedFacets []string `json:"trusted_facets"`
+
+	ChallengeTTL time.Duration `json:"challenge_ttl"`
+
+	StatelessChallenges bool `json:"stateless_challenges"`
+
+	CounterPolicy string `json:"counter_policy"`
+
+	UpgradeU2FRegistrations bool `json:"upgrade_u2f_registrations"`
+
+	// SelfEnrollmentLimit is the number of keys a user may add with an
+	// already registered key, zero disables self-enrollment
+	SelfEnrollmentLimit int `json:"self_enrollment_limit"`
+
+	// RecoveryRole is the role of tokens issued for recovery codes, empty
+	// disables recovery logins
+	RecoveryRole string `json:"recovery_role"`
+
+	// AliasNameSource selects whether entity aliases are named after the
+	// user name or the user ID, which survives renaming the user
+	AliasNameSource string `json:"alias_name_source"`
+
+	// LockoutThreshold is the number of consecutive failed logins that lock
+	// a device or key out for LockoutDuration, zero disables lockouts. Each
+	// failure before that delays the next attempt by LockoutBackoff, doubled
+	// for every further failure.
+	LockoutThreshold int `json:"lockout_threshold"`
+
+	LockoutBackoff time.Duration `json:"lockout_backoff"`
+
+	LockoutDuration time.Duration `json:"lockout_duration"`
+
+	// RateLimitPerName and RateLimitPerAddress are the number of calls per
+	// minute the unauthenticated endpoints accept for a device name and for
+	// a client address, zero disables the limit
+	RateLimitPerName int `json:"rate_limit_per_name"`
+
+	RateLimitPerAddress int `json:"rate_limit_per_address"`
+
+	RateLimitBurst int `json:"rate_limit_burst"`
+
+	// HideUnknownNames answers sign requests for names without a usable key
+	// with fake key handles instead of an error
+	HideUnknownNames bool `json:"hide_unknown_names"`
+}
+
+func (c *ConfigEntry) aliasNameSource() string {
+	if c.AliasNameSource == "" {
+		return aliasNameSourceUserName
+	}
+	return c.AliasNameSource
+}
+
+func (c *ConfigEntry) rateLimitBurst() int {
+	if c.RateLimitBurst == 0 {
+		return defaultRateLimitBurst
+	}
+	return c.RateLimitBurst
+}
+
+func (c *ConfigEntry) counterPolicy() string {
+	if c.CounterPolicy == "" {
+		return counterPolicyStrict
+	}
+	return c.CounterPolicy
+}
+
+func (c *ConfigEntry) challengeTTL() time.Duration {
+	if c.ChallengeTTL == 0 {
+		return defaultChallengeTTL
+	}
+	return c.ChallengeTTL
+}
+
+func pathConfig(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config",
+		Fields: map[string]*framework.FieldSchema{
+			"app_id": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "U2F application ID, an https origin such as https://vault.example.com.",
+			},
+			"trusted_facets": &framework.FieldSchema{
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Comma-separated list of facets allowed to use the application ID. Accepts https origins, android:apk-key-hash: and ios:bundle-id: facets. Defaults to the origin of app_id.",
+			},
+			"challenge_ttl": &framework.FieldSchema{
+				Type:        framework.TypeDurationSecond,
+				Description: "Duration a challenge stays valid. Defaults to and may not exceed 5 minutes.",
+			},
+			"stateless_challenges": &framework.FieldSchema{
+				Type:        framework.TypeBool,
+				Description: "If set, sign challenges are returned as MAC'd tokens instead of being stored.",
+			},
+			"counter_policy": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: `Action taken when an authenticator counter does not increase: "strict" quarantines the key handle, "warn" logs a warning and "ignore" does nothing. Defaults to "strict".`,
+			},
+			"upgrade_u2f_registrations": &framework.FieldSchema{
+				Type:        framework.TypeBool,
+				Description: "If set, a u2f registration used for a WebAuthn login is converted into a WebAuthn credential.",
+			},
+			"self_enrollment_limit": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: "Number of keys a user may add by proving possession of an already registered key. Defaults to 0, which disables self-enrollment.",
+			},
+			"recovery_role": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Role of the tokens issued for recovery codes. Recovery logins are disabled when empty.",
+			},
+			"alias_name_source": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: `Name of the entity alias of a login: "user_name" for "u2f_<user>", or "user_id" for the generated ID of the user, which does not change when the user is renamed. Defaults to "user_name".`,
+			},
+			"lockout_threshold": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: "Number of consecutive failed logins that lock a device or key out. Defaults to 0, which disables lockouts.",
+			},
+			"lockout_backoff": &framework.FieldSchema{
+				Type:        framework.TypeDurationSecond,
+				Description: "Delay before another login is accepted after a failure, doubled for every further failure. Defaults to 0.",
+			},
+			"lockout_duration": &framework.FieldSchema{
+				Type:        framework.TypeDurationSecond,
+				Description: "Duration of a lockout once lockout_threshold is reached. Defaults to 15 minutes.",
+			},
+			"rate_limit_per_name": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: "Number of calls per minute the login and enrollment endpoints accept for a device name. Defaults to 0, which disables the limit.",
+			},
+			"rate_limit_per_address": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: "Number of calls per minute the login and enrollment endpoints accept from a client address. Defaults to 0, which disables the limit.",
+			},
+			"rate_limit_burst": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: "Number of calls accepted at once before the rate limits apply. Defaults to 10.",
+			},
+			"hide_unknown_names": &framework.FieldSchema{
+				Type:        framework.TypeBool,
+				Description: "If set, sign requests for unknown names get fake key handles and fail like a wrong signature, instead of revealing that the name does not exist.",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathConfigRead,
+				Summary:  "Read the u2f configuration",
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathConfigWrite,
+				Summary:  "Configure the u2f application ID and trusted facets",
+			},
+		},
+
+		HelpSynopsis:    pathConfigHelpSyn,
+		HelpDescription: pathConfigHelpDesc,
+	}
+}
+
+func (b *backend) config(ctx context.Context, s logical.Storage) (*ConfigEntry, error) {
+	entry, err := s.Get(ctx, "config")
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result ConfigEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func (b *backend) setConfig(ctx context.Context, s logical.Storage, config *ConfigEntry) error {
+	entry, err := logical.StorageEntryJSON("config", config)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+func (b *backend) pathConfigRead(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"app_id":         config.AppID,
+			"trusted_facets": config.TrustedFacets,
+			"challenge_ttl":  int64(config.challengeTTL().Seconds()),
+
+			"stateless_challenges": config.StatelessChallenges,
+			"counter_policy":       config.counterPolicy(),
+
+			"upgrade_u2f_registrations": config.UpgradeU2FRegistrations,
+			"self_enrollment_limit":     config.SelfEnrollmentLimit,
+			"recovery_role":             config.RecoveryRole,
+			"alias_name_source":         config.aliasNameSource(),
+
+			"lockout_threshold": config.LockoutThreshold,
+			"lockout_backoff":   int64(config.LockoutBackoff.Seconds()),
+			"lockout_duration":  int64(config.LockoutDuration.Seconds()),
+
+			"rate_limit_per_name":    config.RateLimitPerName,
+			"rate_limit_per_address": config.RateLimitPerAddress,
+			"rate_limit_burst":       config.rateLimitBurst(),
+
+			"hide_unknown_names": config.HideUnknownNames,
+		},
+	}, nil
+}
+
+func (b *backend) pathConfigWrite(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = &ConfigEntry{}
+	}
+
+	if appIDRaw, ok := d.GetOk("app_id"); ok {
+		config.AppID = appIDRaw.(string)
+	}
+	if config.AppID == "" {
+		return logical.ErrorResponse("missing app_id"), logical.ErrInvalidRequest
+	}
+	appURL, err := parseAppID(config.AppID)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
+	if facetsRaw, ok := d.GetOk("trusted_facets"); ok {
+		config.TrustedFacets = facetsRaw.([]string)
+	}
+	if len(config.TrustedFacets) == 0 {
+		config.TrustedFacets = []string{appURL.Scheme + "://" + appURL.Host}
+	}
+	for _, facet := range config.TrustedFacets {
+		if err := validateFacet(appURL, facet); err != nil {
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		}
+	}
+
+	if ttlRaw, ok := d.GetOk("challenge_ttl"); ok {
+		config.ChallengeTTL = time.Duration(ttlRaw.(int)) * time.Second
+	}
+	if config.ChallengeTTL < 0 || config.ChallengeTTL > defaultChallengeTTL {
+		return logical.ErrorResponse(fmt.Sprintf("challenge_ttl must be between 1s and %s", defaultChallengeTTL)), logical.ErrInvalidRequest
+	}
+
+	if policyRaw, ok := d.GetOk("counter_policy"); ok {
+		config.CounterPolicy = strings.ToLower(policyRaw.(string))
+	}
+	switch config.CounterPolicy {
+	case "", counterPolicyStrict, counterPolicyWarn, counterPolicyIgnore:
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("invalid counter_policy %q", config.CounterPolicy)), logical.ErrInvalidRequest
+	}
+
+	if upgradeRaw, ok := d.GetOk("upgrade_u2f_registrations"); ok {
+		config.UpgradeU2FRegistrations = upgradeRaw.(bool)
+	}
+
+	if limitRaw, ok := d.GetOk("self_enrollment_limit"); ok {
+		config.SelfEnrollmentLimit = limitRaw.(int)
+	}
+	if config.SelfEnrollmentLimit < 0 {
+		return logical.ErrorResponse("self_enrollment_limit must not be negative"), logical.ErrInvalidRequest
+	}
+
+	if roleRaw, ok := d.GetOk("recovery_role"); ok {
+		config.RecoveryRole = strings.ToLower(roleRaw.(string))
+	}
+	if config.RecoveryRole != "" {
+		roleEntry, err := b.role(ctx, req.Storage, config.RecoveryRole)
+		if err != nil {
+			return nil, err
+		}
+		if roleEntry == nil {
+			return logical.ErrorResponse(fmt.Sprintf("recovery_role %q not found", config.RecoveryRole)), logical.ErrInvalidRequest
+		}
+	}
+
+	if sourceRaw, ok := d.GetOk("alias_name_source"); ok {
+		config.AliasNameSource = strings.ToLower(sourceRaw.(string))
+	}
+	switch config.AliasNameSource {
+	case "", aliasNameSourceUserName, aliasNameSourceUserID:
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("invalid alias_name_source %q", config.AliasNameSource)), logical.ErrInvalidRequest
+	}
+
+	if thresholdRaw, ok := d.GetOk("lockout_threshold"); ok {
+		config.LockoutThreshold = thresholdRaw.(int)
+	}
+	if backoffRaw, ok := d.GetOk("lockout_backoff"); ok {
+		config.LockoutBackoff = time.Duration(backoffRaw.(int)) * time.Second
+	}
+	if durationRaw, ok := d.GetOk("lockout_duration"); ok {
+		config.LockoutDuration = time.Duration(durationRaw.(int)) * time.Second
+	}
+	if config.LockoutThreshold < 0 || config.LockoutBackoff < 0 || config.LockoutDuration < 0 {
+		return logical.ErrorResponse("lockout_threshold, lockout_backoff and lockout_duration must not be negative"), logical.ErrInvalidRequest
+	}
+
+	if rateRaw, ok := d.GetOk("rate_limit_per_name"); ok {
+		config.RateLimitPerName = rateRaw.(int)
+	}
+	if rateRaw, ok := d.GetOk("rate_limit_per_address"); ok {
+		config.RateLimitPerAddress = rateRaw.(int)
+	}
+	if burstRaw, ok := d.GetOk("rate_limit_burst"); ok {
+		config.RateLimitBurst = burstRaw.(int)
+	}
+	if config.RateLimitPerName < 0 || config.RateLimitPerAddress < 0 || config.RateLimitBurst < 0 {
+		return logical.ErrorResponse("rate_limit_per_name, rate_limit_per_address and rate_limit_burst must not be negative"), logical.ErrInvalidRequest
+	}
+
+	if hideRaw, ok := d.GetOk("hide_unknown_names"); ok {
+		config.HideUnknownNames = hideRaw.(bool)
+	}
+	if config.HideUnknownNames {
+		if err := b.ensureDecoyKey(ctx, req.Storage); err != nil {
+			return nil, err
+		}
+	}
+
+	if statelessRaw, ok := d.GetOk("stateless_challenges"); ok {
+		config.StatelessChallenges = statelessRaw.(bool)
+	}
+	if config.StatelessChallenges {
+		if err := b.ensureChallengeKeys(ctx, req.Storage); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, b.setConfig(ctx, req.Storage, config)
+}
+
+// parseAppID checks that the application ID is an https URL with a host.
+func parseAppID(appID string) (*url.URL, error) {
+	u, err := url.Parse(appID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid app_id: %v", err)
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("app_id must be an https URL")
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("app_id is missing a host")
+	}
+
+	return u, nil
+}
+
+// validateFacet checks that a facet is either an Android or iOS facet, or
+// an https origin within the same registrable domain as the application ID,
+// as required by the FIDO AppID and Facet specification.
+func validateFacet(appURL *url.URL, facet string) error {
+	switch {
+	case strings.HasPrefix(facet, androidFacetPrefix):
+		return validateAndroidFacet(facet)
+	case strings.HasPrefix(facet, iosFacetPrefix):
+		return validateIOSFacet(facet)
+	}
+
+	u, err := url.Parse(facet)
+	if err != nil {
+		return fmt.Errorf("invalid facet %q: %v", facet, err)
+	}
+	if u.Scheme != "https" || u.Hostname() == "" {
+		return fmt.Errorf("facet %q must be an https origin", facet)
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("facet %q must not contain a path, query or fragment", facet)
+	}
+	if registrableDomain(u.Hostname()) != registrableDomain(appURL.Hostname()) {
+		return fmt.Errorf("facet %q does not share the domain of app_id %q", facet, appURL.String())
+	}
+
+	return nil
+}
+
+// validateAndroidFacet checks that the facet carries a base64 encoded
+// SHA-1 or SHA-256 hash of the APK signing certificate.
+func validateAndroidFacet(facet string) error {
+	keyHash := strings.TrimRight(strings.TrimPrefix(facet, androidFacetPrefix), "=")
+	raw, err := base64.RawStdEncoding.DecodeString(keyHash)
+	if err != nil {
+		raw, err = base64.RawURLEncoding.DecodeString(keyHash)
+	}
+	if err != nil {
+		return fmt.Errorf("facet %q does not contain a base64 encoded apk key hash", facet)
+	}
+	if len(raw) != sha1.Size && len(raw) != sha256.Size {
+		return fmt.Errorf("facet %q must contain a SHA-1 or SHA-256 apk key hash", facet)
+	}
+
+	return nil
+}
+
+// validateIOSFacet checks that the facet carries a bundle identifier.
+func validateIOSFacet(facet string) error {
+	if !bundleIDRegex.MatchString(strings.TrimPrefix(facet, iosFacetPrefix)) {
+		return fmt.Errorf("facet %q does not contain a valid bundle identifier", facet)
+	}
+
+	return nil
+}
+
+// registrableDomain returns the eTLD+1 of the host, or the host itself when
+// it has none, such as for IP addresses and single label names.
+func registrableDomain(host string) string {
+	host = strings.ToLower(host)
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+
+	return domain
+}
+
+const pathConfigHelpSyn = `
+Configure the u2f application ID and trusted facets
+`
+
+const pathConfigHelpDesc = `
+This endpoint configures the application ID presented to u2f devices and the
+facets trusted to use it. The application ID must be an https URL and every
+web facet must be an https origin in the same registrable domain. Mobile
+applications are trusted with "android:apk-key-hash:<hash>" and
+"ios:bundle-id:<bundle id>" facets.
+
+With "stateless_challenges" set, sign challenges are not written to storage
+but returned as a token MAC'd with a backend key, see
+"config/rotate-challenge-key".
+
+u2f registrations can be used for WebAuthn logins through the appid
+extension. With "upgrade_u2f_registrations" set, such a registration is
+converted into a WebAuthn credential on its first WebAuthn login and is no
+longer offered to the u2f endpoints.
+
+With "self_enrollment_limit" set, users may add up to that many backup keys
+through "selfEnrollRequest" and "selfEnrollResponse", by signing with a key
+they already registered.
+
+"recovery_role" is the role of the tokens issued by "recoveryLogin" for
+recovery codes. Recovery logins are refused while it is empty.
+
+"alias_name_source" names the entity alias of logins after the user name,
+"u2f_<user>", or after the generated ID of the user with "user_id". Only
+the latter keeps the entity when a user is renamed.
+
+After "lockout_threshold" consecutive failed logins a device or key is
+locked out for "lockout_duration". Each failure before that delays the next
+attempt by "lockout_backoff", doubled for every further failure. Roles can
+override these settings.
+
+"rate_limit_per_name" and "rate_limit_per_address" limit the calls per
+minute to the unauthenticated login and enrollment endpoints for a device
+name and for a client address, after a burst of "rate_limit_burst" calls.
+Calls over a limit get a 429 response with the seconds to wait in
+"retry_after", and in a Retry-After header when the mount is tuned with
+allowed_response_headers=Retry-After. Rejections are counted in the
+u2f.rate_limit.rejected metric and logged as warnings. The limits are kept in
+memory by each node.
+
+With "hide_unknown_names" set, a sign request for a name without a usable key
+gets fake key handles derived from a secret of the mount, and the sign
+response then fails like a wrong signature, so that names cannot be
+enumerated through the unauthenticated endpoints. This applies to the u2f,
+WebAuthn and self-enrollment endpoints, and a locked out key also fails like
+a wrong signature instead of telling it is locked out.
+
+Registration and authentication requests are refused until this endpoint
+has been written.
+`
@@ -0,0 +1,248 @@
+package u2fauth
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/ryankurte/go-u2f"
+)
+
+const attestationConfigStoragePath = "config/attestation"
+
+var (
+	errAttestationRootsMissing = errors.New("attestation is required but no trust roots are configured")
+	errAttestationMissing      = errors.New("attestation is required but the authenticator did not provide a certificate")
+	errAttestationUnverified   = errors.New("the role only allows known authenticators but the attestation is not verified")
+)
+
+// AttestationConfig holds the roots trusted to issue authenticator
+// attestation certificates.
+type AttestationConfig struct {
+	TrustRoots string `json:"trust_roots"`
+
+	RequireAttestation bool `json:"require_attestation"`
+}
+
+// pool parses the PEM trust roots into a certificate pool.
+func (c *AttestationConfig) pool() (*x509.CertPool, []*x509.Certificate, error) {
+	pool := x509.NewCertPool()
+	var certs []*x509.Certificate
+
+	rest := []byte(c.TrustRoots)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool.AddCert(cert)
+		certs = append(certs, cert)
+	}
+
+	return pool, certs, nil
+}
+
+func pathConfigAttestation(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/attestation",
+		Fields: map[string]*framework.FieldSchema{
+			"trust_roots": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "PEM encoded certificates trusted to issue attestation certificates, such as the Yubico U2F root CA.",
+			},
+			"require_attestation": &framework.FieldSchema{
+				Type:        framework.TypeBool,
+				Description: "If set, every registration must present an attestation certificate issued by one of the trust roots.",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathConfigAttestationRead,
+				Summary:  "Read the attestation trust roots",
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathConfigAttestationWrite,
+				Summary:  "Configure the attestation trust roots",
+			},
+		},
+
+		HelpSynopsis:    pathConfigAttestationHelpSyn,
+		HelpDescription: pathConfigAttestationHelpDesc,
+	}
+}
+
+func (b *backend) attestationConfig(ctx context.Context, s logical.Storage) (*AttestationConfig, error) {
+	entry, err := s.Get(ctx, attestationConfigStoragePath)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result AttestationConfig
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func (b *backend) pathConfigAttestationRead(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := b.attestationConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return nil, nil
+	}
+
+	_, certs, err := config.pool()
+	if err != nil {
+		return nil, err
+	}
+	subjects := []string{}
+	for _, cert := range certs {
+		subjects = append(subjects, cert.Subject.String())
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"trust_roots":         config.TrustRoots,
+			"trust_root_subjects": subjects,
+			"require_attestation": config.RequireAttestation,
+		},
+	}, nil
+}
+
+func (b *backend) pathConfigAttestationWrite(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := b.attestationConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = &AttestationConfig{}
+	}
+
+	if rootsRaw, ok := d.GetOk("trust_roots"); ok {
+		config.TrustRoots = strings.TrimSpace(rootsRaw.(string))
+	}
+	if requireRaw, ok := d.GetOk("require_attestation"); ok {
+		config.RequireAttestation = requireRaw.(bool)
+	}
+
+	_, certs, err := config.pool()
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("invalid trust_roots: %v", err)), logical.ErrInvalidRequest
+	}
+	if config.TrustRoots != "" && len(certs) == 0 {
+		return logical.ErrorResponse("trust_roots does not contain any PEM certificate"), logical.ErrInvalidRequest
+	}
+	if config.RequireAttestation && len(certs) == 0 {
+		return logical.ErrorResponse(errAttestationRootsMissing.Error()), logical.ErrInvalidRequest
+	}
+
+	entry, err := logical.StorageEntryJSON(attestationConfigStoragePath, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, req.Storage.Put(ctx, entry)
+}
+
+// registrationCertificate parses the attestation certificate of a u2f
+// registration.
+func registrationCertificate(reg *u2f.Registration) (*x509.Certificate, error) {
+	der, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(reg.Certificate, "="))
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// verifyAttestation checks the attestation certificate of a new key, and the
+// intermediates sent along with it, against the trust roots. The certificate
+// subject, serial and key identifier are always recorded; an untrusted or
+// missing certificate is only an error when the mount or the role requires
+// attestation.
+func (b *backend) verifyAttestation(ctx context.Context, s logical.Storage, roleEntry *RoleEntry, cert *x509.Certificate, intermediates []*x509.Certificate, att *Attestation) error {
+	config, err := b.attestationConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+	required := roleEntry.RequireAttestation || (config != nil && config.RequireAttestation)
+
+	if cert == nil {
+		if required {
+			return errAttestationMissing
+		}
+		return nil
+	}
+	att.AttestationSubject = cert.Subject.String()
+	att.AttestationSerial = cert.SerialNumber.String()
+	att.AttestationKeyID, err = attestationKeyID(cert)
+	if err != nil {
+		return err
+	}
+
+	if config == nil || config.TrustRoots == "" {
+		if required {
+			return errAttestationRootsMissing
+		}
+		return nil
+	}
+
+	pool, _, err := config.pool()
+	if err != nil {
+		return err
+	}
+	intermediatePool := x509.NewCertPool()
+	for _, c := range intermediates {
+		intermediatePool.AddCert(c)
+	}
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediatePool,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	att.AttestationVerified = err == nil
+	if err != nil && required {
+		return fmt.Errorf("attestation certificate is not trusted: %v", err)
+	}
+
+	return nil
+}
+
+const pathConfigAttestationHelpSyn = `
+Configure the roots trusted to issue attestation certificates
+`
+
+const pathConfigAttestationHelpDesc = `
+Every u2f device presents an attestation certificate when it is registered.
+This endpoint stores PEM encoded roots, such as the Yubico U2F root CA, that
+those certificates must chain to.
+
+When "require_attestation" is set here or on the role a device is registered
+with, registrations whose attestation certificate does not chain to one of
+the roots are refused. The subject and serial of the attestation certificate
+are recorded with every registration.
+`
@@ -0,0 +1,101 @@
+package u2fauth
+
+import (
+	"context"
+	"encoding/pem"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestConfigAttestation_RequireAttestation(t *testing.T) {
+	b, storage := getBackend(t)
+	configureBackend(t, b, storage)
+	createRole(t, b, storage, "my-role", "c,d")
+
+	ca, caKey, err := newAttestationCA("Test U2F Root CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config/attestation",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"trust_roots":         string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})),
+			"require_attestation": true,
+		},
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	trusted, err := newAttestedVirtualKey(ca, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerDevice(t, b, storage, trusted, "trusted-device", "my-role")
+
+	dEntry, err := b.(*backend).device(context.Background(), storage, "trusted-device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	regEntry := dEntry.Registration[0]
+	if !regEntry.AttestationVerified || regEntry.AttestationSubject != "CN=Virtual U2F Device" || regEntry.AttestationSerial == "" {
+		t.Fatalf("bad: registration: %#v", regEntry)
+	}
+
+	untrusted, err := newVirtualKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = tryRegisterDevice(t, b, storage, untrusted, "untrusted-device", "my-role")
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected untrusted attestation to be refused, got err:%v resp:%#v", err, resp)
+	}
+}
+
+func TestConfigAttestation_RoleRequireAttestation(t *testing.T) {
+	b, storage := getBackend(t)
+	configureBackend(t, b, storage)
+	createRole(t, b, storage, "my-role", "c,d")
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "roles/hardware-only",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"token_policies":      "c,d",
+			"require_attestation": true,
+		},
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	vk, err := newVirtualKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without trust roots, only roles that do not require attestation work
+	registerDevice(t, b, storage, vk, "my-device", "my-role")
+	resp, err = tryRegisterDevice(t, b, storage, vk, "hardware-device", "hardware-only")
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected registration to be refused, got err:%v resp:%#v", err, resp)
+	}
+	if resp.Error().Error() != errAttestationRootsMissing.Error() {
+		t.Fatalf("bad: error: %v", resp.Error())
+	}
+
+	dEntry, err := b.(*backend).device(context.Background(), storage, "my-device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dEntry.Registration[0].AttestationVerified || dEntry.Registration[0].AttestationSubject == "" {
+		t.Fatalf("bad: registration: %#v", dEntry.Registration[0])
+	}
+}
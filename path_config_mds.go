@@ -0,0 +1,417 @@
+package u2fauth
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const (
+	mdsConfigStoragePath = "config/mds"
+	mdsInfoStoragePath   = "mds/info"
+	mdsEntriesPrefix     = "mds/entries/"
+)
+
+// MDSConfig holds the root the FIDO Metadata Service blob must chain to.
+type MDSConfig struct {
+	RootCertificate string `json:"root_certificate"`
+}
+
+// MDSInfo describes the last imported metadata blob.
+type MDSInfo struct {
+	Number int `json:"no"`
+
+	NextUpdate string `json:"next_update"`
+
+	LegalHeader string `json:"legal_header"`
+
+	Entries int `json:"entries"`
+
+	ImportedAt time.Time `json:"imported_at"`
+}
+
+// MDSEntry is the part of a metadata blob entry needed to enforce role
+// authenticator policies. It is stored once per AAGUID and once per
+// attestation certificate key identifier.
+type MDSEntry struct {
+	AAGUID string `json:"aaguid,omitempty"`
+
+	AttestationCertificateKeyIdentifiers []string `json:"attestation_certificate_key_identifiers,omitempty"`
+
+	Description string `json:"description"`
+
+	Statuses []string `json:"statuses"`
+}
+
+// mdsBlobPayload is the payload of a FIDO MDS3 blob.
+type mdsBlobPayload struct {
+	LegalHeader string `json:"legalHeader"`
+	Number      int    `json:"no"`
+	NextUpdate  string `json:"nextUpdate"`
+	Entries     []struct {
+		AAGUID                               string   `json:"aaguid"`
+		AttestationCertificateKeyIdentifiers []string `json:"attestationCertificateKeyIdentifiers"`
+		MetadataStatement                    struct {
+			Description string `json:"description"`
+		} `json:"metadataStatement"`
+		StatusReports []struct {
+			Status string `json:"status"`
+		} `json:"statusReports"`
+	} `json:"entries"`
+}
+
+func pathConfigMDS(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/mds",
+		Fields: map[string]*framework.FieldSchema{
+			"root_certificate": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "PEM encoded root certificate the metadata blob signing chain must lead to.",
+			},
+			"blob": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "FIDO Metadata Service (MDS3) blob, a signed JWT, downloaded by an administrator.",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathConfigMDSRead,
+				Summary:  "Read the metadata service root and the imported blob details",
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathConfigMDSWrite,
+				Summary:  "Configure the metadata service root or import a metadata blob",
+			},
+		},
+
+		HelpSynopsis:    pathConfigMDSHelpSyn,
+		HelpDescription: pathConfigMDSHelpDesc,
+	}
+}
+
+func (b *backend) mdsConfig(ctx context.Context, s logical.Storage) (*MDSConfig, error) {
+	entry, err := s.Get(ctx, mdsConfigStoragePath)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result MDSConfig
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func (b *backend) mdsInfo(ctx context.Context, s logical.Storage) (*MDSInfo, error) {
+	entry, err := s.Get(ctx, mdsInfoStoragePath)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result MDSInfo
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// mdsEntry looks up the metadata of an authenticator by AAGUID or by
+// attestation certificate key identifier.
+func (b *backend) mdsEntry(ctx context.Context, s logical.Storage, id string) (*MDSEntry, error) {
+	entry, err := s.Get(ctx, mdsEntriesPrefix+strings.ToLower(id))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result MDSEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func (b *backend) pathConfigMDSRead(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := b.mdsConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return nil, nil
+	}
+
+	respData := map[string]interface{}{
+		"root_certificate": config.RootCertificate,
+	}
+
+	info, err := b.mdsInfo(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if info != nil {
+		respData["no"] = info.Number
+		respData["next_update"] = info.NextUpdate
+		respData["legal_header"] = info.LegalHeader
+		respData["entries"] = info.Entries
+		respData["imported_at"] = info.ImportedAt.Format(time.RFC3339)
+	}
+
+	return &logical.Response{
+		Data: respData,
+	}, nil
+}
+
+func (b *backend) pathConfigMDSWrite(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := b.mdsConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = &MDSConfig{}
+	}
+
+	if rootRaw, ok := d.GetOk("root_certificate"); ok {
+		config.RootCertificate = strings.TrimSpace(rootRaw.(string))
+
+		_, certs, err := (&AttestationConfig{TrustRoots: config.RootCertificate}).pool()
+		if err != nil || len(certs) == 0 {
+			return logical.ErrorResponse("root_certificate must be a PEM encoded certificate"), logical.ErrInvalidRequest
+		}
+
+		entry, err := logical.StorageEntryJSON(mdsConfigStoragePath, config)
+		if err != nil {
+			return nil, err
+		}
+		if err := req.Storage.Put(ctx, entry); err != nil {
+			return nil, err
+		}
+	}
+
+	blob := strings.TrimSpace(d.Get("blob").(string))
+	if blob == "" {
+		return nil, nil
+	}
+	if config.RootCertificate == "" {
+		return logical.ErrorResponse("root_certificate must be configured before importing a blob"), logical.ErrInvalidRequest
+	}
+
+	payload, err := verifyMDSBlob(config, blob)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
+	if err := b.importMDSBlob(ctx, req.Storage, payload); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// verifyMDSBlob checks that the blob is signed by a certificate chaining to
+// the configured root and returns its payload.
+func verifyMDSBlob(config *MDSConfig, blob string) (*mdsBlobPayload, error) {
+	jws, err := jose.ParseSigned(blob)
+	if err != nil {
+		return nil, fmt.Errorf("invalid blob: %v", err)
+	}
+	if len(jws.Signatures) != 1 {
+		return nil, fmt.Errorf("invalid blob: expected a single signature")
+	}
+
+	roots, _, err := (&AttestationConfig{TrustRoots: config.RootCertificate}).pool()
+	if err != nil {
+		return nil, err
+	}
+	chains, err := jws.Signatures[0].Protected.Certificates(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("blob signing certificate is not trusted: %v", err)
+	}
+
+	raw, err := jws.Verify(chains[0][0].PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid blob signature: %v", err)
+	}
+
+	var payload mdsBlobPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return nil, fmt.Errorf("invalid blob payload: %v", err)
+	}
+
+	return &payload, nil
+}
+
+// importMDSBlob replaces the stored metadata entries with those of the blob.
+func (b *backend) importMDSBlob(ctx context.Context, s logical.Storage, payload *mdsBlobPayload) error {
+	entries := map[string]*MDSEntry{}
+	for _, e := range payload.Entries {
+		mEntry := &MDSEntry{
+			AAGUID:      strings.ToLower(e.AAGUID),
+			Description: e.MetadataStatement.Description,
+		}
+		for _, id := range e.AttestationCertificateKeyIdentifiers {
+			mEntry.AttestationCertificateKeyIdentifiers = append(mEntry.AttestationCertificateKeyIdentifiers, strings.ToLower(id))
+		}
+		for _, report := range e.StatusReports {
+			mEntry.Statuses = append(mEntry.Statuses, report.Status)
+		}
+
+		if mEntry.AAGUID != "" {
+			entries[mEntry.AAGUID] = mEntry
+		}
+		for _, id := range mEntry.AttestationCertificateKeyIdentifiers {
+			entries[id] = mEntry
+		}
+	}
+
+	for id, mEntry := range entries {
+		entry, err := logical.StorageEntryJSON(mdsEntriesPrefix+id, mEntry)
+		if err != nil {
+			return err
+		}
+		if err := s.Put(ctx, entry); err != nil {
+			return err
+		}
+	}
+
+	existing, err := s.List(ctx, mdsEntriesPrefix)
+	if err != nil {
+		return err
+	}
+	for _, id := range existing {
+		if _, ok := entries[id]; ok {
+			continue
+		}
+		if err := s.Delete(ctx, mdsEntriesPrefix+id); err != nil {
+			return err
+		}
+	}
+
+	entry, err := logical.StorageEntryJSON(mdsInfoStoragePath, &MDSInfo{
+		Number:      payload.Number,
+		NextUpdate:  payload.NextUpdate,
+		LegalHeader: payload.LegalHeader,
+		Entries:     len(payload.Entries),
+		ImportedAt:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+// attestationKeyID returns the attestation certificate key identifier of a
+// certificate as used by the metadata service: the hex SHA-1 of its
+// subjectPublicKey. It is computed rather than read from the certificate so
+// that it cannot be claimed by a certificate for another key.
+func attestationKeyID(cert *x509.Certificate) (string, error) {
+	var spki struct {
+		Algorithm        asn1.RawValue
+		SubjectPublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(cert.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return "", err
+	}
+
+	sum := sha1.Sum(spki.SubjectPublicKey.Bytes)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// checkAuthenticatorPolicy enforces the role allowed_authenticators and
+// denied_status lists for a new key. The authenticator is known by the key
+// identifier of its attestation certificate and by its AAGUID, which is only
+// given when the certificate vouches for it. The allowed_authenticators list
+// is never met by an attestation that is not verified against the trust
+// roots, since the authenticator could claim any identifier.
+func (b *backend) checkAuthenticatorPolicy(ctx context.Context, s logical.Storage, roleEntry *RoleEntry, att *Attestation, aaguid string) error {
+	var ids []string
+	for _, id := range []string{aaguid, att.AttestationKeyID} {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+
+	if len(roleEntry.AllowedAuthenticators) > 0 {
+		if !att.AttestationVerified {
+			return errAttestationUnverified
+		}
+		allowed := false
+		for _, id := range ids {
+			if strutil.StrListContains(roleEntry.AllowedAuthenticators, strings.ToLower(id)) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("authenticator is not allowed by the role")
+		}
+	}
+
+	if len(roleEntry.DeniedStatus) == 0 {
+		return nil
+	}
+	for _, id := range ids {
+		mEntry, err := b.mdsEntry(ctx, s, id)
+		if err != nil {
+			return err
+		}
+		if mEntry == nil {
+			continue
+		}
+		for _, status := range mEntry.Statuses {
+			if strutil.StrListContains(roleEntry.DeniedStatus, status) {
+				return fmt.Errorf("authenticator %q has status %s", mEntry.Description, status)
+			}
+		}
+	}
+
+	return nil
+}
+
+const pathConfigMDSHelpSyn = `
+Import a FIDO Metadata Service blob
+`
+
+const pathConfigMDSHelpDesc = `
+This endpoint imports a FIDO Metadata Service (MDS3) blob uploaded by an
+administrator; the backend never fetches it over the network. The blob is a
+JWT whose x5c signing chain must lead to "root_certificate".
+
+The entries of the blob are indexed by AAGUID and by attestation certificate
+key identifier. Roles use them through "allowed_authenticators", a list of
+those identifiers, and "denied_status", a list of status reports such as
+REVOKED or USER_VERIFICATION_BYPASS that refuse a registration. A role with
+"allowed_authenticators" refuses keys whose attestation certificate is not
+verified against the trust roots of "config/attestation". The AAGUID of a
+WebAuthn credential only counts when that certificate carries it.
+`
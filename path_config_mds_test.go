@@ -0,0 +1,196 @@
+package u2fauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// signMDSBlob signs the payload as an MDS3 blob with a certificate issued by
+// the given root.
+func signMDSBlob(t *testing.T, root *x509.Certificate, rootKey *ecdsa.PrivateKey, payload interface{}) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "Metadata Service Signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, root, &key.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.ES256, Key: key},
+		(&jose.SignerOptions{}).WithHeader("x5c", []string{base64.StdEncoding.EncodeToString(der)}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jws, err := signer.Sign(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob
+}
+
+func virtualKeyID(t *testing.T, vk *virtualKey) string {
+	cert, err := x509.ParseCertificate(vk.attestationCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := attestationKeyID(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestConfigMDS_Import(t *testing.T) {
+	b, storage := getBackend(t)
+	configureBackend(t, b, storage)
+
+	root, rootKey, err := newAttestationCA("Test MDS Root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, otherKey, err := newAttestationCA("Other Root")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An allowlist is only met by keys attested by the trust roots
+	ca, caKey, err := newAttestationCA("Test U2F Root CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config/attestation",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"trust_roots": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})),
+		},
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	approved, err := newAttestedVirtualKey(ca, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := newAttestedVirtualKey(ca, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown, err := newAttestedVirtualKey(ca, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selfSigned, err := newVirtualKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := map[string]interface{}{
+		"legalHeader": "test",
+		"no":          7,
+		"nextUpdate":  "2030-01-01",
+		"entries": []map[string]interface{}{
+			{
+				"attestationCertificateKeyIdentifiers": []string{virtualKeyID(t, approved)},
+				"metadataStatement":                    map[string]interface{}{"description": "Approved Key"},
+				"statusReports":                        []map[string]interface{}{{"status": "FIDO_CERTIFIED"}},
+			},
+			{
+				"attestationCertificateKeyIdentifiers": []string{virtualKeyID(t, revoked)},
+				"metadataStatement":                    map[string]interface{}{"description": "Revoked Key"},
+				"statusReports":                        []map[string]interface{}{{"status": "FIDO_CERTIFIED"}, {"status": "REVOKED"}},
+			},
+		},
+	}
+
+	req = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config/mds",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"root_certificate": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw})),
+			"blob":             signMDSBlob(t, other, otherKey, payload),
+		},
+	}
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err == nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected blob from another root to be refused, got err:%v resp:%#v", err, resp)
+	}
+
+	req.Data["blob"] = signMDSBlob(t, root, rootKey, payload)
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	req = &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "config/mds",
+		Storage:   storage,
+	}
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if resp.Data["no"] != 7 || resp.Data["entries"] != 2 {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	req = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "roles/approved-only",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"token_policies":         "c,d",
+			"allowed_authenticators": virtualKeyID(t, approved) + "," + virtualKeyID(t, revoked) + "," + virtualKeyID(t, selfSigned),
+			"denied_status":          "revoked,USER_VERIFICATION_BYPASS",
+		},
+	}
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	registerDevice(t, b, storage, approved, "approved-device", "approved-only")
+
+	// A self-signed certificate can carry any key, listing it does not help
+	for name, vk := range map[string]*virtualKey{"revoked-device": revoked, "unknown-device": unknown, "self-signed-device": selfSigned} {
+		resp, err = tryRegisterDevice(t, b, storage, vk, name, "approved-only")
+		if err != nil || resp == nil || !resp.IsError() {
+			t.Fatalf("%s: expected registration to be refused, got err:%v resp:%#v", name, err, resp)
+		}
+	}
+}
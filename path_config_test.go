@@ -0,0 +1,169 @@
+package u2fauth
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func configureBackend(t *testing.T, b logical.Backend, s logical.Storage) {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"app_id": app_id,
+		},
+	}
+
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+}
+
+// writeConfig updates the given settings of the mount configuration.
+func writeConfig(t *testing.T, b logical.Backend, s logical.Storage, data map[string]interface{}) {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   s,
+		Data:      data,
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+}
+
+func TestConfig_ReadWrite(t *testing.T) {
+	b, storage := getBackend(t)
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"app_id":         "https://vault.example.com/u2f/facets",
+			"trusted_facets": "https://vault.example.com,https://login.example.com:8443",
+		},
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	req = &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "config",
+		Storage:   storage,
+	}
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	expected := map[string]interface{}{
+		"app_id":         "https://vault.example.com/u2f/facets",
+		"trusted_facets": []string{"https://vault.example.com", "https://login.example.com:8443"},
+		"challenge_ttl":  int64(300),
+
+		"stateless_challenges": false,
+		"counter_policy":       "strict",
+
+		"upgrade_u2f_registrations": false,
+		"self_enrollment_limit":     0,
+		"recovery_role":             "",
+		"alias_name_source":         "user_name",
+
+		"lockout_threshold": 0,
+		"lockout_backoff":   int64(0),
+		"lockout_duration":  int64(0),
+
+		"rate_limit_per_name":    0,
+		"rate_limit_per_address": 0,
+		"rate_limit_burst":       10,
+
+		"hide_unknown_names": false,
+	}
+	if !reflect.DeepEqual(expected, resp.Data) {
+		t.Fatalf("bad:\nexpected:%#v\nactual:%#v\n", expected, resp.Data)
+	}
+}
+
+func TestConfig_DefaultFacets(t *testing.T) {
+	b, storage := getBackend(t)
+	configureBackend(t, b, storage)
+
+	config, err := b.(*backend).config(context.Background(), storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.TrustedFacets, []string{app_id}) {
+		t.Fatalf("bad: trusted facets: %#v", config.TrustedFacets)
+	}
+}
+
+func TestConfig_Validation(t *testing.T) {
+	b, storage := getBackend(t)
+
+	cases := map[string]map[string]interface{}{
+		"missing app_id": {},
+		"http app_id": {
+			"app_id": "http://vault.example.com",
+		},
+		"facet with another domain": {
+			"app_id":         "https://vault.example.com",
+			"trusted_facets": "https://vault.example.org",
+		},
+		"facet with path": {
+			"app_id":         "https://vault.example.com",
+			"trusted_facets": "https://vault.example.com/login",
+		},
+		"http facet": {
+			"app_id":         "https://vault.example.com",
+			"trusted_facets": "http://login.example.com",
+		},
+		"unknown counter_policy": {
+			"app_id":         "https://vault.example.com",
+			"counter_policy": "lenient",
+		},
+		"challenge_ttl too long": {
+			"app_id":        "https://vault.example.com",
+			"challenge_ttl": "10m",
+		},
+	}
+
+	for name, data := range cases {
+		req := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "config",
+			Storage:   storage,
+			Data:      data,
+		}
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err == nil || resp == nil || !resp.IsError() {
+			t.Fatalf("%s: expected error, got err:%v resp:%#v", name, err, resp)
+		}
+	}
+}
+
+func TestConfig_Unconfigured(t *testing.T) {
+	b, storage := getBackend(t)
+	createRole(t, b, storage, "my-role", "c,d")
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "registerRequest/my-device",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"role_name": "my-role",
+		},
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected error response, got err:%v resp:%#v", err, resp)
+	}
+}
@@ -0,0 +1,398 @@
+package u2fauth
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	deviceStateActive      = "active"
+	deviceStateQuarantined = "quarantined"
+	deviceStateDisabled    = "disabled"
+)
+
+// reservedMetadataKeys are set by the backend at login and cannot be used
+// in device metadata.
+var reservedMetadataKeys = []string{"user_name", "device_name", "role", "user_verification", "user_verified"}
+
+// state returns whether the device still has a key that may be used to log
+// in. A device without one is quarantined when one of its keys is, and
+// disabled otherwise.
+func (d *DeviceData) state() string {
+	if d.Disabled {
+		return deviceStateDisabled
+	}
+	if len(d.activeRegistrations()) > 0 || len(d.activeCredentials()) > 0 {
+		return deviceStateActive
+	}
+	for _, reg := range d.Registration {
+		if reg.Quarantined {
+			return deviceStateQuarantined
+		}
+	}
+	for _, cred := range d.Credentials {
+		if cred.Quarantined {
+			return deviceStateQuarantined
+		}
+	}
+	return deviceStateDisabled
+}
+
+func pathDevicesList(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "devices/?$",
+		Fields: map[string]*framework.FieldSchema{
+			"after": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Only list devices whose name sorts after this one.",
+			},
+			"limit": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: "Maximum number of devices to list. Defaults to no limit.",
+			},
+			"role": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Only list devices registered with this role.",
+			},
+			"state": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: `Only list devices in this state: "active", "quarantined" or "disabled".`,
+			},
+			"last_used_before": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Only list devices last used before this RFC 3339 time, including devices never used.",
+			},
+			"last_used_after": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Only list devices last used after this RFC 3339 time.",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.pathDeviceList,
+				Summary:  "List registered devices",
+			},
+		},
+
+		HelpSynopsis:    pathDevicesHelpSyn,
+		HelpDescription: pathDevicesHelpDesc,
+	}
+}
+
+func pathDevices(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "devices/" + framework.GenericNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Device name.",
+			},
+			"metadata": &framework.FieldSchema{
+				Type: framework.TypeKVPairs,
+				Description: `Key/value pairs added to the token and alias metadata at login. Replaces the
+current metadata. The keys "user_name", "device_name", "role",
+"user_verification" and "user_verified" are reserved.`,
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathDeviceRead,
+				Summary:  "Read a registered device",
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathDeviceUpdate,
+				Summary:  "Set the metadata of a registered device",
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.pathDeviceDelete,
+				Summary:  "Delete a registered device and all its keys",
+			},
+		},
+
+		HelpSynopsis:    pathDevicesHelpSyn,
+		HelpDescription: pathDevicesHelpDesc,
+	}
+}
+
+func (b *backend) pathDeviceList(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	after := strings.ToLower(d.Get("after").(string))
+	limit := d.Get("limit").(int)
+	if limit < 0 {
+		return logical.ErrorResponse("limit must not be negative"), logical.ErrInvalidRequest
+	}
+	role := strings.ToLower(d.Get("role").(string))
+	state := strings.ToLower(d.Get("state").(string))
+	switch state {
+	case "", deviceStateActive, deviceStateQuarantined, deviceStateDisabled:
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("invalid state %q", state)), logical.ErrInvalidRequest
+	}
+
+	var usedBefore, usedAfter time.Time
+	var err error
+	if raw := d.Get("last_used_before").(string); raw != "" {
+		if usedBefore, err = time.Parse(time.RFC3339, raw); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("invalid last_used_before: %v", err)), logical.ErrInvalidRequest
+		}
+	}
+	if raw := d.Get("last_used_after").(string); raw != "" {
+		if usedAfter, err = time.Parse(time.RFC3339, raw); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("invalid last_used_after: %v", err)), logical.ErrInvalidRequest
+		}
+	}
+
+	names, err := req.Storage.List(ctx, "devices/")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	names = names[sort.Search(len(names), func(i int) bool { return names[i] > after }):]
+
+	// Without a filter the page is known from the names alone, so only its
+	// devices are read
+	filtered := role != "" || state != "" || !usedBefore.IsZero() || !usedAfter.IsZero()
+	if !filtered && limit > 0 && len(names) > limit {
+		names = names[:limit]
+	}
+
+	keys := []string{}
+	keyInfo := map[string]interface{}{}
+	for _, name := range names {
+		if limit > 0 && len(keys) >= limit {
+			break
+		}
+
+		dEntry, err := b.device(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+		if dEntry == nil {
+			continue
+		}
+		if role != "" && dEntry.RoleName != role {
+			continue
+		}
+		if state != "" && dEntry.state() != state {
+			continue
+		}
+		if !usedBefore.IsZero() && !dEntry.LastUsedAt.Before(usedBefore) {
+			continue
+		}
+		if !usedAfter.IsZero() && !dEntry.LastUsedAt.After(usedAfter) {
+			continue
+		}
+
+		keys = append(keys, name)
+		keyInfo[name] = map[string]interface{}{
+			"user_name":    dEntry.UserName,
+			"role_name":    dEntry.RoleName,
+			"state":        dEntry.state(),
+			"last_used_at": formatTime(dEntry.LastUsedAt),
+		}
+	}
+
+	return logical.ListResponseWithInfo(keys, keyInfo), nil
+}
+
+func (b *backend) pathDeviceRead(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(d.Get("name").(string))
+	dEntry, err := b.device(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if dEntry == nil {
+		return nil, nil
+	}
+
+	// Only identifiers and state are returned, not the raw registration data
+	registrations := []map[string]interface{}{}
+	for _, reg := range dEntry.Registration {
+		data := map[string]interface{}{
+			"key_handle":     reg.KeyHandle,
+			"counter":        reg.Counter,
+			"quarantined":    reg.Quarantined,
+			"quarantined_at": formatTime(reg.QuarantinedAt),
+		}
+		reg.Attestation.populate(data)
+		reg.KeyUsage.populate(data)
+		reg.DisabledState.populate(data)
+		reg.Rotation.populate(data)
+		reg.LoginFailures.populate(data)
+		registrations = append(registrations, data)
+	}
+	credentials := []map[string]interface{}{}
+	for _, cred := range dEntry.Credentials {
+		data := map[string]interface{}{
+			"id":                 cred.ID,
+			"sign_count":         cred.SignCount,
+			"aaguid":             cred.AAGUID,
+			"attestation_format": cred.AttestationFormat,
+			"app_id":             cred.AppID,
+			"quarantined":        cred.Quarantined,
+			"quarantined_at":     formatTime(cred.QuarantinedAt),
+		}
+		cred.Attestation.populate(data)
+		cred.KeyUsage.populate(data)
+		cred.DisabledState.populate(data)
+		cred.Rotation.populate(data)
+		cred.LoginFailures.populate(data)
+		credentials = append(credentials, data)
+	}
+
+	data := map[string]interface{}{
+		"name":                 name,
+		"user_name":            dEntry.UserName,
+		"role_name":            dEntry.RoleName,
+		"state":                dEntry.state(),
+		"last_used_at":         formatTime(dEntry.LastUsedAt),
+		"metadata":             dEntry.Metadata,
+		"registrations":        registrations,
+		"webauthn_credentials": credentials,
+	}
+	dEntry.DisabledState.populate(data)
+	dEntry.LoginFailures.populate(data)
+
+	return &logical.Response{
+		Data: data,
+	}, nil
+}
+
+func (b *backend) pathDeviceUpdate(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(d.Get("name").(string))
+	dEntry, unlock, err := b.lockDevice(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if dEntry == nil {
+		return logical.ErrorResponse("device not found"), logical.ErrInvalidRequest
+	}
+
+	if raw, ok := d.GetOk("metadata"); ok {
+		metadata := raw.(map[string]string)
+		for _, key := range reservedMetadataKeys {
+			if _, ok := metadata[key]; ok {
+				return logical.ErrorResponse(fmt.Sprintf("metadata key %q is reserved", key)), logical.ErrInvalidRequest
+			}
+		}
+		dEntry.Metadata = metadata
+	}
+
+	return nil, b.setDevice(ctx, req.Storage, name, dEntry)
+}
+
+func (b *backend) pathDeviceDelete(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(d.Get("name").(string))
+	dEntry, unlock, err := b.lockDevice(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if dEntry == nil {
+		return nil, nil
+	}
+	b.Logger().Info("pathDeviceDelete", "device", name, "user", dEntry.UserName)
+
+	if err := b.removeUserDevice(ctx, req.Storage, dEntry); err != nil {
+		return nil, err
+	}
+	if err := b.releaseKeys(ctx, req.Storage, name, dEntry); err != nil {
+		return nil, err
+	}
+	return nil, b.deleteDevice(ctx, req.Storage, name)
+}
+
+// populate adds the attestation details to the data returned for a key.
+func (a *Attestation) populate(data map[string]interface{}) {
+	data["attestation_subject"] = a.AttestationSubject
+	data["attestation_serial"] = a.AttestationSerial
+	data["attestation_verified"] = a.AttestationVerified
+	data["attestation_key_id"] = a.AttestationKeyID
+}
+
+// populate adds the enrollment and usage details to the data returned for a
+// key.
+func (u *KeyUsage) populate(data map[string]interface{}) {
+	data["enrolled_at"] = formatTime(u.EnrolledAt)
+	data["enrolled_by"] = u.EnrolledBy
+	data["enrolled_by_accessor"] = u.EnrolledByAccessor
+	data["self_enrolled"] = u.SelfEnrolled
+	data["enrolled_with"] = u.EnrolledWith
+	data["enrollment_code"] = u.EnrollmentCode
+	data["last_used_at"] = formatTime(u.LastUsedAt)
+	data["last_used_from"] = u.LastUsedFrom
+}
+
+// populate adds whether a device or key is disabled to the data returned
+// for it.
+func (s *DisabledState) populate(data map[string]interface{}) {
+	data["disabled"] = s.Disabled
+	data["disabled_reason"] = s.DisabledReason
+	data["disabled_at"] = formatTime(s.DisabledAt)
+}
+
+// populate adds the keys a key replaced or was replaced by to the data
+// returned for it.
+func (r *Rotation) populate(data map[string]interface{}) {
+	data["replaces"] = r.Replaces
+	data["replaced_by"] = r.ReplacedBy
+	data["replaced_at"] = formatTime(r.ReplacedAt)
+	data["retires_at"] = formatTime(r.RetiresAt)
+}
+
+// populate adds the failed logins and lockout of a device or key to the
+// data returned for it.
+func (f *LoginFailures) populate(data map[string]interface{}) {
+	data["failed_logins"] = f.FailedLogins
+	data["last_failed_login_at"] = formatTime(f.LastFailedLoginAt)
+	data["locked_until"] = formatTime(f.LockedUntil)
+}
+
+// formatTime returns the time in RFC 3339, or an empty string when it is not
+// set.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+const pathDevicesHelpSyn = `
+List, read, update and delete registered devices
+`
+
+const pathDevicesHelpDesc = `
+Devices are created by the registration endpoints. Listing "devices/" returns
+their names, with the user, role, state and last login time of each one in
+"key_info". The list is sorted by name and can be paged with "after" and
+"limit", and filtered with "role", "state", "last_used_before" and
+"last_used_after".
+
+Reading "devices/<name>" returns the identifiers, counters and attestation
+details of its keys, who enrolled each key and when, and when and from which
+address it was last used, but not the raw registration data.
+
+Writing "metadata" to "devices/<name>" replaces the key/value metadata of the
+device. It is added to the token metadata and to the entity alias metadata at
+login, so policies can be templated on it. The keys set by the backend
+("user_name", "device_name", "role", "user_verification" and
+"user_verified") cannot be used. Deleting it removes the device and all of
+its keys and removes it from its user; tokens already issued are not
+revoked.
+`
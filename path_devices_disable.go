@@ -0,0 +1,184 @@
+package u2fauth
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func pathDevicesDisable(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "devices/" + framework.GenericNameRegex("name") + "/disable",
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Device name.",
+			},
+			"key_handle": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Key handle or WebAuthn credential ID to disable. Disables the whole device when empty.",
+			},
+			"reason": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Why the device or key is disabled.",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathDeviceDisable,
+				Summary:  "Disable a device or one of its keys",
+			},
+		},
+
+		HelpSynopsis:    pathDevicesDisableHelpSyn,
+		HelpDescription: pathDevicesDisableHelpDesc,
+	}
+}
+
+func pathDevicesEnable(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "devices/" + framework.GenericNameRegex("name") + "/enable",
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Device name.",
+			},
+			"key_handle": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Key handle or WebAuthn credential ID to enable. Enables the device itself when empty.",
+			},
+			"clear_quarantine": &framework.FieldSchema{
+				Type:        framework.TypeBool,
+				Description: "Also lift the quarantine of the key, or of every key of the device when key_handle is empty.",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathDeviceEnable,
+				Summary:  "Enable a disabled device or key",
+			},
+		},
+
+		HelpSynopsis:    pathDevicesDisableHelpSyn,
+		HelpDescription: pathDevicesDisableHelpDesc,
+	}
+}
+
+func (b *backend) pathDeviceDisable(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(d.Get("name").(string))
+	dEntry, unlock, err := b.lockDevice(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if dEntry == nil {
+		return logical.ErrorResponse("device not found"), logical.ErrInvalidRequest
+	}
+
+	keyHandle := strings.TrimRight(d.Get("key_handle").(string), "=")
+	reason := d.Get("reason").(string)
+	if keyHandle == "" {
+		dEntry.disable(reason)
+	} else {
+		state := dEntry.keyDisabledState(keyHandle)
+		if state == nil {
+			return logical.ErrorResponse("key handle not found"), logical.ErrInvalidRequest
+		}
+		state.disable(reason)
+	}
+	b.Logger().Info("pathDeviceDisable", "device", name, "key_handle", keyHandle, "reason", reason)
+
+	return nil, b.setDevice(ctx, req.Storage, name, dEntry)
+}
+
+func (b *backend) pathDeviceEnable(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(d.Get("name").(string))
+	dEntry, unlock, err := b.lockDevice(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if dEntry == nil {
+		return logical.ErrorResponse("device not found"), logical.ErrInvalidRequest
+	}
+
+	keyHandle := strings.TrimRight(d.Get("key_handle").(string), "=")
+	clearQuarantine := d.Get("clear_quarantine").(bool)
+	if keyHandle == "" {
+		dEntry.enable()
+	} else {
+		state := dEntry.keyDisabledState(keyHandle)
+		if state == nil {
+			return logical.ErrorResponse("key handle not found"), logical.ErrInvalidRequest
+		}
+		state.enable()
+	}
+
+	if clearQuarantine {
+		for i := range dEntry.Registration {
+			reg := &dEntry.Registration[i]
+			if keyHandle == "" || reg.KeyHandle == keyHandle {
+				reg.Quarantined = false
+				reg.QuarantinedAt = time.Time{}
+			}
+		}
+		for i := range dEntry.Credentials {
+			cred := &dEntry.Credentials[i]
+			if keyHandle == "" || cred.ID == keyHandle {
+				cred.Quarantined = false
+				cred.QuarantinedAt = time.Time{}
+			}
+		}
+	}
+	b.Logger().Info("pathDeviceEnable", "device", name, "key_handle", keyHandle, "clear_quarantine", clearQuarantine)
+
+	return nil, b.setDevice(ctx, req.Storage, name, dEntry)
+}
+
+// keyDisabledState returns the disabled state of the u2f registration or
+// WebAuthn credential with the given key handle.
+func (d *DeviceData) keyDisabledState(keyHandle string) *DisabledState {
+	if reg := d.registration(keyHandle); reg != nil {
+		return &reg.DisabledState
+	}
+	if cred := d.credential(keyHandle); cred != nil {
+		return &cred.DisabledState
+	}
+	return nil
+}
+
+// keyRotation returns the rotation history of the u2f registration or
+// WebAuthn credential with the given key handle.
+func (d *DeviceData) keyRotation(keyHandle string) *Rotation {
+	if reg := d.registration(keyHandle); reg != nil {
+		return &reg.Rotation
+	}
+	if cred := d.credential(keyHandle); cred != nil {
+		return &cred.Rotation
+	}
+	return nil
+}
+
+const pathDevicesDisableHelpSyn = `
+Disable or enable a device or one of its keys
+`
+
+const pathDevicesDisableHelpDesc = `
+Writing to "devices/<name>/disable" stops the device, or only the key given
+in "key_handle", from logging in without deleting its enrollment history. A
+"reason" can be recorded; it is returned with the disabled time when reading
+the device. Disabled keys are left out of sign requests and refused by the
+login endpoints.
+
+Writing to "devices/<name>/enable" undoes this. With "clear_quarantine" it
+also lifts the quarantine placed on keys whose counter did not increase.
+`
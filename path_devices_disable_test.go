@@ -0,0 +1,146 @@
+package u2fauth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func writeDeviceState(t *testing.T, b logical.Backend, s logical.Storage, name, action string, data map[string]interface{}) {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "devices/" + name + "/" + action,
+		Storage:   s,
+		Data:      data,
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+}
+
+func readDevice(t *testing.T, b logical.Backend, s logical.Storage, name string) map[string]interface{} {
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "devices/" + name,
+		Storage:   s,
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	return resp.Data
+}
+
+func TestDevices_DisableKey(t *testing.T) {
+	b, storage, vk := setupDevice(t, "my-device")
+	backup, err := newVirtualKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerDevice(t, b, storage, backup, "my-device", "my-role")
+	keyHandle := encodeWebSafe(vk.keys[0].keyHandle)
+
+	// A sign request issued before the key was disabled cannot be used
+	signReq := signRequest(t, b, storage, "my-device")
+	writeDeviceState(t, b, storage, "my-device", "disable", map[string]interface{}{
+		"key_handle": keyHandle,
+		"reason":     "reported lost",
+	})
+	signResp, err := vk.HandleAuthenticationRequest(*signReq.SignRequestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := signResponse(b, storage, "my-device", signReq.ChallengeID, signResp)
+	if err != nil || resp == nil || !resp.IsError() || resp.Data["error"] != errKeyDisabled.Error() {
+		t.Fatalf("expected disabled key to be refused, got err:%v resp:%#v", err, resp)
+	}
+
+	signReq = signRequest(t, b, storage, "my-device")
+	if keys := signReq.RegisteredKeys; len(keys) != 1 || keys[0].KeyHandle == keyHandle {
+		t.Fatalf("bad: registered keys: %#v", keys)
+	}
+	if resp, err := login(t, b, storage, backup, "my-device"); err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	data := readDevice(t, b, storage, "my-device")
+	reg := data["registrations"].([]map[string]interface{})[0]
+	if reg["disabled"] != true || reg["disabled_reason"] != "reported lost" || reg["disabled_at"] == "" {
+		t.Fatalf("bad: registration: %#v", reg)
+	}
+	if data["state"] != deviceStateActive {
+		t.Fatalf("bad: state: %#v", data["state"])
+	}
+
+	writeDeviceState(t, b, storage, "my-device", "enable", map[string]interface{}{
+		"key_handle": keyHandle,
+	})
+	if resp, err := login(t, b, storage, vk, "my-device"); err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+}
+
+func TestDevices_DisableDevice(t *testing.T) {
+	b, storage, vk := setupDevice(t, "my-device")
+
+	signReq := signRequest(t, b, storage, "my-device")
+	writeDeviceState(t, b, storage, "my-device", "disable", map[string]interface{}{
+		"reason": "leave of absence",
+	})
+	signResp, err := vk.HandleAuthenticationRequest(*signReq.SignRequestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := signResponse(b, storage, "my-device", signReq.ChallengeID, signResp)
+	if err != nil || resp == nil || !resp.IsError() || resp.Data["error"] != errDeviceDisabled.Error() {
+		t.Fatalf("expected disabled device to be refused, got err:%v resp:%#v", err, resp)
+	}
+
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "signRequest/my-device",
+		Storage:   storage,
+	}
+	if _, err := b.HandleRequest(context.Background(), req); err == nil {
+		t.Fatal("expected sign request for a disabled device to fail")
+	}
+
+	data := readDevice(t, b, storage, "my-device")
+	if data["state"] != deviceStateDisabled || data["disabled_reason"] != "leave of absence" {
+		t.Fatalf("bad: device: %#v", data)
+	}
+	if keys := listDevices(t, b, storage, map[string]interface{}{"state": "disabled"}); len(keys) != 1 {
+		t.Fatalf("bad: disabled devices: %v", keys)
+	}
+
+	writeDeviceState(t, b, storage, "my-device", "enable", nil)
+	if resp, err := login(t, b, storage, vk, "my-device"); err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+}
+
+func TestDevices_EnableClearsQuarantine(t *testing.T) {
+	b, storage, vk := setupDevice(t, "my-device")
+
+	bumpStoredCounter(t, b, storage, "my-device", 100)
+	resp, err := login(t, b, storage, vk, "my-device")
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected counter regression, got err:%v resp:%#v", err, resp)
+	}
+
+	// Enabling alone keeps the quarantine
+	writeDeviceState(t, b, storage, "my-device", "enable", nil)
+	if data := readDevice(t, b, storage, "my-device"); data["state"] != deviceStateQuarantined {
+		t.Fatalf("bad: state: %#v", data["state"])
+	}
+
+	writeDeviceState(t, b, storage, "my-device", "enable", map[string]interface{}{
+		"clear_quarantine": true,
+	})
+	bumpStoredCounter(t, b, storage, "my-device", 0)
+	if resp, err := login(t, b, storage, vk, "my-device"); err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+}
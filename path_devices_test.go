@@ -0,0 +1,209 @@
+package u2fauth
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func listDevices(t *testing.T, b logical.Backend, s logical.Storage, data map[string]interface{}) []string {
+	req := &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      "devices/",
+		Storage:   s,
+		Data:      data,
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	return resp.Data["keys"].([]string)
+}
+
+func TestDevices_ListReadDelete(t *testing.T) {
+	b, storage, vk := setupDevice(t, "dev-a")
+	createRole(t, b, storage, "other-role", "e")
+	registerDevice(t, b, storage, vk, "dev-b", "other-role")
+	registerDevice(t, b, storage, vk, "dev-c", "my-role")
+
+	resp, err := login(t, b, storage, vk, "dev-a")
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	bumpStoredCounter(t, b, storage, "dev-c", 100)
+	resp, err = login(t, b, storage, vk, "dev-c")
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected counter regression, got err:%v resp:%#v", err, resp)
+	}
+
+	hourAgo := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	cases := map[string]struct {
+		data     map[string]interface{}
+		expected []string
+	}{
+		"all":         {nil, []string{"dev-a", "dev-b", "dev-c"}},
+		"page":        {map[string]interface{}{"after": "dev-a", "limit": 1}, []string{"dev-b"}},
+		"role":        {map[string]interface{}{"role": "other-role"}, []string{"dev-b"}},
+		"quarantined": {map[string]interface{}{"state": "quarantined"}, []string{"dev-c"}},
+		"active":      {map[string]interface{}{"state": "active"}, []string{"dev-a", "dev-b"}},
+		"used after":  {map[string]interface{}{"last_used_after": hourAgo}, []string{"dev-a"}},
+		"used before": {map[string]interface{}{"last_used_before": hourAgo}, []string{"dev-b", "dev-c"}},
+	}
+	for name, tc := range cases {
+		keys := listDevices(t, b, storage, tc.data)
+		if !reflect.DeepEqual(keys, tc.expected) {
+			t.Fatalf("%s: bad: expected:%v actual:%v", name, tc.expected, keys)
+		}
+	}
+
+	req := &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      "devices/",
+		Storage:   storage,
+		Data:      map[string]interface{}{"state": "lost"},
+	}
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err == nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected invalid state to be refused, got err:%v resp:%#v", err, resp)
+	}
+
+	req = &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "devices/dev-a",
+		Storage:   storage,
+	}
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if resp.Data["role_name"] != "my-role" || resp.Data["state"] != deviceStateActive || resp.Data["last_used_at"] == "" {
+		t.Fatalf("bad: device: %#v", resp.Data)
+	}
+	if _, ok := resp.Data["registration_data"]; ok {
+		t.Fatalf("bad: raw registration data returned: %#v", resp.Data)
+	}
+	registrations := resp.Data["registrations"].([]map[string]interface{})
+	if len(registrations) != 1 || registrations[0]["counter"] != uint(1) || registrations[0]["key_handle"] == "" {
+		t.Fatalf("bad: registrations: %#v", registrations)
+	}
+	reg := registrations[0]
+	if reg["enrolled_at"] == "" || reg["enrolled_by"] != "token-admin" || reg["enrolled_by_accessor"] != "admin-accessor" {
+		t.Fatalf("bad: enrollment: %#v", reg)
+	}
+	if reg["last_used_at"] == "" || reg["last_used_from"] != "192.0.2.10" {
+		t.Fatalf("bad: usage: %#v", reg)
+	}
+	if reg["attestation_subject"] != "CN=Virtual U2F Device" {
+		t.Fatalf("bad: attestation: %#v", reg)
+	}
+
+	req = &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "devices/dev-b",
+		Storage:   storage,
+	}
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if keys := listDevices(t, b, storage, nil); !reflect.DeepEqual(keys, []string{"dev-a", "dev-c"}) {
+		t.Fatalf("bad: devices after delete: %v", keys)
+	}
+}
+
+func TestDevices_Metadata(t *testing.T) {
+	b, storage, vk := setupDevice(t, "my-device")
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "devices/my-device",
+		Storage:   storage,
+	}
+	for _, key := range reservedMetadataKeys {
+		req.Data = map[string]interface{}{
+			"metadata": map[string]interface{}{"team": "infra", key: "admin"},
+		}
+		resp, err := b.HandleRequest(context.Background(), req)
+		if err == nil || resp == nil || !resp.IsError() {
+			t.Fatalf("expected reserved key %q to be refused, got err:%v resp:%#v", key, err, resp)
+		}
+	}
+
+	req.Data = map[string]interface{}{
+		"metadata": []interface{}{"team=infra", "employee_id=1234"},
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	resp, err = login(t, b, storage, vk, "my-device")
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	expected := map[string]string{
+		"user_name":         "my-device",
+		"device_name":       "my-device",
+		"role":              "my-role",
+		"user_verification": "preferred",
+		"user_verified":     "false",
+		"team":              "infra",
+		"employee_id":       "1234",
+	}
+	if !reflect.DeepEqual(resp.Auth.Metadata, expected) {
+		t.Fatalf("bad: token metadata: expected:%#v actual:%#v", expected, resp.Auth.Metadata)
+	}
+	if !reflect.DeepEqual(resp.Auth.Alias.Metadata, expected) {
+		t.Fatalf("bad: alias metadata: expected:%#v actual:%#v", expected, resp.Auth.Alias.Metadata)
+	}
+
+	req = &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "devices/my-device",
+		Storage:   storage,
+	}
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if resp.Data["metadata"].(map[string]string)["team"] != "infra" {
+		t.Fatalf("bad: device: %#v", resp.Data)
+	}
+}
+
+// readsStorage counts the devices read from it.
+type readsStorage struct {
+	logical.Storage
+	reads *int
+}
+
+func (s readsStorage) Get(ctx context.Context, key string) (*logical.StorageEntry, error) {
+	if strings.HasPrefix(key, "devices/") {
+		*s.reads++
+	}
+	return s.Storage.Get(ctx, key)
+}
+
+func TestDevices_ListPage(t *testing.T) {
+	b, storage, vk := setupDevice(t, "dev-a")
+	for _, name := range []string{"dev-b", "dev-c", "dev-d", "dev-e"} {
+		registerDevice(t, b, storage, vk, name, "my-role")
+	}
+
+	var reads int
+	keys := listDevices(t, b, readsStorage{storage, &reads}, map[string]interface{}{"after": "dev-b", "limit": 2})
+	if !reflect.DeepEqual(keys, []string{"dev-c", "dev-d"}) {
+		t.Fatalf("bad: page: %v", keys)
+	}
+	if reads != 2 {
+		t.Fatalf("expected only the devices of the page to be read, got %d reads", reads)
+	}
+
+	if keys := listDevices(t, b, storage, map[string]interface{}{"after": "dev-d", "limit": 2}); !reflect.DeepEqual(keys, []string{"dev-e"}) {
+		t.Fatalf("bad: last page: %v", keys)
+	}
+}
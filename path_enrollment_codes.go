@@ -0,0 +1,493 @@
+package u2fauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	challengeTypeEnroll = "enroll"
+
+	defaultEnrollmentCodeTTL = 24 * time.Hour
+
+	// enrollmentCodeSize is the number of random bytes in a code
+	enrollmentCodeSize = 32
+)
+
+var errEnrollmentCodeInvalid = errors.New("invalid or expired enrollment code")
+
+// EnrollmentCodeEntry allows a single registration without a Vault token.
+// It is stored under "enrollment-codes/<id>", where the ID is the SHA-256 of
+// the code, so the code itself is never stored. A code has enough entropy
+// that the hash needs no salt.
+type EnrollmentCodeEntry struct {
+	ID string `json:"id"`
+
+	// DeviceName and UserName bind the code to a device, a user or both
+	DeviceName string `json:"device_name,omitempty"`
+
+	UserName string `json:"user_name,omitempty"`
+
+	RoleName string `json:"role_name"`
+
+	CreatedAt time.Time `json:"created_at"`
+
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// CreatedBy is the display name of the token that issued the code
+	CreatedBy string `json:"created_by,omitempty"`
+
+	CreatedByAccessor string `json:"created_by_accessor,omitempty"`
+}
+
+func (c *EnrollmentCodeEntry) expired(now time.Time) bool {
+	return !now.Before(c.ExpiresAt)
+}
+
+// allows returns whether the code may register the named device, dEntry
+// being the device if it exists. A code bound only to a user may not add
+// keys to an existing device of someone else, including one registered
+// before users were introduced.
+func (c *EnrollmentCodeEntry) allows(name string, dEntry *DeviceData, now time.Time) bool {
+	if c.expired(now) {
+		return false
+	}
+	if c.DeviceName == "" {
+		return dEntry == nil || deviceOwner(dEntry, name) == c.UserName
+	}
+	return c.DeviceName == name
+}
+
+func pathEnrollmentCodesList(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "enrollment-codes/?$",
+		Fields: map[string]*framework.FieldSchema{
+			"device_name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Device the code registers.",
+			},
+			"user_name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "User the registered device is assigned to.",
+			},
+			"role_name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Role assigned to the registered device.",
+			},
+			"ttl": &framework.FieldSchema{
+				Type:        framework.TypeDurationSecond,
+				Description: "Duration the code stays valid. Defaults to 24 hours.",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.pathEnrollmentCodeList,
+				Summary:  "List outstanding enrollment codes",
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathEnrollmentCodeCreate,
+				Summary:  "Issue an enrollment code",
+			},
+		},
+
+		HelpSynopsis:    pathEnrollmentCodesHelpSyn,
+		HelpDescription: pathEnrollmentCodesHelpDesc,
+	}
+}
+
+func pathEnrollmentCodes(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "enrollment-codes/" + framework.GenericNameRegex("id"),
+		Fields: map[string]*framework.FieldSchema{
+			"id": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "ID of the enrollment code.",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathEnrollmentCodeRead,
+				Summary:  "Read an enrollment code",
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.pathEnrollmentCodeDelete,
+				Summary:  "Revoke an enrollment code",
+			},
+		},
+
+		HelpSynopsis:    pathEnrollmentCodesHelpSyn,
+		HelpDescription: pathEnrollmentCodesHelpDesc,
+	}
+}
+
+func pathEnrollRequest(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "enrollRequest/" + framework.GenericNameRegex("name"),
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.rateLimited("enrollRequest", b.EnrollRequest),
+				Summary:  "Returns data to register a u2f device with an enrollment code",
+			},
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Device name.",
+			},
+			"code": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Enrollment code issued by an administrator.",
+			},
+		},
+
+		HelpSynopsis:    pathEnrollHelpSyn,
+		HelpDescription: pathEnrollHelpDesc,
+	}
+}
+
+func pathEnrollResponse(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "enrollResponse/" + framework.GenericNameRegex("name"),
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.rateLimited("enrollResponse", b.EnrollResponse),
+				Summary:  "Registers a u2f device with an enrollment code",
+			},
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Device name.",
+			},
+			"challengeId": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "ID of the challenge returned by enrollRequest.",
+			},
+			"registrationData": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "registration data of the device.",
+			},
+			"appId": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "registration data of the device.",
+			},
+			"clientData": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "registration data of the device.",
+			},
+			"version": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "registration data of the device.",
+			},
+		},
+
+		HelpSynopsis:    pathEnrollHelpSyn,
+		HelpDescription: pathEnrollHelpDesc,
+	}
+}
+
+func (b *backend) pathEnrollmentCodeList(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	ids, err := req.Storage.List(ctx, "enrollment-codes/")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+
+	keyInfo := map[string]interface{}{}
+	for _, id := range ids {
+		code, err := b.enrollmentCode(ctx, req.Storage, id)
+		if err != nil {
+			return nil, err
+		}
+		if code == nil {
+			continue
+		}
+		keyInfo[id] = map[string]interface{}{
+			"device_name": code.DeviceName,
+			"user_name":   code.UserName,
+			"role_name":   code.RoleName,
+			"expires_at":  formatTime(code.ExpiresAt),
+		}
+	}
+
+	return logical.ListResponseWithInfo(ids, keyInfo), nil
+}
+
+func (b *backend) pathEnrollmentCodeCreate(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	deviceName := strings.ToLower(d.Get("device_name").(string))
+	userName := strings.ToLower(d.Get("user_name").(string))
+	roleName := strings.ToLower(d.Get("role_name").(string))
+
+	if deviceName == "" && userName == "" {
+		return logical.ErrorResponse("device_name or user_name is required"), logical.ErrInvalidRequest
+	}
+	if deviceName != "" && !deviceNameRegex.MatchString(deviceName) {
+		return logical.ErrorResponse("invalid device_name"), logical.ErrInvalidRequest
+	}
+	if userName != "" && !deviceNameRegex.MatchString(userName) {
+		return logical.ErrorResponse("invalid user_name"), logical.ErrInvalidRequest
+	}
+	if roleName == "" {
+		return logical.ErrorResponse("missing role_name"), logical.ErrInvalidRequest
+	}
+	roleEntry, err := b.role(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, err
+	}
+	if roleEntry == nil {
+		return logical.ErrorResponse(fmt.Sprintf("role %q not found", roleName)), logical.ErrInvalidRequest
+	}
+
+	ttl := time.Duration(d.Get("ttl").(int)) * time.Second
+	if ttl < 0 {
+		return logical.ErrorResponse("ttl may not be negative"), logical.ErrInvalidRequest
+	}
+	if ttl == 0 {
+		ttl = defaultEnrollmentCodeTTL
+	}
+
+	raw := make([]byte, enrollmentCodeSize)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	code := base64.RawURLEncoding.EncodeToString(raw)
+
+	now := time.Now()
+	entry := &EnrollmentCodeEntry{
+		ID:                enrollmentCodeID(code),
+		DeviceName:        deviceName,
+		UserName:          userName,
+		RoleName:          roleName,
+		CreatedAt:         now,
+		ExpiresAt:         now.Add(ttl),
+		CreatedBy:         req.DisplayName,
+		CreatedByAccessor: req.ClientTokenAccessor,
+	}
+	if err := b.setEnrollmentCode(ctx, req.Storage, entry); err != nil {
+		return nil, err
+	}
+	b.Logger().Info("pathEnrollmentCodeCreate", "id", entry.ID, "device", deviceName, "user", userName, "role", roleName)
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"code":       code,
+			"id":         entry.ID,
+			"expires_at": formatTime(entry.ExpiresAt),
+		},
+	}, nil
+}
+
+func (b *backend) pathEnrollmentCodeRead(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	code, err := b.enrollmentCode(ctx, req.Storage, d.Get("id").(string))
+	if err != nil {
+		return nil, err
+	}
+	if code == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"id":                  code.ID,
+			"device_name":         code.DeviceName,
+			"user_name":           code.UserName,
+			"role_name":           code.RoleName,
+			"created_at":          formatTime(code.CreatedAt),
+			"expires_at":          formatTime(code.ExpiresAt),
+			"created_by":          code.CreatedBy,
+			"created_by_accessor": code.CreatedByAccessor,
+		},
+	}, nil
+}
+
+func (b *backend) pathEnrollmentCodeDelete(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	id := strings.ToLower(d.Get("id").(string))
+	unlock := b.lockKeys(enrollmentCodeLockKey(id))
+	defer unlock()
+
+	b.Logger().Info("pathEnrollmentCodeDelete", "id", id)
+	return nil, req.Storage.Delete(ctx, "enrollment-codes/"+id)
+}
+
+func (b *backend) EnrollRequest(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(d.Get("name").(string))
+	if name == "" {
+		return nil, fmt.Errorf("missing device name")
+	}
+
+	code, err := b.enrollmentCode(ctx, req.Storage, enrollmentCodeID(d.Get("code").(string)))
+	if err != nil {
+		return nil, err
+	}
+	var dEntry *DeviceData
+	if code != nil {
+		dEntry, err = b.device(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if code == nil || !code.allows(name, dEntry, time.Now()) {
+		b.Logger().Error("EnrollRequest", "device", name, "error", errEnrollmentCodeInvalid)
+		return logical.ErrorResponse(errEnrollmentCodeInvalid.Error()), nil
+	}
+
+	return b.registrationRequest(ctx, req, &ChallengeEntry{
+		Type:           challengeTypeEnroll,
+		DeviceName:     name,
+		RoleName:       code.RoleName,
+		UserName:       code.UserName,
+		EnrollmentCode: code.ID,
+	})
+}
+
+func (b *backend) EnrollResponse(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(d.Get("name").(string))
+	if name == "" {
+		return nil, fmt.Errorf("missing device name")
+	}
+	cEntry, err := b.consumeChallenge(ctx, req.Storage, d.Get("challengeId").(string), challengeTypeEnroll, name)
+	switch {
+	case err == errChallengeNotFound || err == errChallengeExpired:
+		b.Logger().Error("EnrollResponse", "device", name, "error", err)
+		return logical.ErrorResponse(err.Error()), nil
+	case err != nil:
+		return nil, err
+	}
+
+	// The enrollment code is checked again and used up along with the
+	// registration
+	return b.registrationResponse(ctx, req, d, cEntry, KeyUsage{})
+}
+
+// enrollmentCodeID returns the ID a code is stored under.
+func enrollmentCodeID(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+func (b *backend) enrollmentCode(ctx context.Context, s logical.Storage, id string) (*EnrollmentCodeEntry, error) {
+	if id == "" {
+		return nil, nil
+	}
+
+	entry, err := s.Get(ctx, "enrollment-codes/"+strings.ToLower(id))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result EnrollmentCodeEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (b *backend) setEnrollmentCode(ctx context.Context, s logical.Storage, code *EnrollmentCodeEntry) error {
+	entry, err := logical.StorageEntryJSON("enrollment-codes/"+code.ID, code)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+// userEnrollmentCodes returns the IDs of the codes bound to the user.
+func (b *backend) userEnrollmentCodes(ctx context.Context, s logical.Storage, name string) ([]string, error) {
+	ids, err := s.List(ctx, "enrollment-codes/")
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, id := range ids {
+		code, err := b.enrollmentCode(ctx, s, id)
+		if err != nil {
+			return nil, err
+		}
+		if code != nil && code.UserName == name {
+			result = append(result, id)
+		}
+	}
+	return result, nil
+}
+
+// tidyEnrollmentCodes removes codes that expired without being used.
+func (b *backend) tidyEnrollmentCodes(ctx context.Context, s logical.Storage) error {
+	ids, err := s.List(ctx, "enrollment-codes/")
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, id := range ids {
+		code, err := b.enrollmentCode(ctx, s, id)
+		if err != nil {
+			return err
+		}
+		if code == nil || !code.expired(now) {
+			continue
+		}
+		if err := s.Delete(ctx, "enrollment-codes/"+id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+const pathEnrollmentCodesHelpSyn = `
+Issue, list and revoke enrollment codes
+`
+
+const pathEnrollmentCodesHelpDesc = `
+An enrollment code lets someone without a Vault token register a device
+once. Writing to "enrollment-codes" issues a code bound to "device_name",
+"user_name" or both, and to "role_name", valid for "ttl" (24 hours by
+default). The code is only returned in this response; it is stored as its
+SHA-256, which is the ID the code is listed, read and revoked with. A code
+bound only to a user registers new devices or adds keys to devices the user
+already owns.
+
+A code is deleted once a registration with it succeeds, and when it expires.
+`
+
+const pathEnrollHelpSyn = `
+Register a device with an enrollment code
+`
+
+const pathEnrollHelpDesc = `
+These unauthenticated endpoints work like "registerRequest" and
+"registerResponse", with the enrollment code in place of a privileged token.
+"enrollRequest/<device>" takes the "code" and returns the u2f register
+request; "enrollResponse/<device>" takes the response of the device. The
+device gets the role and user the code was issued for, and the code can not
+be used again.
+`
@@ -0,0 +1,225 @@
+package u2fauth
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func issueEnrollmentCode(t *testing.T, b logical.Backend, s logical.Storage, data map[string]interface{}) (string, string) {
+	req := &logical.Request{
+		Operation:           logical.UpdateOperation,
+		Path:                "enrollment-codes",
+		Storage:             s,
+		DisplayName:         "token-admin",
+		ClientTokenAccessor: "admin-accessor",
+		Data:                data,
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	return resp.Data["code"].(string), resp.Data["id"].(string)
+}
+
+// enroll registers vk as the named device with the enrollment code.
+func enroll(t *testing.T, b logical.Backend, s logical.Storage, vk *virtualKey, name, code string) (*logical.Response, error) {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "enrollRequest/" + name,
+		Storage:   s,
+		Data: map[string]interface{}{
+			"code": code,
+		},
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || resp == nil || resp.IsError() {
+		return resp, err
+	}
+
+	var registerReq registerRequestMessage
+	if err := json.Unmarshal([]byte(resp.Data[logical.HTTPRawBody].(string)), &registerReq); err != nil {
+		t.Fatal(err)
+	}
+	vkResp, err := vk.HandleRegisterRequest(*registerReq.RegisterRequestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "enrollResponse/" + name,
+		Storage:   s,
+		Data: map[string]interface{}{
+			"challengeId":      registerReq.ChallengeID,
+			"registrationData": vkResp.RegistrationData,
+			"clientData":       vkResp.ClientData,
+		},
+	}
+	return b.HandleRequest(context.Background(), req)
+}
+
+func TestEnrollmentCodes(t *testing.T) {
+	b, storage := getBackend(t)
+	configureBackend(t, b, storage)
+	createRole(t, b, storage, "my-role", "c,d")
+
+	vk, err := newVirtualKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, id := issueEnrollmentCode(t, b, storage, map[string]interface{}{
+		"device_name": "alice-laptop",
+		"user_name":   "alice",
+		"role_name":   "my-role",
+	})
+	if id != enrollmentCodeID(code) {
+		t.Fatalf("bad: id %q", id)
+	}
+
+	// Only the hash of the code is stored
+	entry, err := storage.Get(context.Background(), "enrollment-codes/"+id)
+	if err != nil || entry == nil {
+		t.Fatalf("err:%v entry:%#v", err, entry)
+	}
+	if strings.Contains(string(entry.Value), code) {
+		t.Fatal("enrollment code stored in clear")
+	}
+
+	resp, err := enroll(t, b, storage, vk, "mallory-laptop", code)
+	if err != nil || resp == nil || resp.Data["error"] != errEnrollmentCodeInvalid.Error() {
+		t.Fatalf("expected a code bound to another device to be refused, got err:%v resp:%#v", err, resp)
+	}
+	resp, err = enroll(t, b, storage, vk, "alice-laptop", "not-a-code")
+	if err != nil || resp == nil || resp.Data["error"] != errEnrollmentCodeInvalid.Error() {
+		t.Fatalf("expected an unknown code to be refused, got err:%v resp:%#v", err, resp)
+	}
+
+	resp, err = enroll(t, b, storage, vk, "alice-laptop", code)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	resp, err = login(t, b, storage, vk, "alice")
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if resp.Auth.Metadata["device_name"] != "alice-laptop" || resp.Auth.Metadata["role"] != "my-role" {
+		t.Fatalf("bad: auth: %#v", resp.Auth)
+	}
+
+	data := readDevice(t, b, storage, "alice-laptop")
+	reg := data["registrations"].([]map[string]interface{})[0]
+	if reg["enrolled_by"] != "token-admin" || reg["enrolled_by_accessor"] != "admin-accessor" || reg["enrollment_code"] != id {
+		t.Fatalf("bad: registration: %#v", reg)
+	}
+
+	// The code is used up
+	another, err := newVirtualKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = enroll(t, b, storage, another, "alice-laptop", code)
+	if err != nil || resp == nil || resp.Data["error"] != errEnrollmentCodeInvalid.Error() {
+		t.Fatalf("expected a used code to be refused, got err:%v resp:%#v", err, resp)
+	}
+}
+
+func TestEnrollmentCodes_Revoke(t *testing.T) {
+	b, storage := getBackend(t)
+	configureBackend(t, b, storage)
+	createRole(t, b, storage, "my-role", "c,d")
+
+	code, id := issueEnrollmentCode(t, b, storage, map[string]interface{}{
+		"user_name": "bob",
+		"role_name": "my-role",
+		"ttl":       "1h",
+	})
+
+	req := &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      "enrollment-codes/",
+		Storage:   storage,
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	info := resp.Data["key_info"].(map[string]interface{})[id].(map[string]interface{})
+	if info["user_name"] != "bob" || info["role_name"] != "my-role" || info["expires_at"] == "" {
+		t.Fatalf("bad: key_info: %#v", info)
+	}
+
+	req = &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "enrollment-codes/" + id,
+		Storage:   storage,
+	}
+	if resp, err := b.HandleRequest(context.Background(), req); err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	vk, err := newVirtualKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = enroll(t, b, storage, vk, "bob-laptop", code)
+	if err != nil || resp == nil || resp.Data["error"] != errEnrollmentCodeInvalid.Error() {
+		t.Fatalf("expected a revoked code to be refused, got err:%v resp:%#v", err, resp)
+	}
+
+	// A code needs a device or user and an existing role
+	req = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "enrollment-codes",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"role_name": "my-role",
+		},
+	}
+	if _, err := b.HandleRequest(context.Background(), req); err != logical.ErrInvalidRequest {
+		t.Fatalf("expected invalid request, got %v", err)
+	}
+	req.Data = map[string]interface{}{
+		"user_name": "bob",
+		"role_name": "missing-role",
+	}
+	if _, err := b.HandleRequest(context.Background(), req); err != logical.ErrInvalidRequest {
+		t.Fatalf("expected invalid request, got %v", err)
+	}
+}
+
+func TestEnrollmentCodes_UserOnly(t *testing.T) {
+	b, storage, _ := setupDevice(t, "carol")
+	makeLegacyDevice(t, b, storage, "carol")
+
+	vk, err := newVirtualKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := issueEnrollmentCode(t, b, storage, map[string]interface{}{
+		"user_name": "mallory",
+		"role_name": "my-role",
+	})
+
+	// A code bound to a user may not take over a device of someone else
+	resp, err := enroll(t, b, storage, vk, "carol", code)
+	if err != nil || resp == nil || resp.Data["error"] != errEnrollmentCodeInvalid.Error() {
+		t.Fatalf("expected an existing device of another user to be refused, got err:%v resp:%#v", err, resp)
+	}
+	if registrations := readDevice(t, b, storage, "carol")["registrations"].([]map[string]interface{}); len(registrations) != 1 {
+		t.Fatalf("bad: carol registrations: %#v", registrations)
+	}
+
+	resp, err = enroll(t, b, storage, vk, "mallory-laptop", code)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if _, ok := readUser(t, b, storage, "mallory")["devices"].(map[string]interface{})["mallory-laptop"]; !ok {
+		t.Fatal("expected the new device to belong to the code's user")
+	}
+}
@@ -0,0 +1,72 @@
+package u2fauth
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/ryankurte/go-u2f"
+)
+
+const trustedFacetsContentType = "application/fido.trusted-apps+json"
+
+func pathFacets(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "facets",
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback:    b.pathFacetsRead,
+				Summary:     "Returns the trusted facet list for the application ID",
+				Description: "Returns the trusted facet list for the application ID",
+			},
+		},
+
+		HelpSynopsis:    pathFacetsHelpSyn,
+		HelpDescription: pathFacetsHelpDesc,
+	}
+}
+
+func (b *backend) pathFacetsRead(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return logical.ErrorResponse("u2f backend has not been configured"), nil
+	}
+
+	facets := u2f.TrustedFacets{
+		Ids: config.TrustedFacets,
+	}
+	facets.Version.Major = 1
+	facets.Version.Minor = 0
+
+	mJSON, err := json.Marshal(u2f.TrustedFacetsEndpoint{
+		TrustedFacets: []u2f.TrustedFacets{facets},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			logical.HTTPContentType: trustedFacetsContentType,
+			logical.HTTPRawBody:     string(mJSON),
+			logical.HTTPStatusCode:  200,
+		},
+	}, nil
+}
+
+const pathFacetsHelpSyn = `
+Returns the trusted facet list for the application ID
+`
+
+const pathFacetsHelpDesc = `
+This endpoint serves the configured trusted facets in the format defined by
+the FIDO AppID and Facet specification. It does not require authentication so
+that the application ID can point to it, e.g.
+https://vault.example.com/v1/auth/u2f/facets.
+`
@@ -0,0 +1,67 @@
+package u2fauth
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/ryankurte/go-u2f"
+)
+
+func TestFacets_Read(t *testing.T) {
+	b, storage := getBackend(t)
+
+	facets := []string{
+		"https://vault.example.com",
+		"android:apk-key-hash:FD18FA800DD00C0D9D7724328B6387EFE01F4E6C7C3B0E9C8A5D0E7E4C0F2A3B",
+		"android:apk-key-hash:bE0JBUuQ6Qch1mh4BZ0nHEpLCfg",
+		"ios:bundle-id:com.example.vault",
+	}
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"app_id":         "https://vault.example.com/v1/auth/u2f/facets",
+			"trusted_facets": facets[0] + "," + facets[2] + "," + facets[3],
+		},
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	// The first android facet is hex, not base64 of a known hash size
+	req.Data["trusted_facets"] = facets[1]
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err == nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected error, got err:%v resp:%#v", err, resp)
+	}
+
+	req = &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "facets",
+		Storage:   storage,
+	}
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if resp.Data[logical.HTTPContentType] != trustedFacetsContentType {
+		t.Fatalf("bad: content type: %v", resp.Data[logical.HTTPContentType])
+	}
+
+	var endpoint u2f.TrustedFacetsEndpoint
+	if err := json.Unmarshal([]byte(resp.Data[logical.HTTPRawBody].(string)), &endpoint); err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoint.TrustedFacets) != 1 || endpoint.TrustedFacets[0].Version.Major != 1 {
+		t.Fatalf("bad: %#v", endpoint)
+	}
+	expected := []string{facets[0], facets[2], facets[3]}
+	if !reflect.DeepEqual(endpoint.TrustedFacets[0].Ids, expected) {
+		t.Fatalf("bad:\nexpected:%#v\nactual:%#v\n", expected, endpoint.TrustedFacets[0].Ids)
+	}
+}
@@ -0,0 +1,178 @@
+package u2fauth
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func pathLockoutsList(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "lockouts/?$",
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.pathLockoutList,
+				Summary:  "List devices that are locked out or have a key locked out",
+			},
+		},
+
+		HelpSynopsis:    pathLockoutHelpSyn,
+		HelpDescription: pathLockoutHelpDesc,
+	}
+}
+
+func pathDevicesLockout(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "devices/" + framework.GenericNameRegex("name") + "/lockout",
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Device name.",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathDeviceLockoutRead,
+				Summary:  "Read the failed logins and lockouts of a device and its keys",
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.pathDeviceLockoutDelete,
+				Summary:  "Clear the failed logins and lockouts of a device and its keys",
+			},
+		},
+
+		HelpSynopsis:    pathLockoutHelpSyn,
+		HelpDescription: pathLockoutHelpDesc,
+	}
+}
+
+func (b *backend) pathLockoutList(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	names, err := req.Storage.List(ctx, "devices/")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	now := time.Now()
+	keys := []string{}
+	keyInfo := map[string]interface{}{}
+	for _, name := range names {
+		dEntry, err := b.device(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+		if dEntry == nil {
+			continue
+		}
+
+		var lockedKeys []string
+		for _, keyHandle := range dEntry.keyHandles() {
+			if dEntry.keyLoginFailures(keyHandle).locked(now) {
+				lockedKeys = append(lockedKeys, keyHandle)
+			}
+		}
+		if !dEntry.LoginFailures.locked(now) && len(lockedKeys) == 0 {
+			continue
+		}
+
+		keys = append(keys, name)
+		keyInfo[name] = map[string]interface{}{
+			"user_name":     dEntry.UserName,
+			"failed_logins": dEntry.FailedLogins,
+			"locked_until":  formatTime(dEntry.LockedUntil),
+			"locked_keys":   lockedKeys,
+		}
+	}
+
+	return logical.ListResponseWithInfo(keys, keyInfo), nil
+}
+
+func (b *backend) pathDeviceLockoutRead(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(d.Get("name").(string))
+	dEntry, err := b.device(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if dEntry == nil {
+		return nil, nil
+	}
+
+	now := time.Now()
+	keys := map[string]interface{}{}
+	for _, keyHandle := range dEntry.keyHandles() {
+		f := dEntry.keyLoginFailures(keyHandle)
+		data := map[string]interface{}{
+			"locked": f.locked(now),
+		}
+		f.populate(data)
+		keys[keyHandle] = data
+	}
+
+	data := map[string]interface{}{
+		"locked": dEntry.LoginFailures.locked(now),
+		"keys":   keys,
+	}
+	dEntry.LoginFailures.populate(data)
+
+	return &logical.Response{
+		Data: data,
+	}, nil
+}
+
+func (b *backend) pathDeviceLockoutDelete(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(d.Get("name").(string))
+	dEntry, unlock, err := b.lockDevice(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if dEntry == nil {
+		return nil, nil
+	}
+
+	for _, keyHandle := range dEntry.keyHandles() {
+		dEntry.loginSucceeded(keyHandle)
+	}
+	dEntry.LoginFailures.reset()
+	b.Logger().Info("pathDeviceLockoutDelete", "device", name)
+
+	return nil, b.setDevice(ctx, req.Storage, name, dEntry)
+}
+
+// keyHandles returns the key handles of the u2f registrations and the IDs of
+// the WebAuthn credentials of the device.
+func (d *DeviceData) keyHandles() []string {
+	var keyHandles []string
+	for _, reg := range d.Registration {
+		keyHandles = append(keyHandles, reg.KeyHandle)
+	}
+	for _, cred := range d.Credentials {
+		keyHandles = append(keyHandles, cred.ID)
+	}
+	return keyHandles
+}
+
+const pathLockoutHelpSyn = `
+View and clear lockouts after failed logins
+`
+
+const pathLockoutHelpDesc = `
+With "lockout_threshold" set on the config endpoint or on a role, failed
+logins are counted for each device and each key. Listing "lockouts" returns
+the devices that are locked out or have a key locked out. Reading
+"devices/<name>/lockout" returns the failed logins and lockout of the device
+and of each of its keys; deleting it clears them. A successful login also
+clears the counts of the device and the key used.
+`
@@ -0,0 +1,127 @@
+package u2fauth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// failLogin answers a sign request for the user with a signature that does
+// not verify.
+func failLogin(t *testing.T, b logical.Backend, s logical.Storage, vk *virtualKey, name string) *logical.Response {
+	signReq := signRequest(t, b, s, name)
+	signResp, err := vk.HandleAuthenticationRequest(*signReq.SignRequestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signResp.SignatureData = signResp.SignatureData[:len(signResp.SignatureData)-4] + "AAAA"
+	resp, err := signResponse(b, s, name, signReq.ChallengeID, signResp)
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected the login to fail, got err:%v resp:%#v", err, resp)
+	}
+	return resp
+}
+
+func writeLockoutSettings(t *testing.T, b logical.Backend, s logical.Storage, path string, data map[string]interface{}) {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      path,
+		Storage:   s,
+		Data:      data,
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	b, storage, vk := setupDevice(t, "my-device")
+	writeLockoutSettings(t, b, storage, "config", map[string]interface{}{
+		"lockout_threshold": 2,
+		"lockout_duration":  "1h",
+	})
+
+	// A success resets the count
+	failLogin(t, b, storage, vk, "my-device")
+	if resp, err := login(t, b, storage, vk, "my-device"); err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	failLogin(t, b, storage, vk, "my-device")
+	failLogin(t, b, storage, vk, "my-device")
+
+	resp, err := login(t, b, storage, vk, "my-device")
+	if err != nil || resp == nil || resp.Data["error"] != errLockedOut.Error() {
+		t.Fatalf("expected the device to be locked out, got err:%v resp:%#v", err, resp)
+	}
+
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "devices/my-device/lockout",
+		Storage:   storage,
+	}
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	key := resp.Data["keys"].(map[string]interface{})[encodeWebSafe(vk.keys[0].keyHandle)].(map[string]interface{})
+	if resp.Data["locked"] != true || resp.Data["failed_logins"] != 2 || key["locked"] != true || key["failed_logins"] != 2 {
+		t.Fatalf("bad: lockout: %#v", resp.Data)
+	}
+
+	req = &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      "lockouts/",
+		Storage:   storage,
+	}
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if keys := resp.Data["keys"].([]string); len(keys) != 1 || keys[0] != "my-device" {
+		t.Fatalf("bad: lockouts: %#v", resp.Data)
+	}
+
+	req = &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "devices/my-device/lockout",
+		Storage:   storage,
+	}
+	if resp, err := b.HandleRequest(context.Background(), req); err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if resp, err := login(t, b, storage, vk, "my-device"); err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+}
+
+func TestLockout_RoleOverride(t *testing.T) {
+	b, storage, vk := setupDevice(t, "my-device")
+	writeLockoutSettings(t, b, storage, "config", map[string]interface{}{
+		"lockout_threshold": 1,
+	})
+
+	// The role disables lockouts of the mount
+	writeLockoutSettings(t, b, storage, "roles/my-role", map[string]interface{}{
+		"lockout_threshold": -1,
+	})
+	failLogin(t, b, storage, vk, "my-device")
+	if resp, err := login(t, b, storage, vk, "my-device"); err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	// A failure delays the next attempt by the backoff of the role
+	writeLockoutSettings(t, b, storage, "roles/my-role", map[string]interface{}{
+		"lockout_threshold": 5,
+		"lockout_backoff":   "1h",
+	})
+	failLogin(t, b, storage, vk, "my-device")
+	resp, err := login(t, b, storage, vk, "my-device")
+	if err != nil || resp == nil || resp.Data["error"] != errLockedOut.Error() {
+		t.Fatalf("expected the backoff to refuse the login, got err:%v resp:%#v", err, resp)
+	}
+	if data := readDevice(t, b, storage, "my-device"); data["failed_logins"] != 1 || data["locked_until"] == "" {
+		t.Fatalf("bad: device: %#v", data)
+	}
+}
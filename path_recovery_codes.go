@@ -0,0 +1,446 @@
+package u2fauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	defaultRecoveryCodeCount = 10
+	maxRecoveryCodeCount     = 50
+
+	// recoveryCodeSize is the number of random bytes in a code, which are
+	// written as 16 base32 characters
+	recoveryCodeSize = 10
+
+	recoveryCodeSaltSize = 16
+)
+
+var (
+	errRecoveryDisabled    = errors.New("recovery codes are disabled")
+	errRecoveryCodeInvalid = errors.New("invalid recovery code")
+)
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// RecoveryCodesEntry holds the unused recovery codes of a user and a record
+// of the ones already used. It is stored under "recovery-codes/<user>".
+type RecoveryCodesEntry struct {
+	Codes []RecoveryCode `json:"codes"`
+
+	Used []RecoveryCodeUse `json:"used,omitempty"`
+
+	GeneratedAt time.Time `json:"generated_at"`
+
+	// GeneratedBy is the display name of the token that generated the codes
+	GeneratedBy string `json:"generated_by,omitempty"`
+
+	GeneratedByAccessor string `json:"generated_by_accessor,omitempty"`
+
+	// LoginFailures counts the recovery logins with a wrong code, under the
+	// lockout settings of the recovery role
+	LoginFailures LoginFailures `json:"login_failures"`
+}
+
+// RecoveryCode is the salted SHA-256 of a code; the code itself is only
+// returned when it is generated.
+type RecoveryCode struct {
+	ID string `json:"id"`
+
+	Salt []byte `json:"salt"`
+
+	Hash []byte `json:"hash"`
+}
+
+// RecoveryCodeUse records a login with a recovery code.
+type RecoveryCodeUse struct {
+	ID string `json:"id"`
+
+	UsedAt time.Time `json:"used_at"`
+
+	UsedFrom string `json:"used_from,omitempty"`
+}
+
+// match returns the index of the unused code, or -1. Every code is compared
+// so the time taken does not depend on which one matches.
+func (e *RecoveryCodesEntry) match(code string) int {
+	found := -1
+	for i, c := range e.Codes {
+		if subtle.ConstantTimeCompare(hashRecoveryCode(c.Salt, code), c.Hash) == 1 {
+			found = i
+		}
+	}
+	return found
+}
+
+// burn removes the code at index i and records its use.
+func (e *RecoveryCodesEntry) burn(i int, req *logical.Request) RecoveryCodeUse {
+	use := RecoveryCodeUse{
+		ID:     e.Codes[i].ID,
+		UsedAt: time.Now(),
+	}
+	if req.Connection != nil {
+		use.UsedFrom = req.Connection.RemoteAddr
+	}
+	e.Codes = append(e.Codes[:i], e.Codes[i+1:]...)
+	e.Used = append(e.Used, use)
+	return use
+}
+
+func pathRecoveryCodes(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "users/" + framework.GenericNameRegex("name") + "/recovery-codes",
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "User name.",
+			},
+			"count": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: "Number of codes to generate. Defaults to 10.",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathRecoveryCodesRead,
+				Summary:  "Read how many recovery codes are left and which were used",
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathRecoveryCodesGenerate,
+				Summary:  "Generate new recovery codes, replacing the previous ones",
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.pathRecoveryCodesDelete,
+				Summary:  "Revoke all recovery codes",
+			},
+		},
+
+		HelpSynopsis:    pathRecoveryCodesHelpSyn,
+		HelpDescription: pathRecoveryCodesHelpDesc,
+	}
+}
+
+func pathRecoveryLogin(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "recoveryLogin/" + framework.GenericNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "User name.",
+			},
+			"code": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Unused recovery code of the user.",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.rateLimited("recoveryLogin", b.RecoveryLogin),
+				Summary:  "Log in with a recovery code",
+			},
+		},
+
+		HelpSynopsis:    pathRecoveryCodesHelpSyn,
+		HelpDescription: pathRecoveryCodesHelpDesc,
+	}
+}
+
+func (b *backend) pathRecoveryCodesRead(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(d.Get("name").(string))
+	entry, err := b.recoveryCodes(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	used := make([]map[string]interface{}, 0, len(entry.Used))
+	for _, use := range entry.Used {
+		used = append(used, map[string]interface{}{
+			"id":        use.ID,
+			"used_at":   formatTime(use.UsedAt),
+			"used_from": use.UsedFrom,
+		})
+	}
+
+	data := map[string]interface{}{
+		"remaining":             len(entry.Codes),
+		"used":                  used,
+		"generated_at":          formatTime(entry.GeneratedAt),
+		"generated_by":          entry.GeneratedBy,
+		"generated_by_accessor": entry.GeneratedByAccessor,
+	}
+	entry.LoginFailures.populate(data)
+	return &logical.Response{
+		Data: data,
+	}, nil
+}
+
+func (b *backend) pathRecoveryCodesGenerate(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(d.Get("name").(string))
+	count := d.Get("count").(int)
+	if count == 0 {
+		count = defaultRecoveryCodeCount
+	}
+	if count < 0 || count > maxRecoveryCodeCount {
+		return logical.ErrorResponse(fmt.Sprintf("count must be between 1 and %d", maxRecoveryCodeCount)), logical.ErrInvalidRequest
+	}
+
+	unlock := b.lockKeys(userLockKey(name))
+	defer unlock()
+
+	devices, err := b.userDevices(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(devices) == 0 {
+		return logical.ErrorResponse(fmt.Sprintf("user %q has no devices", name)), logical.ErrInvalidRequest
+	}
+
+	entry := &RecoveryCodesEntry{
+		GeneratedAt:         time.Now(),
+		GeneratedBy:         req.DisplayName,
+		GeneratedByAccessor: req.ClientTokenAccessor,
+	}
+	codes := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		salt := make([]byte, recoveryCodeSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		entry.Codes = append(entry.Codes, RecoveryCode{
+			ID:   strconv.Itoa(i + 1),
+			Salt: salt,
+			Hash: hashRecoveryCode(salt, code),
+		})
+		codes = append(codes, code)
+	}
+
+	if err := b.setRecoveryCodes(ctx, req.Storage, name, entry); err != nil {
+		return nil, err
+	}
+	b.Logger().Info("pathRecoveryCodesGenerate", "user", name, "count", count)
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"codes": codes,
+		},
+	}, nil
+}
+
+func (b *backend) pathRecoveryCodesDelete(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(d.Get("name").(string))
+	unlock := b.lockKeys(userLockKey(name))
+	defer unlock()
+
+	b.Logger().Info("pathRecoveryCodesDelete", "user", name)
+	return nil, req.Storage.Delete(ctx, "recovery-codes/"+name)
+}
+
+func (b *backend) RecoveryLogin(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(d.Get("name").(string))
+	if name == "" {
+		return nil, fmt.Errorf("missing user name")
+	}
+
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return logical.ErrorResponse("u2f backend has not been configured"), nil
+	}
+	if config.RecoveryRole == "" {
+		return logical.ErrorResponse(errRecoveryDisabled.Error()), nil
+	}
+	roleEntry, err := b.role(ctx, req.Storage, config.RecoveryRole)
+	if err != nil {
+		return nil, err
+	}
+	if roleEntry == nil {
+		return nil, fmt.Errorf("recovery role %q not found", config.RecoveryRole)
+	}
+
+	unlock := b.lockKeys(userLockKey(name))
+	defer unlock()
+
+	entry, err := b.recoveryCodes(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	i := -1
+	if entry != nil {
+		i = entry.match(d.Get("code").(string))
+	}
+	if entry != nil && entry.LoginFailures.locked(time.Now()) {
+		b.Logger().Warn("RecoveryLogin", "user", name, "error", errLockedOut)
+		// Unknown names are never locked out
+		if config.HideUnknownNames {
+			return logical.ErrorResponse(errRecoveryCodeInvalid.Error()), nil
+		}
+		return logical.ErrorResponse(errLockedOut.Error()), nil
+	}
+	if i < 0 {
+		b.Logger().Warn("RecoveryLogin", "user", name, "error", errRecoveryCodeInvalid)
+		if entry != nil {
+			if p := lockoutPolicyFor(config, roleEntry); p.enabled() {
+				entry.LoginFailures.failed(p)
+				b.Logger().Warn("RecoveryLogin", "user", name, "failed logins", entry.LoginFailures.FailedLogins, "locked until", entry.LoginFailures.LockedUntil)
+				if err := b.setRecoveryCodes(ctx, req.Storage, name, entry); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return logical.ErrorResponse(errRecoveryCodeInvalid.Error()), nil
+	}
+
+	// A user whose devices were all disabled by an administrator can not
+	// get around it with a recovery code
+	devices, err := b.userDevices(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	enabled := false
+	for _, dEntry := range devices {
+		enabled = enabled || !dEntry.Disabled
+	}
+	if !enabled {
+		b.Logger().Error("RecoveryLogin", "user", name, "error", errDeviceDisabled)
+		return logical.ErrorResponse(errDeviceDisabled.Error()), nil
+	}
+
+	use := entry.burn(i, req)
+	entry.LoginFailures.reset()
+	if err := b.setRecoveryCodes(ctx, req.Storage, name, entry); err != nil {
+		return nil, err
+	}
+	b.Logger().Warn("RecoveryLogin", "user", name, "recovery code", use.ID, "remaining", len(entry.Codes))
+
+	alias, err := b.recoveryAliasName(ctx, req.Storage, config, name)
+	if err != nil {
+		return nil, err
+	}
+	metadata := map[string]string{
+		"user_name":                name,
+		"role":                     config.RecoveryRole,
+		"recovery_code":            use.ID,
+		"recovery_codes_remaining": strconv.Itoa(len(entry.Codes)),
+	}
+	auth := &logical.Auth{
+		Metadata:    metadata,
+		DisplayName: "u2f_recovery_" + name,
+		Alias: &logical.Alias{
+			Name:     alias,
+			Metadata: metadata,
+		},
+	}
+	roleEntry.PopulateTokenAuth(auth)
+	return &logical.Response{
+		Auth: auth,
+	}, nil
+}
+
+// recoveryAliasName returns the alias of recovery logins. It differs from the
+// alias of logins with a key, so that recovery tokens get their own entity
+// without the policies and groups of the user, and stand out in audit logs.
+func (b *backend) recoveryAliasName(ctx context.Context, s logical.Storage, config *ConfigEntry, name string) (string, error) {
+	alias, err := b.aliasName(ctx, s, config, name)
+	if err != nil {
+		return "", err
+	}
+	return "u2f_recovery_" + strings.TrimPrefix(alias, "u2f_"), nil
+}
+
+// newRecoveryCode returns a random code as four groups of four characters.
+func newRecoveryCode() (string, error) {
+	raw := make([]byte, recoveryCodeSize)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	s := strings.ToLower(recoveryCodeEncoding.EncodeToString(raw))
+	return s[0:4] + "-" + s[4:8] + "-" + s[8:12] + "-" + s[12:16], nil
+}
+
+// hashRecoveryCode hashes the code with the salt, ignoring case and the
+// dashes between groups.
+func hashRecoveryCode(salt []byte, code string) []byte {
+	code = strings.ToLower(strings.Replace(code, "-", "", -1))
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(code))
+	return h.Sum(nil)
+}
+
+func (b *backend) recoveryCodes(ctx context.Context, s logical.Storage, name string) (*RecoveryCodesEntry, error) {
+	entry, err := s.Get(ctx, "recovery-codes/"+name)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result RecoveryCodesEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (b *backend) setRecoveryCodes(ctx context.Context, s logical.Storage, name string, codes *RecoveryCodesEntry) error {
+	entry, err := logical.StorageEntryJSON("recovery-codes/"+name, codes)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+const pathRecoveryCodesHelpSyn = `
+Generate recovery codes and log in with them
+`
+
+const pathRecoveryCodesHelpDesc = `
+Recovery codes let a user who lost their keys log in once per code.
+Writing to "users/<name>/recovery-codes" generates "count" codes (10 by
+default) and replaces any previous ones; the codes are only returned in this
+response and stored as salted hashes. Reading it returns how many codes are
+left and when and from where each used code was used. Deleting it revokes
+all codes. A device registered before users were introduced is a user of its
+own.
+
+"recoveryLogin/<name>" is unauthenticated and takes a "code". A valid code
+is burned and a token is issued through the "recovery_role" set on the
+config endpoint, which should only allow what is needed to recover, such as
+enrolling a new key. The token carries an alias of its own,
+"u2f_recovery_<name>", so it does not share the entity of the user, and the
+ID of the code in the "recovery_code" metadata. Recovery logins are refused
+while "recovery_role" is not set. Wrong codes count as failed logins under
+the lockout settings of the recovery role; generating new codes clears them.
+`
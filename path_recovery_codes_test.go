@@ -0,0 +1,170 @@
+package u2fauth
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func generateRecoveryCodes(t *testing.T, b logical.Backend, s logical.Storage, name string, count int) []string {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "users/" + name + "/recovery-codes",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"count": count,
+		},
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	return resp.Data["codes"].([]string)
+}
+
+func recoveryLogin(b logical.Backend, s logical.Storage, name, code string) (*logical.Response, error) {
+	req := &logical.Request{
+		Operation:  logical.UpdateOperation,
+		Path:       "recoveryLogin/" + name,
+		Storage:    s,
+		Connection: &logical.Connection{RemoteAddr: "192.0.2.10"},
+		Data: map[string]interface{}{
+			"code": code,
+		},
+	}
+	return b.HandleRequest(context.Background(), req)
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	b, storage, _ := setupDevice(t, "alice")
+	createRole(t, b, storage, "recovery", "enroll-only")
+
+	codes := generateRecoveryCodes(t, b, storage, "alice", 3)
+	if len(codes) != 3 {
+		t.Fatalf("bad: codes: %v", codes)
+	}
+
+	// Only salted hashes are stored
+	entry, err := storage.Get(context.Background(), "recovery-codes/alice")
+	if err != nil || entry == nil {
+		t.Fatalf("err:%v entry:%#v", err, entry)
+	}
+	for _, code := range codes {
+		if strings.Contains(string(entry.Value), code) {
+			t.Fatal("recovery code stored in clear")
+		}
+	}
+
+	resp, err := recoveryLogin(b, storage, "alice", codes[0])
+	if err != nil || resp == nil || resp.Data["error"] != errRecoveryDisabled.Error() {
+		t.Fatalf("expected recovery to be disabled, got err:%v resp:%#v", err, resp)
+	}
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"recovery_role": "recovery",
+		},
+	}
+	if resp, err := b.HandleRequest(context.Background(), req); err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	resp, err = recoveryLogin(b, storage, "alice", "aaaa-bbbb-cccc-dddd")
+	if err != nil || resp == nil || resp.Data["error"] != errRecoveryCodeInvalid.Error() {
+		t.Fatalf("expected an unknown code to be refused, got err:%v resp:%#v", err, resp)
+	}
+
+	// Codes are accepted regardless of case
+	resp, err = recoveryLogin(b, storage, "alice", strings.ToUpper(codes[1]))
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if resp.Auth.Alias.Name != "u2f_recovery_alice" || resp.Auth.DisplayName != "u2f_recovery_alice" || resp.Auth.Metadata["role"] != "recovery" || resp.Auth.Metadata["recovery_code"] != "2" || resp.Auth.Metadata["recovery_codes_remaining"] != "2" {
+		t.Fatalf("bad: auth: %#v", resp.Auth)
+	}
+	if len(resp.Auth.Policies) != 1 || resp.Auth.Policies[0] != "enroll-only" {
+		t.Fatalf("bad: policies: %v", resp.Auth.Policies)
+	}
+
+	// The code is burned
+	resp, err = recoveryLogin(b, storage, "alice", codes[1])
+	if err != nil || resp == nil || resp.Data["error"] != errRecoveryCodeInvalid.Error() {
+		t.Fatalf("expected a used code to be refused, got err:%v resp:%#v", err, resp)
+	}
+
+	req = &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "users/alice/recovery-codes",
+		Storage:   storage,
+	}
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	used := resp.Data["used"].([]map[string]interface{})
+	if resp.Data["remaining"] != 2 || len(used) != 1 || used[0]["id"] != "2" || used[0]["used_from"] != "192.0.2.10" || used[0]["used_at"] == "" {
+		t.Fatalf("bad: recovery codes: %#v", resp.Data)
+	}
+
+	// Generating codes again replaces the previous ones
+	generateRecoveryCodes(t, b, storage, "alice", 0)
+	resp, err = recoveryLogin(b, storage, "alice", codes[0])
+	if err != nil || resp == nil || resp.Data["error"] != errRecoveryCodeInvalid.Error() {
+		t.Fatalf("expected a replaced code to be refused, got err:%v resp:%#v", err, resp)
+	}
+}
+
+func TestRecoveryCodes_Lockout(t *testing.T) {
+	b, storage, _ := setupDevice(t, "alice")
+	createRole(t, b, storage, "recovery", "enroll-only")
+	writeConfig(t, b, storage, map[string]interface{}{
+		"recovery_role":     "recovery",
+		"lockout_threshold": 2,
+		"lockout_duration":  "1h",
+	})
+	codes := generateRecoveryCodes(t, b, storage, "alice", 3)
+
+	for i := 0; i < 2; i++ {
+		if resp, err := recoveryLogin(b, storage, "alice", "aaaa-bbbb-cccc-dddd"); err != nil || resp == nil || resp.Data["error"] != errRecoveryCodeInvalid.Error() {
+			t.Fatalf("expected an unknown code to be refused, got err:%v resp:%#v", err, resp)
+		}
+	}
+
+	// Valid codes are refused, and not burned, while locked out
+	resp, err := recoveryLogin(b, storage, "alice", codes[0])
+	if err != nil || resp == nil || resp.Data["error"] != errLockedOut.Error() {
+		t.Fatalf("expected the user to be locked out, got err:%v resp:%#v", err, resp)
+	}
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "users/alice/recovery-codes",
+		Storage:   storage,
+	}
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if resp.Data["remaining"] != 3 || resp.Data["failed_logins"] != 2 || resp.Data["locked_until"] == "" {
+		t.Fatalf("bad: recovery codes: %#v", resp.Data)
+	}
+
+	// With hidden names the lockout looks like a wrong code
+	writeConfig(t, b, storage, map[string]interface{}{
+		"hide_unknown_names": true,
+	})
+	resp, err = recoveryLogin(b, storage, "alice", codes[0])
+	if err != nil || resp == nil || resp.Data["error"] != errRecoveryCodeInvalid.Error() {
+		t.Fatalf("expected the lockout to be hidden, got err:%v resp:%#v", err, resp)
+	}
+
+	// New codes clear the lockout
+	codes = generateRecoveryCodes(t, b, storage, "alice", 3)
+	if resp, err := recoveryLogin(b, storage, "alice", codes[0]); err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+}
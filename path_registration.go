@@ -3,14 +3,25 @@ package u2fauth
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/ryankurte/go-u2f"
 )
 
+var errReplacedKeyNotFound = errors.New("the key to replace is not registered to the user")
+
+// registerRequestMessage is the u2f registration request returned to the
+// client along with the ID it must send back with the response.
+type registerRequestMessage struct {
+	*u2f.RegisterRequestMessage
+	ChallengeID string `json:"challengeId"`
+}
+
 func pathRegistrationRequest(b *backend) *framework.Path {
 	return &framework.Path{
 		Pattern: "registerRequest/" + framework.GenericNameRegex("name"),
@@ -30,6 +41,18 @@ func pathRegistrationRequest(b *backend) *framework.Path {
 				Type:        framework.TypeString,
 				Description: "Role assigned to the device.",
 			},
+			"user_name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "User owning the device. Defaults to the device name.",
+			},
+			"replaces": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Key handle or WebAuthn credential ID of a key of the user that the new key replaces.",
+			},
+			"grace_period": &framework.FieldSchema{
+				Type:        framework.TypeDurationSecond,
+				Description: "Duration the replaced key keeps working. Defaults to 0, which revokes it once the new key is registered.",
+			},
 		},
 		//HelpSynopsis:    pathLoginSyn,
 		//HelpDescription: pathLoginDesc,
@@ -52,6 +75,10 @@ func pathRegistrationResponse(b *backend) *framework.Path {
 				Type:        framework.TypeString,
 				Description: "Device name.",
 			},
+			"challengeId": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "ID of the challenge returned by registerRequest.",
+			},
 			"registrationData": &framework.FieldSchema{
 				Type:        framework.TypeString,
 				Description: "registration data of the device.",
@@ -77,9 +104,9 @@ func pathRegistrationResponse(b *backend) *framework.Path {
 func (b *backend) RegistrationRequest(
 	ctx context.Context,
 	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	var registration []u2f.Registration
 	name := strings.ToLower(d.Get("name").(string))
 	roleName := strings.ToLower(d.Get("role_name").(string))
+	userName := strings.ToLower(d.Get("user_name").(string))
 
 	if name == "" {
 		return nil, fmt.Errorf("missing device name")
@@ -87,8 +114,36 @@ func (b *backend) RegistrationRequest(
 	if roleName == "" {
 		return nil, fmt.Errorf("missing device role name")
 	}
+	gracePeriod := time.Duration(d.Get("grace_period").(int)) * time.Second
+	if gracePeriod < 0 {
+		return logical.ErrorResponse("grace_period may not be negative"), logical.ErrInvalidRequest
+	}
 
-	roleEntry, err := b.role(ctx, req.Storage, roleName)
+	return b.registrationRequest(ctx, req, &ChallengeEntry{
+		Type:        challengeTypeRegister,
+		DeviceName:  name,
+		RoleName:    roleName,
+		UserName:    userName,
+		ReplacesKey: d.Get("replaces").(string),
+		GracePeriod: gracePeriod,
+	})
+}
+
+// registrationRequest issues the registration challenge described by
+// cEntry and returns the u2f register request for it.
+func (b *backend) registrationRequest(ctx context.Context, req *logical.Request, cEntry *ChallengeEntry) (*logical.Response, error) {
+	var registration []u2f.Registration
+	name := cEntry.DeviceName
+
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return logical.ErrorResponse("u2f backend has not been configured"), nil
+	}
+
+	roleEntry, err := b.role(ctx, req.Storage, cEntry.RoleName)
 	if err != nil {
 		return nil, err
 	}
@@ -96,39 +151,54 @@ func (b *backend) RegistrationRequest(
 	if roleEntry == nil {
 		return nil, fmt.Errorf("Specified role name not found")
 	}
+	if roleEntry.userVerification() == userVerificationRequired {
+		return logical.ErrorResponse(errUserVerificationRequired.Error()), nil
+	}
 
 	dEntry, err := b.device(ctx, req.Storage, name)
 	if err != nil {
 		return nil, err
 	}
+	cEntry.UserName, err = deviceUserName(dEntry, name, cEntry.UserName)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
 
-	if dEntry == nil {
-		b.Logger().Error("RegistrationResponse", "Creating new registration for device", name)
-		dEntry = &DeviceData{}
-		dEntry.Challenge = &u2f.Challenge{}
-		dEntry.Name = name
-		dEntry.RoleName = roleName
-	} else {
-		b.Logger().Error("RegistrationResponse", "Updating registration for device", name)
-		registration = dEntry.Registration
-		dEntry.RoleName = roleName
+	// Exclude the keys of every device of the user, so the same
+	// authenticator is not registered twice
+	devices, err := b.userDevices(ctx, req.Storage, cEntry.UserName)
+	if err != nil {
+		return nil, err
+	}
+	if dEntry != nil && dEntry.UserName == "" && cEntry.UserName != name {
+		devices = append(devices, dEntry)
+	}
+	for _, device := range devices {
+		registration = append(registration, device.u2fRegistrations()...)
+	}
+	if cEntry.ReplacesKey != "" {
+		if err := replaceableKey(devices, cEntry.ReplacesKey); err != nil {
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		}
 	}
 
 	b.Logger().Debug("RegistrationRequest", "registration", registration)
-	c, err := u2f.NewChallenge(appID, trustedFacets, registration)
+	c, err := u2f.NewChallenge(config.AppID, config.TrustedFacets, registration)
 	if err != nil {
 		b.Logger().Debug("RegistrationRequest", "error", err)
 		return nil, err
 	}
 
-	dEntry.Challenge = c
-
-	err = b.setDevice(ctx, req.Storage, name, dEntry)
+	cEntry.Challenge = c
+	err = b.issueChallenge(ctx, req.Storage, config, cEntry)
 	if err != nil {
 		return nil, err
 	}
 
-	u2fReq := c.RegisterRequest()
+	u2fReq := registerRequestMessage{
+		RegisterRequestMessage: u2fRegisterRequest(c),
+		ChallengeID:            cEntry.ID,
+	}
 	b.Logger().Debug("RegistrationRequest", "challenge", c)
 	b.Logger().Debug("RegistrationRequest", "u2fReq", u2fReq)
 	mJSON, err := json.Marshal(u2fReq)
@@ -154,19 +224,63 @@ func (b *backend) RegistrationResponse(
 	if name == "" {
 		return nil, fmt.Errorf("missing device name")
 	}
-	dEntry, err := b.device(ctx, req.Storage, name)
+	cEntry, err := b.consumeChallenge(ctx, req.Storage, d.Get("challengeId").(string), challengeTypeRegister, name)
+	switch {
+	case err == errChallengeNotFound || err == errChallengeExpired:
+		b.Logger().Error("RegistrationResponse", "device", name, "error", err)
+		return logical.ErrorResponse(err.Error()), nil
+	case err != nil:
+		return nil, err
+	}
+
+	var usage KeyUsage
+	usage.enrolled(req)
+	return b.registrationResponse(ctx, req, d, cEntry, usage)
+}
+
+// registrationResponse verifies the response to a registration challenge
+// and adds the new key, enrolled as described by usage, to the device. A
+// registration started with an enrollment code uses it up; the code may
+// have been used or revoked since the challenge was issued, so it is
+// checked again under the lock.
+func (b *backend) registrationResponse(ctx context.Context, req *logical.Request, d *framework.FieldData, cEntry *ChallengeEntry, usage KeyUsage) (*logical.Response, error) {
+	name := cEntry.DeviceName
+	var keys []string
+	if cEntry.UserName != "" {
+		keys = append(keys, userLockKey(cEntry.UserName))
+	}
+	if cEntry.EnrollmentCode != "" {
+		keys = append(keys, enrollmentCodeLockKey(cEntry.EnrollmentCode))
+	}
+	dEntry, unlock, err := b.lockDevice(ctx, req.Storage, name, keys...)
 	if err != nil {
 		return nil, err
 	}
+	defer unlock()
 
-	if dEntry == nil {
-		b.Logger().Error("RegistrationResponse", "Device not registered:", name)
-		return nil, fmt.Errorf("Device not registered")
+	var code *EnrollmentCodeEntry
+	if cEntry.EnrollmentCode != "" {
+		code, err = b.enrollmentCode(ctx, req.Storage, cEntry.EnrollmentCode)
+		if err != nil {
+			return nil, err
+		}
+		if code == nil || !code.allows(name, dEntry, time.Now()) {
+			b.Logger().Error("RegistrationResponse", "device", name, "error", errEnrollmentCodeInvalid)
+			return logical.ErrorResponse(errEnrollmentCodeInvalid.Error()), nil
+		}
+		usage.enrolledWithCode(code)
+		// The user may have been renamed since the challenge was issued
+		cEntry.UserName = code.UserName
 	}
-	if dEntry.Challenge == nil {
-		b.Logger().Error("RegistrationResponse", "challenge not found for device:", name)
-		return nil, fmt.Errorf("Device not registered")
+
+	if dEntry == nil {
+		b.Logger().Info("RegistrationResponse", "Creating new registration for device", name)
+		dEntry = &DeviceData{}
+		dEntry.Name = name
+	} else {
+		b.Logger().Info("RegistrationResponse", "Updating registration for device", name)
 	}
+	dEntry.RoleName = cEntry.RoleName
 
 	dEntry.RegistrationData = d.Get("registrationData").(string)
 	dEntry.AppID = d.Get("appId").(string)
@@ -180,18 +294,63 @@ func (b *backend) RegistrationResponse(
 		ClientData:       dEntry.ClientData,
 	}
 	b.Logger().Debug("RegistrationResponse", "regResp", regResp)
-	reg, err := dEntry.Challenge.Register(regResp, &u2f.RegistrationConfig{SkipAttestationVerify: true})
+
+	roleEntry, err := b.role(ctx, req.Storage, cEntry.RoleName)
 	if err != nil {
-		b.Logger().Error("RegistrationResponse u2f.Register", "error", err)
-		return nil, fmt.Errorf("error verifying response")
+		return nil, err
+	}
+	if roleEntry == nil {
+		return nil, fmt.Errorf("Specified role name not found")
 	}
 
-	dEntry.Registration = append(dEntry.Registration, *reg)
+	regEntry, errResp, err := b.register(ctx, req.Storage, name, cEntry.Challenge, roleEntry, regResp)
+	if errResp != nil || err != nil {
+		return errResp, err
+	}
+
+	regEntry.KeyUsage = usage
+	regEntry.Replaces = cEntry.ReplacesKey
+	dEntry.Registration = append(dEntry.Registration, *regEntry)
+
+	userName, err := deviceUserName(dEntry, name, cEntry.UserName)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	pub, err := registrationPublicKey(regEntry)
+	if err != nil {
+		return nil, err
+	}
+	claim, owner, err := b.claimKey(ctx, req.Storage, name, regEntry.KeyHandle, pub)
+	if err != nil {
+		return nil, err
+	}
+	if owner != nil {
+		// Enrollment codes are used without a token
+		return b.duplicateKeyResponse(owner, regEntry.KeyHandle, cEntry.Type == challengeTypeRegister), nil
+	}
+	defer claim.release(ctx, req.Storage)
+	if cEntry.ReplacesKey != "" {
+		errResp, err := b.replaceKey(ctx, req.Storage, userName, dEntry, cEntry.ReplacesKey, regEntry.KeyHandle, cEntry.GracePeriod)
+		if errResp != nil || err != nil {
+			return errResp, err
+		}
+	}
+	if err := b.addUserDevice(ctx, req.Storage, userName, dEntry); err != nil {
+		return nil, err
+	}
 
 	err = b.setDevice(ctx, req.Storage, name, dEntry)
 	if err != nil {
 		return nil, err
 	}
+	claim.keep()
+
+	if code != nil {
+		if err := req.Storage.Delete(ctx, "enrollment-codes/"+code.ID); err != nil {
+			return nil, err
+		}
+		b.Logger().Info("RegistrationResponse", "device", name, "enrollment code", code.ID)
+	}
 
 	return &logical.Response{
 		Data: map[string]interface{}{
@@ -201,3 +360,85 @@ func (b *backend) RegistrationResponse(
 		},
 	}, nil
 }
+
+// replaceableKey checks that a key of the user may be replaced.
+func replaceableKey(devices []*DeviceData, keyHandle string) error {
+	dEntry := deviceWithKey(devices, keyHandle)
+	if dEntry == nil {
+		return errReplacedKeyNotFound
+	}
+	if dEntry.keyRotation(keyHandle).ReplacedBy != "" {
+		return errKeyReplaced
+	}
+	return nil
+}
+
+// replaceKey marks the key of the user as replaced by the new key of
+// dEntry. A key of dEntry is updated in place for the caller to store, a key
+// of another device of the user is stored here. A non-nil response tells
+// why the key can not be replaced.
+func (b *backend) replaceKey(ctx context.Context, s logical.Storage, userName string, dEntry *DeviceData, keyHandle, newKeyHandle string, gracePeriod time.Duration) (*logical.Response, error) {
+	owner := dEntry
+	if dEntry.keyRotation(keyHandle) == nil {
+		devices, err := b.userDevices(ctx, s, userName)
+		if err != nil {
+			return nil, err
+		}
+		owner = deviceWithKey(devices, keyHandle)
+	}
+	err := errReplacedKeyNotFound
+	if owner != nil {
+		err = replaceableKey([]*DeviceData{owner}, keyHandle)
+	}
+	if err != nil {
+		b.Logger().Error("replaceKey", "device", dEntry.Name, "key_handle", keyHandle, "error", err)
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	owner.keyRotation(keyHandle).replace(newKeyHandle, gracePeriod)
+	b.Logger().Info("replaceKey", "device", owner.Name, "key_handle", keyHandle, "replaced by", newKeyHandle, "grace period", gracePeriod)
+	if owner == dEntry {
+		return nil, nil
+	}
+	return nil, b.setDevice(ctx, s, owner.Name, owner)
+}
+
+// u2fRegisterRequest returns the register request of the challenge, with
+// the keys of its registrations as registeredKeys. The u2f library encodes
+// their key handles a second time, authenticators would not recognize their
+// own keys and would register them again.
+func u2fRegisterRequest(c *u2f.Challenge) *u2f.RegisterRequestMessage {
+	m := c.RegisterRequest()
+	for i := range m.RegisteredKeys {
+		m.RegisteredKeys[i].KeyHandle = c.RegisteredKeys[i].KeyHandle
+	}
+	return m
+}
+
+// register verifies a u2f registration response and checks the attestation
+// of the new key against the role. A non-nil response tells why the key was
+// refused.
+func (b *backend) register(ctx context.Context, s logical.Storage, name string, c *u2f.Challenge, roleEntry *RoleEntry, regResp u2f.RegisterResponse) (*RegistrationEntry, *logical.Response, error) {
+	reg, err := c.Register(regResp, &u2f.RegistrationConfig{SkipAttestationVerify: true})
+	if err != nil {
+		b.Logger().Error("register u2f.Register", "error", err)
+		return nil, nil, fmt.Errorf("error verifying response")
+	}
+
+	regEntry := &RegistrationEntry{Registration: *reg}
+	cert, err := registrationCertificate(reg)
+	if err != nil {
+		b.Logger().Error("register", "device", name, "error", err)
+		return nil, logical.ErrorResponse("invalid attestation certificate"), nil
+	}
+	if err := b.verifyAttestation(ctx, s, roleEntry, cert, nil, &regEntry.Attestation); err != nil {
+		b.Logger().Error("register", "device", name, "error", err)
+		return nil, logical.ErrorResponse(err.Error()), nil
+	}
+	if err := b.checkAuthenticatorPolicy(ctx, s, roleEntry, &regEntry.Attestation, ""); err != nil {
+		b.Logger().Error("register", "device", name, "error", err)
+		return nil, logical.ErrorResponse(err.Error()), nil
+	}
+
+	return regEntry, nil, nil
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -34,7 +36,7 @@ func getBackend(t *testing.T) (logical.Backend, logical.Storage) {
 	return b, config.StorageView
 }
 
-var app_id string = "http://localhost"
+var app_id string = "https://localhost"
 var registrations []u2f.Registration
 
 func TestRegistrationRequest(t *testing.T) {
@@ -66,6 +68,7 @@ func TestE2ERequests(t *testing.T) {
 		t.Error(err)
 		t.FailNow()
 	}
+	configureBackend(t, b, storage)
 	createRole(t, b, storage, "my-role", "c,d")
 	//Generate challenge by calling registerRequest
 	req := &logical.Request{
@@ -87,7 +90,7 @@ func TestE2ERequests(t *testing.T) {
 	t.Log("registerRequest http_raw_body", resp.Data["http_raw_body"])
 
 	//Convert it to RegisterRequestMessage
-	var registerReq u2f.RegisterRequestMessage
+	var registerReq registerRequestMessage
 	rawBody := bytes.NewBufferString(resp.Data["http_raw_body"].(string))
 	dec := json.NewDecoder(rawBody)
 	err = dec.Decode(&registerReq)
@@ -98,7 +101,7 @@ func TestE2ERequests(t *testing.T) {
 	t.Log("registerReq", spew.Sdump(registerReq))
 
 	// Pass to virtual token
-	vKresp, err := vk.HandleRegisterRequest(registerReq)
+	vKresp, err := vk.HandleRegisterRequest(*registerReq.RegisterRequestMessage)
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
@@ -110,6 +113,7 @@ func TestE2ERequests(t *testing.T) {
 		Path:      "registerResponse/my-device",
 		Storage:   storage,
 		Data: map[string]interface{}{
+			"challengeId":      registerReq.ChallengeID,
 			"registrationData": vKresp.RegistrationData,
 			"clientData":       vKresp.ClientData,
 		},
@@ -139,7 +143,7 @@ func TestE2ERequests(t *testing.T) {
 	t.Log("registerRequest http_raw_body", resp.Data["http_raw_body"])
 
 	//Convert it to SignRequestMessage
-	var signReq u2f.SignRequestMessage
+	var signReq signRequestMessage
 	rawBody = bytes.NewBufferString(resp.Data["http_raw_body"].(string))
 	dec = json.NewDecoder(rawBody)
 	err = dec.Decode(&signReq)
@@ -150,7 +154,7 @@ func TestE2ERequests(t *testing.T) {
 	t.Log("SignRequestMessage: signReq", spew.Sdump(signReq))
 
 	// Pass to virtual token
-	signResp, err := vk.HandleAuthenticationRequest(signReq)
+	signResp, err := vk.HandleAuthenticationRequest(*signReq.SignRequestMessage)
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
@@ -163,6 +167,7 @@ func TestE2ERequests(t *testing.T) {
 		Path:      "signResponse/my-device",
 		Storage:   storage,
 		Data: map[string]interface{}{
+			"challengeId":   signReq.ChallengeID,
 			"keyHandle":     signResp.KeyHandle,
 			"signatureData": signResp.SignatureData,
 			"clientData":    signResp.ClientData,
@@ -176,3 +181,288 @@ func TestE2ERequests(t *testing.T) {
 	t.Log("signRequest resp", spew.Sdump(resp))
 
 }
+
+func TestRegistration_ReplaceKey(t *testing.T) {
+	b, storage, vk := setupDevice(t, "alice")
+	oldKeyHandle := encodeWebSafe(vk.keys[0].keyHandle)
+
+	replacement, err := newVirtualKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A sign request issued before the rotation can not be used with the
+	// replaced key
+	signReq := signRequest(t, b, storage, "alice")
+	resp, err := tryRegisterDeviceWith(t, b, storage, replacement, "alice", map[string]interface{}{
+		"role_name": "my-role",
+		"replaces":  oldKeyHandle,
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	signResp, err := vk.HandleAuthenticationRequest(*signReq.SignRequestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = signResponse(b, storage, "alice", signReq.ChallengeID, signResp)
+	if err != nil || resp == nil || resp.Data["error"] != errKeyReplaced.Error() {
+		t.Fatalf("expected the replaced key to be refused, got err:%v resp:%#v", err, resp)
+	}
+
+	resp, err = login(t, b, storage, replacement, "alice")
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if resp.Auth.Alias.Name != "u2f_alice" {
+		t.Fatalf("bad: alias: %#v", resp.Auth.Alias)
+	}
+
+	newKeyHandle := encodeWebSafe(replacement.keys[0].keyHandle)
+	regs := readDevice(t, b, storage, "alice")["registrations"].([]map[string]interface{})
+	if regs[0]["replaced_by"] != newKeyHandle || regs[0]["replaced_at"] == "" || regs[0]["retires_at"] != regs[0]["replaced_at"] {
+		t.Fatalf("bad: replaced registration: %#v", regs[0])
+	}
+	if regs[1]["replaces"] != oldKeyHandle {
+		t.Fatalf("bad: new registration: %#v", regs[1])
+	}
+
+	// A key can only be replaced once
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "registerRequest/alice",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"role_name": "my-role",
+			"replaces":  oldKeyHandle,
+		},
+	}
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != logical.ErrInvalidRequest || resp == nil || resp.Data["error"] != errKeyReplaced.Error() {
+		t.Fatalf("expected a replaced key to be refused, got err:%v resp:%#v", err, resp)
+	}
+}
+
+func TestRegistration_ReplaceKeyGracePeriod(t *testing.T) {
+	b, storage, vk := setupDevice(t, "alice")
+	oldKeyHandle := encodeWebSafe(vk.keys[0].keyHandle)
+
+	// The replacement may be a new device of the same user
+	replacement, err := newVirtualKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := tryRegisterDeviceWith(t, b, storage, replacement, "alice-new", map[string]interface{}{
+		"role_name":    "my-role",
+		"user_name":    "alice",
+		"replaces":     oldKeyHandle,
+		"grace_period": "1h",
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	for _, key := range []*virtualKey{vk, replacement} {
+		resp, err := login(t, b, storage, key, "alice")
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v", err, resp)
+		}
+		if resp.Auth.Alias.Name != "u2f_alice" {
+			t.Fatalf("bad: alias: %#v", resp.Auth.Alias)
+		}
+	}
+
+	reg := readDevice(t, b, storage, "alice")["registrations"].([]map[string]interface{})[0]
+	if reg["replaced_by"] != encodeWebSafe(replacement.keys[0].keyHandle) || reg["retires_at"] == reg["replaced_at"] {
+		t.Fatalf("bad: replaced registration: %#v", reg)
+	}
+
+	// Keys of other users can not be replaced
+	registerDevice(t, b, storage, vk, "mallory", "my-role")
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "registerRequest/mallory",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"role_name": "my-role",
+			"replaces":  encodeWebSafe(replacement.keys[0].keyHandle),
+		},
+	}
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != logical.ErrInvalidRequest || resp == nil || resp.Data["error"] != errReplacedKeyNotFound.Error() {
+		t.Fatalf("expected a key of another user to be refused, got err:%v resp:%#v", err, resp)
+	}
+}
+
+func TestRegistration_DuplicateKey(t *testing.T) {
+	b, storage, vk := setupDevice(t, "my-device")
+
+	// The keys of the user are passed to the authenticator so that it
+	// refuses to register again
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "registerRequest/my-laptop",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"role_name": "my-role",
+			"user_name": "my-device",
+		},
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	var registerReq registerRequestMessage
+	if err := json.Unmarshal([]byte(resp.Data[logical.HTTPRawBody].(string)), &registerReq); err != nil {
+		t.Fatal(err)
+	}
+	keys := registerReq.RegisteredKeys
+	if len(keys) != 1 || keys[0].KeyHandle != encodeWebSafe(vk.keys[0].keyHandle) {
+		t.Fatalf("bad: registeredKeys: %#v", keys)
+	}
+
+	// A client ignoring them is refused by the backend, under any name
+	vk.reuseKey = true
+	resp, err = tryRegisterUserDevice(t, b, storage, vk, "my-laptop", "my-role", "mallory")
+	want := `key is already registered to device "my-device" of user "my-device"`
+	if err != nil || resp == nil || resp.Data["error"] != want {
+		t.Fatalf("expected a duplicate key to be refused, got err:%v resp:%#v", err, resp)
+	}
+	resp, err = tryRegisterDevice(t, b, storage, vk, "my-device", "my-role")
+	if err != nil || resp == nil || resp.Data["error"] != want {
+		t.Fatalf("expected a duplicate key to be refused, got err:%v resp:%#v", err, resp)
+	}
+	if regs := readDevice(t, b, storage, "my-device")["registrations"].([]map[string]interface{}); len(regs) != 1 {
+		t.Fatalf("bad: registrations: %#v", regs)
+	}
+
+	// The owner is not revealed to the holder of an enrollment code
+	code, _ := issueEnrollmentCode(t, b, storage, map[string]interface{}{
+		"device_name": "alice-laptop",
+		"user_name":   "alice",
+		"role_name":   "my-role",
+	})
+	resp, err = enroll(t, b, storage, vk, "alice-laptop", code)
+	if err != nil || resp == nil || resp.Data["error"] != errKeyAlreadyRegistered.Error() {
+		t.Fatalf("expected a duplicate key to be refused, got err:%v resp:%#v", err, resp)
+	}
+
+	// The key is released with its device
+	req = &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "devices/my-device",
+		Storage:   storage,
+	}
+	if resp, err := b.HandleRequest(context.Background(), req); err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	registerDevice(t, b, storage, vk, "my-laptop", "my-role")
+}
+
+func TestRegistration_DuplicateKeyAfterRename(t *testing.T) {
+	b, storage, vk := setupDevice(t, "my-device")
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "devices/my-device/rename",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"new_name": "my-laptop",
+		},
+	}
+	if resp, err := b.HandleRequest(context.Background(), req); err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	vk.reuseKey = true
+	resp, err := tryRegisterDevice(t, b, storage, vk, "my-device", "my-role")
+	if err != nil || resp == nil || !strings.Contains(resp.Data["error"].(string), `device "my-laptop"`) {
+		t.Fatalf("expected a duplicate key to be refused, got err:%v resp:%#v", err, resp)
+	}
+}
+
+func TestRegistration_DuplicateKeyConcurrent(t *testing.T) {
+	b, storage := getBackend(t)
+	configureBackend(t, b, storage)
+	createRole(t, b, storage, "my-role", "c,d")
+
+	// Create the key on another mount, then register it under several
+	// names at once
+	other, otherStorage := getBackend(t)
+	configureBackend(t, other, otherStorage)
+	createRole(t, other, otherStorage, "my-role", "c,d")
+	vk, err := newVirtualKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerDevice(t, other, otherStorage, vk, "my-device", "my-role")
+	vk.reuseKey = true
+
+	// Slow device writes leave time for the other registrations to check
+	// the index
+	slow := slowStorage{storage}
+	const names = 8
+	errs := make([]error, names)
+	concurrently(t, names, func(i int) error {
+		errs[i] = registerConcurrently(b, slow, vk, fmt.Sprintf("device-%d", i))
+		return nil
+	})
+	registered := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			registered++
+		case !strings.HasPrefix(err.Error(), errKeyAlreadyRegistered.Error()):
+			t.Fatal(err)
+		}
+	}
+	if registered != 1 {
+		t.Fatalf("expected the key to be registered once, got %d", registered)
+	}
+}
+
+// slowStorage takes its time to store devices.
+type slowStorage struct {
+	logical.Storage
+}
+
+func (s slowStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	if strings.HasPrefix(entry.Key, "devices/") {
+		time.Sleep(50 * time.Millisecond)
+	}
+	return s.Storage.Put(ctx, entry)
+}
+
+// failingStorage refuses to store devices.
+type failingStorage struct {
+	logical.Storage
+}
+
+func (s failingStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	if strings.HasPrefix(entry.Key, "devices/") {
+		return fmt.Errorf("storage unavailable")
+	}
+	return s.Storage.Put(ctx, entry)
+}
+
+func TestRegistration_DuplicateKeyFailedWrite(t *testing.T) {
+	b, storage := getBackend(t)
+	configureBackend(t, b, storage)
+	createRole(t, b, storage, "my-role", "c,d")
+	vk, err := newVirtualKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tryRegisterDevice(t, b, failingStorage{storage}, vk, "my-device", "my-role"); err == nil {
+		t.Fatal("expected the registration to fail")
+	}
+
+	// The key is not left in the index
+	for _, prefix := range []string{keyHandleIndexPrefix, publicKeyIndexPrefix} {
+		keys, err := storage.List(context.Background(), prefix)
+		if err != nil || len(keys) != 0 {
+			t.Fatalf("bad: %s: err:%v keys:%v", prefix, err, keys)
+		}
+	}
+}
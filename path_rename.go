@@ -0,0 +1,283 @@
+package u2fauth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func pathDevicesRename(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "devices/" + framework.GenericNameRegex("name") + "/rename",
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Device name.",
+			},
+			"new_name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "New name of the device. Defaults to the current name.",
+			},
+			"user_name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "User the device is moved to. Defaults to the current owner.",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathDeviceRename,
+				Summary:  "Rename a device or move it to another user",
+			},
+		},
+
+		HelpSynopsis:    pathRenameHelpSyn,
+		HelpDescription: pathRenameHelpDesc,
+	}
+}
+
+func pathUsersRename(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "users/" + framework.GenericNameRegex("name") + "/rename",
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "User name.",
+			},
+			"new_name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "New name of the user.",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathUserRename,
+				Summary:  "Rename a user",
+			},
+		},
+
+		HelpSynopsis:    pathRenameHelpSyn,
+		HelpDescription: pathRenameHelpDesc,
+	}
+}
+
+func (b *backend) pathDeviceRename(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(d.Get("name").(string))
+	newName := strings.ToLower(d.Get("new_name").(string))
+	userName := strings.ToLower(d.Get("user_name").(string))
+	if newName == "" {
+		newName = name
+	}
+	if !deviceNameRegex.MatchString(newName) {
+		return logical.ErrorResponse("invalid new_name"), logical.ErrInvalidRequest
+	}
+	if userName != "" && !deviceNameRegex.MatchString(userName) {
+		return logical.ErrorResponse("invalid user_name"), logical.ErrInvalidRequest
+	}
+
+	// Lock the new name and user along with the device
+	keys := []string{deviceLockKey(newName)}
+	if userName != "" {
+		keys = append(keys, userLockKey(userName))
+	}
+	dEntry, unlock, err := b.lockDevice(ctx, req.Storage, name, keys...)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if dEntry == nil {
+		return logical.ErrorResponse(fmt.Sprintf("device %q not found", name)), logical.ErrInvalidRequest
+	}
+	dEntry.Name = name
+	oldUserName := dEntry.UserName
+	if oldUserName == "" {
+		oldUserName = name
+	}
+	if userName == "" {
+		userName = oldUserName
+	}
+	if newName == name && userName == oldUserName {
+		return nil, nil
+	}
+	if newName != name {
+		existing, err := b.device(ctx, req.Storage, newName)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			return logical.ErrorResponse(fmt.Sprintf("device %q already exists", newName)), logical.ErrInvalidRequest
+		}
+	}
+
+	if dEntry.UserName == "" && userName == oldUserName {
+		// Not migrated yet, the device is its own user. It is only created
+		// when the device stays with it, a device moved to another user
+		// would leave it empty.
+		if err := b.addUserDevice(ctx, req.Storage, name, dEntry); err != nil {
+			return nil, err
+		}
+	}
+
+	// Storage has no transactions: the device is written under its new name
+	// before the old entry is removed, so it is never missing
+	if err := b.removeUserDevice(ctx, req.Storage, dEntry); err != nil {
+		return nil, err
+	}
+	dEntry.Name = newName
+	if err := b.addUserDevice(ctx, req.Storage, userName, dEntry); err != nil {
+		return nil, err
+	}
+	if err := b.setDevice(ctx, req.Storage, newName, dEntry); err != nil {
+		return nil, err
+	}
+	if newName != name {
+		if err := b.indexKeys(ctx, req.Storage, newName, dEntry); err != nil {
+			return nil, err
+		}
+		if err := b.deleteDevice(ctx, req.Storage, name); err != nil {
+			return nil, err
+		}
+	}
+	b.Logger().Info("pathDeviceRename", "device", name, "new name", newName, "user", oldUserName, "new user", userName)
+
+	return nil, nil
+}
+
+func (b *backend) pathUserRename(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(d.Get("name").(string))
+	newName := strings.ToLower(d.Get("new_name").(string))
+	if !deviceNameRegex.MatchString(newName) {
+		return logical.ErrorResponse("missing or invalid new_name"), logical.ErrInvalidRequest
+	}
+
+	uEntry, codes, unlock, err := b.lockUserRename(ctx, req.Storage, name, newName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if uEntry == nil {
+		return logical.ErrorResponse(fmt.Sprintf("user %q not found", name)), logical.ErrInvalidRequest
+	}
+	if newName == name {
+		return nil, nil
+	}
+	existingUser, err := b.user(ctx, req.Storage, newName)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := b.userDevices(ctx, req.Storage, newName)
+	if err != nil {
+		return nil, err
+	}
+	if existingUser != nil || len(existing) > 0 {
+		return logical.ErrorResponse(fmt.Sprintf("user %q already exists", newName)), logical.ErrInvalidRequest
+	}
+
+	uEntry.Name = newName
+	if err := b.setUser(ctx, req.Storage, newName, uEntry); err != nil {
+		return nil, err
+	}
+	for _, deviceName := range uEntry.Devices {
+		dEntry, err := b.device(ctx, req.Storage, deviceName)
+		if err != nil {
+			return nil, err
+		}
+		if dEntry == nil {
+			continue
+		}
+		dEntry.UserName = newName
+		if err := b.setDevice(ctx, req.Storage, deviceName, dEntry); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, id := range codes {
+		code, err := b.enrollmentCode(ctx, req.Storage, id)
+		if err != nil {
+			return nil, err
+		}
+		if code == nil {
+			continue
+		}
+		code.UserName = newName
+		if err := b.setEnrollmentCode(ctx, req.Storage, code); err != nil {
+			return nil, err
+		}
+	}
+
+	recoveryCodes, err := b.recoveryCodes(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if recoveryCodes != nil {
+		if err := b.setRecoveryCodes(ctx, req.Storage, newName, recoveryCodes); err != nil {
+			return nil, err
+		}
+		if err := req.Storage.Delete(ctx, "recovery-codes/"+name); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := req.Storage.Delete(ctx, "users/"+name); err != nil {
+		return nil, err
+	}
+	b.Logger().Info("pathUserRename", "user", name, "new name", newName)
+
+	return nil, nil
+}
+
+// lockUserRename takes the locks of a user being renamed, of its devices, of
+// the new name and of the enrollment codes bound to the user, and returns
+// the user and the codes read under them. A code issued for the user after
+// the codes were listed is not locked, so it starts over then.
+func (b *backend) lockUserRename(ctx context.Context, s logical.Storage, name, newName string) (*UserEntry, []string, func(), error) {
+	for {
+		codes, err := b.userEnrollmentCodes(ctx, s, name)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		keys := []string{userLockKey(newName)}
+		for _, id := range codes {
+			keys = append(keys, enrollmentCodeLockKey(id))
+		}
+
+		uEntry, unlock, err := b.lockUser(ctx, s, name, keys...)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		locked, err := b.userEnrollmentCodes(ctx, s, name)
+		if err != nil {
+			unlock()
+			return nil, nil, nil, err
+		}
+		if strings.Join(locked, "/") == strings.Join(codes, "/") {
+			return uEntry, codes, unlock, nil
+		}
+		unlock()
+	}
+}
+
+const pathRenameHelpSyn = `
+Rename devices and users, or move a device to another user
+`
+
+const pathRenameHelpDesc = `
+Writing "new_name" to "devices/<name>/rename" moves the device, with its keys
+and history, to a new name. Writing "user_name" moves it to another user,
+which is created if needed; logins with its keys then resolve to the alias of
+that user. Both can be given at once.
+
+Writing "new_name" to "users/<name>/rename" renames a user, its recovery
+codes and the enrollment codes bound to it. The entity alias of logins is "u2f_<user>" unless "alias_name_source"
+on the config endpoint is "user_id", in which case it is the ID generated for
+the user, and the entity survives the rename.
+`
@@ -0,0 +1,210 @@
+package u2fauth
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func rename(b logical.Backend, s logical.Storage, path string, data map[string]interface{}) (*logical.Response, error) {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      path + "/rename",
+		Storage:   s,
+		Data:      data,
+	}
+	return b.HandleRequest(context.Background(), req)
+}
+
+func TestDevices_Rename(t *testing.T) {
+	b, storage, vk := setupDevice(t, "alise")
+	other, err := newVirtualKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerDevice(t, b, storage, other, "bob", "my-role")
+
+	resp, err := rename(b, storage, "devices/alise", map[string]interface{}{
+		"new_name": "bob",
+	})
+	if err != logical.ErrInvalidRequest {
+		t.Fatalf("expected renaming onto an existing device to fail, got err:%v resp:%#v", err, resp)
+	}
+
+	// Fix the typo and move the device to the right user at once
+	resp, err = rename(b, storage, "devices/alise", map[string]interface{}{
+		"new_name":  "alice-key",
+		"user_name": "alice",
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	dEntry, err := b.(*backend).device(context.Background(), storage, "alise")
+	if err != nil || dEntry != nil {
+		t.Fatalf("expected the old device to be gone, got err:%v device:%#v", err, dEntry)
+	}
+	if devices := readUser(t, b, storage, "alise")["devices"].(map[string]interface{}); len(devices) != 0 {
+		t.Fatalf("bad: devices of the old user: %#v", devices)
+	}
+	if _, ok := readUser(t, b, storage, "alice")["devices"].(map[string]interface{})["alice-key"]; !ok {
+		t.Fatal("expected the device to belong to the new user")
+	}
+
+	resp, err = login(t, b, storage, vk, "alice")
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if resp.Auth.Alias.Name != "u2f_alice" || resp.Auth.Metadata["device_name"] != "alice-key" {
+		t.Fatalf("bad: auth: %#v", resp.Auth)
+	}
+	if data := readDevice(t, b, storage, "alice-key"); len(data["registrations"].([]map[string]interface{})) != 1 || data["user_name"] != "alice" {
+		t.Fatalf("bad: device: %#v", data)
+	}
+}
+
+func TestDevices_RenameLegacy(t *testing.T) {
+	b, storage, vk := setupDevice(t, "carol")
+	makeLegacyDevice(t, b, storage, "carol")
+
+	resp, err := rename(b, storage, "devices/carol", map[string]interface{}{
+		"new_name":  "alice-key",
+		"user_name": "alice",
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	// The device was its own user, nothing is left of it
+	req := &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      "users/",
+		Storage:   storage,
+	}
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if keys := resp.Data["keys"].([]string); !reflect.DeepEqual(keys, []string{"alice"}) {
+		t.Fatalf("bad: users: %v", keys)
+	}
+
+	resp, err = login(t, b, storage, vk, "alice")
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if resp.Auth.Metadata["device_name"] != "alice-key" {
+		t.Fatalf("bad: auth: %#v", resp.Auth)
+	}
+}
+
+func TestUsers_RenameKeepsEntity(t *testing.T) {
+	b, storage, vk := setupDevice(t, "bob")
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"alias_name_source": "user_id",
+		},
+	}
+	if resp, err := b.HandleRequest(context.Background(), req); err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	id := readUser(t, b, storage, "bob")["id"].(string)
+	if id == "" {
+		t.Fatal("expected the user to have an ID")
+	}
+	resp, err := login(t, b, storage, vk, "bob")
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if resp.Auth.Alias.Name != id {
+		t.Fatalf("bad: alias: %#v", resp.Auth.Alias)
+	}
+
+	resp, err = rename(b, storage, "users/bob", map[string]interface{}{
+		"new_name": "robert",
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if readUser(t, b, storage, "bob") != nil {
+		t.Fatal("expected the old user to be gone")
+	}
+
+	resp, err = login(t, b, storage, vk, "robert")
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if resp.Auth.Alias.Name != id || resp.Auth.Metadata["user_name"] != "robert" {
+		t.Fatalf("bad: auth: %#v", resp.Auth)
+	}
+}
+
+func TestUsers_RenameEnrollmentCodes(t *testing.T) {
+	b, storage, _ := setupDevice(t, "alise")
+	code, _ := issueEnrollmentCode(t, b, storage, map[string]interface{}{
+		"user_name": "alise",
+		"role_name": "my-role",
+	})
+
+	// A registration started with the code before the rename
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "enrollRequest/alice-laptop",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"code": code,
+		},
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	var registerReq registerRequestMessage
+	if err := json.Unmarshal([]byte(resp.Data[logical.HTTPRawBody].(string)), &registerReq); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = rename(b, storage, "users/alise", map[string]interface{}{
+		"new_name": "alice",
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	vk, err := newVirtualKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vkResp, err := vk.HandleRegisterRequest(*registerReq.RegisterRequestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "enrollResponse/alice-laptop",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"challengeId":      registerReq.ChallengeID,
+			"registrationData": vkResp.RegistrationData,
+			"clientData":       vkResp.ClientData,
+		},
+	}
+	if resp, err := b.HandleRequest(context.Background(), req); err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	// The device joins the renamed user instead of recreating the old one
+	if _, ok := readUser(t, b, storage, "alice")["devices"].(map[string]interface{})["alice-laptop"]; !ok {
+		t.Fatal("expected the device to belong to the renamed user")
+	}
+	if uEntry, err := b.(*backend).user(context.Background(), storage, "alise"); err != nil || uEntry != nil {
+		t.Fatalf("expected the old user to be gone, got err:%v user:%#v", err, uEntry)
+	}
+}
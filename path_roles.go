@@ -4,15 +4,39 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
 	"github.com/hashicorp/vault/sdk/helper/tokenutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
+const (
+	userVerificationRequired    = "required"
+	userVerificationPreferred   = "preferred"
+	userVerificationDiscouraged = "discouraged"
+)
+
 type RoleEntry struct {
 	//Name string `json:"name" mapstructure:"name"`
 	tokenutil.TokenParams `mapstructure:",squash"`
+
+	RequireAttestation bool `json:"require_attestation" mapstructure:"require_attestation"`
+
+	AllowedAuthenticators []string `json:"allowed_authenticators" mapstructure:"allowed_authenticators"`
+
+	DeniedStatus []string `json:"denied_status" mapstructure:"denied_status"`
+
+	UserVerification string `json:"user_verification" mapstructure:"user_verification"`
+
+	// The lockout settings override those of the mount when set, a negative
+	// threshold disables lockouts for the role
+	LockoutThreshold int `json:"lockout_threshold" mapstructure:"lockout_threshold"`
+
+	LockoutBackoff time.Duration `json:"lockout_backoff" mapstructure:"lockout_backoff"`
+
+	LockoutDuration time.Duration `json:"lockout_duration" mapstructure:"lockout_duration"`
 	// Policies []string
 
 	// // Duration after which the user will be revoked unless renewed
@@ -24,6 +48,27 @@ type RoleEntry struct {
 	// BoundCIDRs []*sockaddr.SockAddrMarshaler
 }
 
+func (r *RoleEntry) userVerification() string {
+	if r.UserVerification == "" {
+		return userVerificationPreferred
+	}
+	return r.UserVerification
+}
+
+// strongerUserVerification returns the stricter of two user verification
+// requirements, an empty one being the least strict.
+func strongerUserVerification(a, b string) string {
+	rank := map[string]int{
+		userVerificationDiscouraged: 1,
+		userVerificationPreferred:   2,
+		userVerificationRequired:    3,
+	}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
 func pathRolesList(b *backend) *framework.Path {
 	return &framework.Path{
 		Pattern: "roles/?",
@@ -45,6 +90,34 @@ func pathRoles(b *backend) *framework.Path {
 				Type:        framework.TypeString,
 				Description: "Name of the role.",
 			},
+			"require_attestation": &framework.FieldSchema{
+				Type:        framework.TypeBool,
+				Description: "If set, devices registered with this role must present an attestation certificate issued by one of the configured trust roots.",
+			},
+			"allowed_authenticators": &framework.FieldSchema{
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Comma-separated list of AAGUIDs or attestation certificate key identifiers allowed to register with this role. Keys whose attestation is not verified against the trust roots are refused when set. Empty allows any authenticator.",
+			},
+			"denied_status": &framework.FieldSchema{
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Comma-separated list of metadata service status reports, such as REVOKED, that refuse a registration.",
+			},
+			"user_verification": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: `WebAuthn user verification, such as a PIN or biometric, asked from devices of this role: "required", "preferred" or "discouraged". Defaults to "preferred". When required, logins without user verification and u2f logins are refused.`,
+			},
+			"lockout_threshold": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: "Number of consecutive failed logins that lock a device or key of this role out. Overrides the mount setting when not 0, -1 disables lockouts.",
+			},
+			"lockout_backoff": &framework.FieldSchema{
+				Type:        framework.TypeDurationSecond,
+				Description: "Delay before another login is accepted after a failure. Overrides the mount setting when not 0.",
+			},
+			"lockout_duration": &framework.FieldSchema{
+				Type:        framework.TypeDurationSecond,
+				Description: "Duration of a lockout. Overrides the mount setting when not 0.",
+			},
 			// "token_policies": &framework.FieldSchema{
 			// 	Type:        framework.TypeCommaStringSlice,
 			// 	Description: "Comma-separated list of policies",
@@ -155,7 +228,15 @@ func (b *backend) pathRoleRead(
 		return nil, nil
 	}
 
-	respData := map[string]interface{}{}
+	respData := map[string]interface{}{
+		"require_attestation":    device.RequireAttestation,
+		"allowed_authenticators": device.AllowedAuthenticators,
+		"denied_status":          device.DeniedStatus,
+		"user_verification":      device.userVerification(),
+		"lockout_threshold":      device.LockoutThreshold,
+		"lockout_backoff":        int64(device.LockoutBackoff.Seconds()),
+		"lockout_duration":       int64(device.LockoutDuration.Seconds()),
+	}
 	device.PopulateTokenData(respData)
 	return &logical.Response{
 		Data: respData,
@@ -180,6 +261,41 @@ func (b *backend) roleCreateUpdate(
 		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
 	}
 
+	if requireRaw, ok := d.GetOk("require_attestation"); ok {
+		dEntry.RequireAttestation = requireRaw.(bool)
+	}
+	if allowedRaw, ok := d.GetOk("allowed_authenticators"); ok {
+		dEntry.AllowedAuthenticators = strutil.RemoveDuplicates(allowedRaw.([]string), true)
+	}
+	if deniedRaw, ok := d.GetOk("denied_status"); ok {
+		dEntry.DeniedStatus = nil
+		for _, status := range deniedRaw.([]string) {
+			dEntry.DeniedStatus = append(dEntry.DeniedStatus, strings.ToUpper(strings.TrimSpace(status)))
+		}
+	}
+
+	if uvRaw, ok := d.GetOk("user_verification"); ok {
+		dEntry.UserVerification = strings.ToLower(uvRaw.(string))
+	}
+	switch dEntry.UserVerification {
+	case "", userVerificationRequired, userVerificationPreferred, userVerificationDiscouraged:
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("invalid user_verification %q", dEntry.UserVerification)), logical.ErrInvalidRequest
+	}
+
+	if thresholdRaw, ok := d.GetOk("lockout_threshold"); ok {
+		dEntry.LockoutThreshold = thresholdRaw.(int)
+	}
+	if backoffRaw, ok := d.GetOk("lockout_backoff"); ok {
+		dEntry.LockoutBackoff = time.Duration(backoffRaw.(int)) * time.Second
+	}
+	if durationRaw, ok := d.GetOk("lockout_duration"); ok {
+		dEntry.LockoutDuration = time.Duration(durationRaw.(int)) * time.Second
+	}
+	if dEntry.LockoutThreshold < -1 || dEntry.LockoutBackoff < 0 || dEntry.LockoutDuration < 0 {
+		return logical.ErrorResponse("lockout_threshold must be -1 or more, lockout_backoff and lockout_duration must not be negative"), logical.ErrInvalidRequest
+	}
+
 	//b.Logger().Debug("deviceCreateUpdate", "dentry", dEntry)
 	return nil, b.setRole(ctx, req.Storage, name, dEntry)
 }
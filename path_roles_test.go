@@ -96,6 +96,21 @@ func createRole(t *testing.T, b logical.Backend, s logical.Storage, roleName, po
 	}
 }
 
+func setUserVerification(t *testing.T, b logical.Backend, s logical.Storage, roleName, userVerification string) {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "roles/" + roleName,
+		Storage:   s,
+		Data: map[string]interface{}{
+			"user_verification": userVerification,
+		},
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+}
+
 func Test_RoleList(t *testing.T) {
 	var resp *logical.Response
 	var err error
@@ -188,6 +203,7 @@ func TestAppRole_RoleUpdate(t *testing.T) {
 		"token_num_uses":    600,
 		"token_bound_cidrs": []string{"127.0.0.1/32", "127.0.0.1/16"},
 		"token_type": logical.TokenTypeDefault,
+		"user_verification": "preferred",
 
 	}
 
@@ -0,0 +1,324 @@
+package u2fauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/ryankurte/go-u2f"
+)
+
+const challengeTypeSelfEnroll = "self-enroll"
+
+var (
+	errSelfEnrollmentDisabled = errors.New("self-enrollment is disabled")
+	errSelfEnrollmentLimit    = errors.New("self-enrollment limit reached")
+)
+
+// deviceNameRegex matches the names accepted by framework.GenericNameRegex,
+// for device names sent in a request body.
+var deviceNameRegex = regexp.MustCompile(`^\w(([\w-.]+)?\w)?$`)
+
+// selfEnrollRequestMessage asks the client to sign with a registered key and
+// to register a new one, both over the same challenge.
+type selfEnrollRequestMessage struct {
+	SignRequest *u2f.SignRequestMessage `json:"signRequest"`
+
+	RegisterRequest *u2f.RegisterRequestMessage `json:"registerRequest"`
+
+	ChallengeID string `json:"challengeId"`
+}
+
+func pathSelfEnrollRequest(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "selfEnrollRequest/" + framework.GenericNameRegex("name"),
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.rateLimited("selfEnrollRequest", b.SelfEnrollRequest),
+				Summary:  "Returns a challenge to add a key with an already registered one",
+			},
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "User name.",
+			},
+		},
+
+		HelpSynopsis:    pathSelfEnrollHelpSyn,
+		HelpDescription: pathSelfEnrollHelpDesc,
+	}
+}
+
+func pathSelfEnrollResponse(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "selfEnrollResponse/" + framework.GenericNameRegex("name"),
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.rateLimited("selfEnrollResponse", b.SelfEnrollResponse),
+				Summary:  "Adds a key authorized by an already registered one",
+			},
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "User name.",
+			},
+			"challengeId": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "ID of the challenge returned by selfEnrollRequest.",
+			},
+			"device_name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the new device.",
+			},
+			"keyHandle": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "keyHandle of the registered device.",
+			},
+			"signatureData": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "signatureData of the registered device.",
+			},
+			"clientData": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "clientData of the sign response of the registered device.",
+			},
+			"registrationData": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "registrationData of the new device.",
+			},
+			"registrationClientData": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "clientData of the registration response of the new device.",
+			},
+		},
+
+		HelpSynopsis:    pathSelfEnrollHelpSyn,
+		HelpDescription: pathSelfEnrollHelpDesc,
+	}
+}
+
+func (b *backend) SelfEnrollRequest(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(d.Get("name").(string))
+	if name == "" {
+		return nil, fmt.Errorf("missing user name")
+	}
+
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return logical.ErrorResponse("u2f backend has not been configured"), nil
+	}
+	if config.SelfEnrollmentLimit == 0 {
+		return logical.ErrorResponse(errSelfEnrollmentDisabled.Error()), nil
+	}
+
+	devices, err := b.userDevices(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	var registration []u2f.Registration
+	for _, dEntry := range devices {
+		registration = append(registration, dEntry.activeRegistrations()...)
+	}
+	if len(registration) == 0 {
+		if !config.HideUnknownNames {
+			return nil, fmt.Errorf("Wrong device name or device not registered")
+		}
+		registration, err = b.decoyRegistrations(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if selfEnrolledKeys(devices) >= config.SelfEnrollmentLimit {
+		return logical.ErrorResponse(errSelfEnrollmentLimit.Error()), nil
+	}
+
+	c, err := u2f.NewChallenge(config.AppID, config.TrustedFacets, registration)
+	if err != nil {
+		return nil, err
+	}
+	cEntry := &ChallengeEntry{
+		Type:       challengeTypeSelfEnroll,
+		DeviceName: name,
+		Challenge:  c,
+	}
+	if err := b.issueChallenge(ctx, req.Storage, config, cEntry); err != nil {
+		return nil, err
+	}
+
+	mJSON, err := json.Marshal(selfEnrollRequestMessage{
+		SignRequest:     c.SignRequest(),
+		RegisterRequest: u2fRegisterRequest(c),
+		ChallengeID:     cEntry.ID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			logical.HTTPContentType: "application/json",
+			logical.HTTPRawBody:     string(mJSON),
+			logical.HTTPStatusCode:  200,
+		},
+	}, nil
+}
+
+func (b *backend) SelfEnrollResponse(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(d.Get("name").(string))
+	if name == "" {
+		return nil, fmt.Errorf("missing user name")
+	}
+	deviceName := strings.ToLower(d.Get("device_name").(string))
+	if !deviceNameRegex.MatchString(deviceName) {
+		return logical.ErrorResponse("missing or invalid device_name"), logical.ErrInvalidRequest
+	}
+
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return logical.ErrorResponse("u2f backend has not been configured"), nil
+	}
+	if config.SelfEnrollmentLimit == 0 {
+		return logical.ErrorResponse(errSelfEnrollmentDisabled.Error()), nil
+	}
+
+	cEntry, err := b.consumeChallenge(ctx, req.Storage, d.Get("challengeId").(string), challengeTypeSelfEnroll, name)
+	switch {
+	case err == errChallengeNotFound || err == errChallengeExpired:
+		b.Logger().Error("SelfEnrollResponse", "user", name, "error", err)
+		return logical.ErrorResponse(err.Error()), nil
+	case err != nil:
+		return nil, err
+	}
+
+	unlock := b.lockKeys(userLockKey(name), deviceLockKey(deviceName))
+	defer unlock()
+
+	existing, err := b.device(ctx, req.Storage, deviceName)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return logical.ErrorResponse(fmt.Sprintf("device %q already exists", deviceName)), nil
+	}
+
+	signResp := u2f.SignResponse{
+		KeyHandle:     d.Get("keyHandle").(string),
+		SignatureData: d.Get("signatureData").(string),
+		ClientData:    d.Get("clientData").(string),
+	}
+	dEntry, roleEntry, errResp, err := b.authenticate(ctx, req, config, name, cEntry.Challenge, signResp)
+	if errResp != nil || err != nil {
+		return errResp, err
+	}
+
+	devices, err := b.userDevices(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if selfEnrolledKeys(devices) >= config.SelfEnrollmentLimit {
+		b.Logger().Error("SelfEnrollResponse", "user", name, "error", errSelfEnrollmentLimit)
+		return logical.ErrorResponse(errSelfEnrollmentLimit.Error()), nil
+	}
+
+	regResp := u2f.RegisterResponse{
+		RegistrationData: d.Get("registrationData").(string),
+		ClientData:       d.Get("registrationClientData").(string),
+	}
+	regEntry, errResp, err := b.register(ctx, req.Storage, deviceName, cEntry.Challenge, roleEntry, regResp)
+	if errResp != nil || err != nil {
+		return errResp, err
+	}
+	regEntry.selfEnrolled(signResp.KeyHandle)
+
+	pub, err := registrationPublicKey(regEntry)
+	if err != nil {
+		return nil, err
+	}
+	claim, owner, err := b.claimKey(ctx, req.Storage, deviceName, regEntry.KeyHandle, pub)
+	if err != nil {
+		return nil, err
+	}
+	if owner != nil {
+		return b.duplicateKeyResponse(owner, regEntry.KeyHandle, false), nil
+	}
+	defer claim.release(ctx, req.Storage)
+
+	// The new device gets the role of the key that authorized it
+	newEntry := &DeviceData{
+		Name:             deviceName,
+		RegistrationData: regResp.RegistrationData,
+		ClientData:       regResp.ClientData,
+		Registration:     []RegistrationEntry{*regEntry},
+		RoleName:         dEntry.RoleName,
+	}
+	if err := b.addUserDevice(ctx, req.Storage, name, newEntry); err != nil {
+		return nil, err
+	}
+	if err := b.setDevice(ctx, req.Storage, deviceName, newEntry); err != nil {
+		return nil, err
+	}
+	claim.keep()
+	b.Logger().Info("SelfEnrollResponse", "user", name, "device", deviceName, "authorized by", dEntry.Name)
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			logical.HTTPContentType: "application/json",
+			logical.HTTPRawBody:     `{"ok":true}`,
+			logical.HTTPStatusCode:  200,
+		},
+	}, nil
+}
+
+// selfEnrolledKeys counts the keys the user added through self-enrollment.
+func selfEnrolledKeys(devices []*DeviceData) int {
+	count := 0
+	for _, dEntry := range devices {
+		for _, reg := range dEntry.Registration {
+			if reg.SelfEnrolled {
+				count++
+			}
+		}
+		for _, cred := range dEntry.Credentials {
+			if cred.SelfEnrolled {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+const pathSelfEnrollHelpSyn = `
+Add a backup key authorized by an already registered key
+`
+
+const pathSelfEnrollHelpDesc = `
+These endpoints let users add a key to their own identity without an
+administrator. "selfEnrollRequest/<user>" returns a u2f sign request for the
+keys of the user and a register request for the new key, over the same
+challenge. "selfEnrollResponse/<user>" takes both responses and the name of
+the new device. The sign response is checked like a login; only then is the
+new key registered, as a new device of the user with the role of the key
+that signed.
+
+Self-enrolled keys are marked with "self_enrolled" and the key handle that
+authorized them. The number of keys a user may add this way is limited by
+"self_enrollment_limit" on the config endpoint, which disables
+self-enrollment when 0.
+`
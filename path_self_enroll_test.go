@@ -0,0 +1,159 @@
+package u2fauth
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/ryankurte/go-u2f"
+)
+
+func setSelfEnrollmentLimit(t *testing.T, b logical.Backend, s logical.Storage, limit int) {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"self_enrollment_limit": limit,
+		},
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+}
+
+func selfEnrollRequest(t *testing.T, b logical.Backend, s logical.Storage, name string) (*selfEnrollRequestMessage, *logical.Response, error) {
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "selfEnrollRequest/" + name,
+		Storage:   s,
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || resp == nil || resp.IsError() {
+		return nil, resp, err
+	}
+
+	var message selfEnrollRequestMessage
+	if err := json.Unmarshal([]byte(resp.Data[logical.HTTPRawBody].(string)), &message); err != nil {
+		t.Fatal(err)
+	}
+	return &message, resp, nil
+}
+
+func selfEnrollResponse(b logical.Backend, s logical.Storage, name, challengeID, deviceName string, signResp *u2f.SignResponse, regResp *u2f.RegisterResponse) (*logical.Response, error) {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "selfEnrollResponse/" + name,
+		Storage:   s,
+		Data: map[string]interface{}{
+			"challengeId":            challengeID,
+			"device_name":            deviceName,
+			"keyHandle":              signResp.KeyHandle,
+			"signatureData":          signResp.SignatureData,
+			"clientData":             signResp.ClientData,
+			"registrationData":       regResp.RegistrationData,
+			"registrationClientData": regResp.ClientData,
+		},
+	}
+	return b.HandleRequest(context.Background(), req)
+}
+
+// selfEnroll adds newKey to the user, signing with vk.
+func selfEnroll(t *testing.T, b logical.Backend, s logical.Storage, vk, newKey *virtualKey, name, deviceName string) (*logical.Response, error) {
+	message, resp, err := selfEnrollRequest(t, b, s, name)
+	if message == nil {
+		return resp, err
+	}
+	signResp, err := vk.HandleAuthenticationRequest(*message.SignRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	regResp, err := newKey.HandleRegisterRequest(*message.RegisterRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return selfEnrollResponse(b, s, name, message.ChallengeID, deviceName, signResp, regResp)
+}
+
+func TestSelfEnroll(t *testing.T) {
+	b, storage, vk := setupDevice(t, "alice")
+
+	backup, err := newVirtualKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := selfEnroll(t, b, storage, vk, backup, "alice", "alice-backup")
+	if err != nil || resp == nil || !resp.IsError() || resp.Data["error"] != errSelfEnrollmentDisabled.Error() {
+		t.Fatalf("expected self-enrollment to be disabled, got err:%v resp:%#v", err, resp)
+	}
+
+	setSelfEnrollmentLimit(t, b, storage, 1)
+
+	// The new key is only added when signing with a key of the user
+	stranger, err := newVirtualKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerDevice(t, b, storage, stranger, "mallory", "my-role")
+	message, resp, err := selfEnrollRequest(t, b, storage, "alice")
+	if message == nil {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	signReq := *message.SignRequest
+	signReq.RegisteredKeys = signRequest(t, b, storage, "mallory").RegisteredKeys
+	signResp, err := stranger.HandleAuthenticationRequest(signReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	regResp, err := backup.HandleRegisterRequest(*message.RegisterRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = selfEnrollResponse(b, storage, "alice", message.ChallengeID, "alice-backup", signResp, regResp)
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected a key of another user to be refused, got err:%v resp:%#v", err, resp)
+	}
+
+	resp, err = selfEnroll(t, b, storage, vk, backup, "alice", "alice-backup")
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	resp, err = login(t, b, storage, backup, "alice")
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if resp.Auth.Alias.Name != "u2f_alice" || resp.Auth.Metadata["device_name"] != "alice-backup" || resp.Auth.Metadata["role"] != "my-role" {
+		t.Fatalf("bad: auth: %#v", resp.Auth)
+	}
+
+	data := readDevice(t, b, storage, "alice-backup")
+	reg := data["registrations"].([]map[string]interface{})[0]
+	if reg["self_enrolled"] != true || reg["enrolled_with"] != encodeWebSafe(vk.keys[0].keyHandle) || reg["enrolled_at"] == "" {
+		t.Fatalf("bad: registration: %#v", reg)
+	}
+
+	another, err := newVirtualKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = selfEnroll(t, b, storage, vk, another, "alice", "alice-third")
+	if err != nil || resp == nil || !resp.IsError() || resp.Data["error"] != errSelfEnrollmentLimit.Error() {
+		t.Fatalf("expected the self-enrollment limit to be enforced, got err:%v resp:%#v", err, resp)
+	}
+}
+
+func TestSelfEnroll_HideUnknownNames(t *testing.T) {
+	b, storage, _ := setupDevice(t, "my-device")
+	setSelfEnrollmentLimit(t, b, storage, 1)
+	writeConfig(t, b, storage, map[string]interface{}{
+		"hide_unknown_names": true,
+	})
+
+	message, resp, err := selfEnrollRequest(t, b, storage, "nobody")
+	if err != nil || message == nil || len(message.SignRequest.RegisteredKeys) == 0 {
+		t.Fatalf("expected fake key handles, got err:%v resp:%#v", err, resp)
+	}
+}
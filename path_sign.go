@@ -3,20 +3,40 @@ package u2fauth
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/ryankurte/go-u2f"
 )
 
+var (
+	errCounterRegression = errors.New("authenticator counter did not increase, key handle quarantined")
+	errKeyQuarantined    = errors.New("key handle is quarantined")
+	errKeyDisabled       = errors.New("key handle is disabled")
+	errDeviceDisabled    = errors.New("device is disabled")
+	errKeyReplaced       = errors.New("key handle has been replaced")
+
+	errUserVerificationRequired = errors.New("role requires user verification, which u2f logins do not provide")
+)
+
+// signRequestMessage is the u2f sign request returned to the client along
+// with the ID it must send back with the response.
+type signRequestMessage struct {
+	*u2f.SignRequestMessage
+	ChallengeID string `json:"challengeId"`
+}
+
 func pathSignResponse(b *backend) *framework.Path {
 	return &framework.Path{
 		Pattern: "signResponse/" + framework.GenericNameRegex("name"),
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.UpdateOperation: &framework.PathOperation{
-				Callback:    b.SignResponse,
+				Callback:    b.rateLimited("signResponse", b.SignResponse),
 				Summary:     "Authenticates a u2f device challenge",
 				Description: "Authenticates a u2f device challenge",
 			},
@@ -25,7 +45,11 @@ func pathSignResponse(b *backend) *framework.Path {
 		Fields: map[string]*framework.FieldSchema{
 			"name": &framework.FieldSchema{
 				Type:        framework.TypeString,
-				Description: "Device name.",
+				Description: "User name.",
+			},
+			"challengeId": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "ID of the challenge returned by signRequest.",
 			},
 			"keyHandle": &framework.FieldSchema{
 				Type:        framework.TypeString,
@@ -49,7 +73,7 @@ func pathSignRequest(b *backend) *framework.Path {
 		Pattern: "signRequest/" + framework.GenericNameRegex("name"),
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.ReadOperation: &framework.PathOperation{
-				Callback:    b.SignRequest,
+				Callback:    b.rateLimited("signRequest", b.SignRequest),
 				Summary:     "Returns a challenge to authenticate a u2f device",
 				Description: "Returns a challenge to authenticate a u2f device",
 			},
@@ -57,7 +81,7 @@ func pathSignRequest(b *backend) *framework.Path {
 		Fields: map[string]*framework.FieldSchema{
 			"name": &framework.FieldSchema{
 				Type:        framework.TypeString,
-				Description: "Device name.",
+				Description: "User name.",
 			},
 		},
 		//HelpSynopsis:    pathLoginSyn,
@@ -73,67 +97,220 @@ func (b *backend) SignResponse(
 	if name == "" {
 		return nil, fmt.Errorf("missing device name")
 	}
-	dEntry, err := b.device(ctx, req.Storage, name)
+	config, err := b.config(ctx, req.Storage)
 	if err != nil {
 		return nil, err
 	}
+	if config == nil {
+		return logical.ErrorResponse("u2f backend has not been configured"), nil
+	}
 
-	if dEntry == nil {
-		b.Logger().Error("SignResponse", "Device not registered:", name)
-		return logical.ErrorResponse("Device not registered"), nil
+	var cEntry *ChallengeEntry
+	challengeID := d.Get("challengeId").(string)
+	if config.StatelessChallenges && strings.Contains(challengeID, ".") {
+		cEntry, err = b.verifySignedChallenge(ctx, req.Storage, config, challengeID, challengeTypeSign, name)
+	} else {
+		cEntry, err = b.consumeChallenge(ctx, req.Storage, challengeID, challengeTypeSign, name)
 	}
-	if dEntry.Challenge == nil {
-		b.Logger().Error("SignResponse", "challenge not found for device:", name)
-		return logical.ErrorResponse("Device not registered"), nil
+	switch {
+	case err == errChallengeNotFound || err == errChallengeExpired:
+		b.Logger().Error("SignResponse", "device", name, "error", err)
+		return logical.ErrorResponse(err.Error()), nil
+	case err != nil:
+		return nil, err
 	}
 
-	keyHandle := d.Get("keyHandle").(string)
-	clientData := d.Get("clientData").(string)
-	signatureData := d.Get("signatureData").(string)
-
 	resp := u2f.SignResponse{
-		KeyHandle:     keyHandle,
-		SignatureData: signatureData,
-		ClientData:    clientData,
+		KeyHandle:     d.Get("keyHandle").(string),
+		SignatureData: d.Get("signatureData").(string),
+		ClientData:    d.Get("clientData").(string),
 	}
 
 	b.Logger().Debug("SignResponse", "regResp", resp)
 
+	unlock := b.lockKeys(userLockKey(name))
+	defer unlock()
+
+	dEntry, roleEntry, errResp, err := b.authenticate(ctx, req, config, name, cEntry.Challenge, resp)
+	if errResp != nil || err != nil {
+		return errResp, err
+	}
+
+	alias, err := b.aliasName(ctx, req.Storage, config, name)
+	if err != nil {
+		return nil, err
+	}
+	return loginResponse(name, alias, dEntry, roleEntry, false), nil
+}
+
+// authenticate verifies a u2f sign response with the key of the user it
+// names, then updates the counter and last use of that key. A non-nil
+// response tells why the key was refused. The caller holds the lock of the
+// user.
+func (b *backend) authenticate(ctx context.Context, req *logical.Request, config *ConfigEntry, name string, c *u2f.Challenge, resp u2f.SignResponse) (*DeviceData, *RoleEntry, *logical.Response, error) {
+	devices, err := b.userDevices(ctx, req.Storage, name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if config.HideUnknownNames && !hasActiveRegistrations(devices) {
+		errResp, err := b.decoyAuthenticate(ctx, req, name, c, resp)
+		return nil, nil, errResp, err
+	}
+	if len(devices) == 0 {
+		b.Logger().Error("authenticate", "Device not registered:", name)
+		return nil, nil, logical.ErrorResponse("Device not registered"), nil
+	}
+
+	keyHandle := resp.KeyHandle
+	dEntry := deviceWithKey(devices, keyHandle)
+	var regEntry *RegistrationEntry
+	if dEntry != nil {
+		regEntry = dEntry.registration(keyHandle)
+	}
+	if regEntry == nil {
+		b.Logger().Error("authenticate", "Authentication failed", u2f.ErrWrongKeyHandle)
+		return nil, nil, logical.ErrorResponse("Authentication failed: " + u2f.ErrWrongKeyHandle.Error()), nil
+	}
+	deviceName := dEntry.Name
+	if dEntry.Disabled {
+		b.Logger().Error("authenticate", "device", deviceName, "error", errDeviceDisabled)
+		return nil, nil, logical.ErrorResponse(errDeviceDisabled.Error()), nil
+	}
+
+	roleEntry, err := b.role(ctx, req.Storage, dEntry.RoleName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if roleEntry == nil {
+		b.Logger().Error("authenticate", "device", deviceName, "error", "role not found", "role", dEntry.RoleName)
+		return nil, nil, logical.ErrorResponse("Specified role name not found"), nil
+	}
+	if roleEntry.userVerification() == userVerificationRequired {
+		b.Logger().Error("authenticate", "device", deviceName, "error", errUserVerificationRequired)
+		return nil, nil, logical.ErrorResponse(errUserVerificationRequired.Error()), nil
+	}
+
+	if regEntry.Quarantined {
+		b.Logger().Error("authenticate", "device", deviceName, "key_handle", keyHandle, "error", errKeyQuarantined)
+		return nil, nil, logical.ErrorResponse(errKeyQuarantined.Error()), nil
+	}
+	if regEntry.Disabled {
+		b.Logger().Error("authenticate", "device", deviceName, "key_handle", keyHandle, "error", errKeyDisabled)
+		return nil, nil, logical.ErrorResponse(errKeyDisabled.Error()), nil
+	}
+	if regEntry.retired(time.Now()) {
+		b.Logger().Error("authenticate", "device", deviceName, "key_handle", keyHandle, "error", errKeyReplaced)
+		return nil, nil, logical.ErrorResponse(errKeyReplaced.Error()), nil
+	}
+	lockedOut := dEntry.lockedOut(keyHandle)
+	if lockedOut {
+		b.Logger().Error("authenticate", "device", deviceName, "key_handle", keyHandle, "error", errLockedOut)
+		if !config.HideUnknownNames {
+			return nil, nil, logical.ErrorResponse(errLockedOut.Error()), nil
+		}
+	}
+
+	// Verify against the current registration, stateless challenges do not
+	// carry it. The counter is compared below according to the counter
+	// policy rather than by the u2f library.
+	registration := regEntry.Registration
+	registration.Counter = 0
+	c.RegisteredKeys = []u2f.Registration{registration}
+
 	// Perform authentication
-	reg, err := dEntry.Challenge.Authenticate(resp)
+	reg, err := c.Authenticate(resp)
+	if lockedOut {
+		// Decoys are never locked out, so a locked out key fails like a
+		// wrong signature after the same work when names are hidden
+		if err == nil {
+			err = u2f.ErrInvalidSig
+		}
+		return nil, nil, logical.ErrorResponse("Authentication failed: " + err.Error()), nil
+	}
 	if err != nil {
 		// Authentication failed.
-		b.Logger().Error("SignResponse", "Authentication failed", err)
-		return logical.ErrorResponse("Authentication failed: " + err.Error()), nil
+		b.Logger().Error("authenticate", "Authentication failed", err)
+		if dEntry.loginFailed(lockoutPolicyFor(config, roleEntry), keyHandle) {
+			b.Logger().Warn("authenticate", "device", deviceName, "key_handle", keyHandle, "failed logins", dEntry.FailedLogins, "locked until", dEntry.LockedUntil)
+			if serr := b.setDevice(ctx, req.Storage, deviceName, dEntry); serr != nil {
+				return nil, nil, nil, serr
+			}
+		}
+		return nil, nil, logical.ErrorResponse("Authentication failed: " + err.Error()), nil
 	}
-	// TODO: expire registrations or implement a FIFO
-	dEntry.Registration = append(dEntry.Registration, *reg)
 
-	err = b.setDevice(ctx, req.Storage, name, dEntry)
-	if err != nil {
-		return nil, err
+	if err := b.checkCounter(config, deviceName, regEntry.KeyHandle, regEntry.Counter, reg.Counter); err != nil {
+		regEntry.quarantine()
+		if serr := b.setDevice(ctx, req.Storage, deviceName, dEntry); serr != nil {
+			return nil, nil, nil, serr
+		}
+		return nil, nil, logical.ErrorResponse(err.Error()), nil
+	}
+	if reg.Counter > regEntry.Counter {
+		regEntry.Counter = reg.Counter
+	}
+	regEntry.used(req)
+	dEntry.LastUsedAt = time.Now()
+	dEntry.loginSucceeded(keyHandle)
+
+	if err := b.setDevice(ctx, req.Storage, deviceName, dEntry); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return dEntry, roleEntry, nil, nil
+}
+
+// loginResponse issues a token for an authenticated device through the role
+// the device was registered with. The alias is the user owning the device.
+// The metadata tells logins with user verification apart from presence-only
+// ones.
+func loginResponse(name, alias string, dEntry *DeviceData, roleEntry *RoleEntry, userVerified bool) *logical.Response {
+	metadata := map[string]string{}
+	for k, v := range dEntry.Metadata {
+		metadata[k] = v
 	}
+	// Set last so that device metadata cannot override them
+	metadata["user_name"] = name
+	metadata["device_name"] = dEntry.Name
+	metadata["role"] = dEntry.RoleName
+	metadata["user_verification"] = roleEntry.userVerification()
+	metadata["user_verified"] = strconv.FormatBool(userVerified)
 
 	auth := &logical.Auth{
-		Metadata: map[string]string{
-			"device_name": name,
-			"role":   dEntry.RoleName,
-		},
+		Metadata:    metadata,
 		DisplayName: "u2f_" + name,
 		Alias: &logical.Alias{
-			Name: "u2f_" + name,
+			Name:     alias,
+			Metadata: metadata,
 		},
 	}
 
-	roleEntry, err := b.role(ctx, req.Storage, dEntry.RoleName)
-	if err != nil {
-		return nil, err
-	}
-
 	roleEntry.PopulateTokenAuth(auth)
 	return &logical.Response{
 		Auth: auth,
-	}, nil
+	}
+}
+
+// checkCounter compares the counter returned by the authenticator with the
+// stored one. A counter that does not increase hints at a cloned key; under
+// the strict policy errCounterRegression is returned and the caller
+// quarantines the key.
+func (b *backend) checkCounter(config *ConfigEntry, name, keyHandle string, stored, counter uint) error {
+	// Authenticators without a counter always report zero
+	if counter > stored || (counter == 0 && stored == 0) {
+		return nil
+	}
+
+	switch config.counterPolicy() {
+	case counterPolicyIgnore:
+		return nil
+	case counterPolicyWarn:
+		b.Logger().Warn("authenticator counter did not increase", "device", name, "key_handle", keyHandle, "stored", stored, "received", counter)
+		return nil
+	}
+
+	b.Logger().Warn("authenticator counter did not increase, key handle quarantined", "device", name, "key_handle", keyHandle, "stored", stored, "received", counter)
+	return errCounterRegression
 }
 
 func (b *backend) SignRequest(
@@ -146,32 +323,61 @@ func (b *backend) SignRequest(
 		return nil, fmt.Errorf("missing device name")
 	}
 
-	dEntry, err := b.device(ctx, req.Storage, name)
+	config, err := b.config(ctx, req.Storage)
 	if err != nil {
 		return nil, err
 	}
-
-	if dEntry == nil || dEntry.Registration == nil {
-		return nil, fmt.Errorf("Wrong device name or device not registered")
+	if config == nil {
+		return logical.ErrorResponse("u2f backend has not been configured"), nil
 	}
 
-	registration = dEntry.Registration
+	devices, err := b.userDevices(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, dEntry := range devices {
+		registration = append(registration, dEntry.activeRegistrations()...)
+	}
+	if len(registration) == 0 {
+		if !config.HideUnknownNames {
+			return nil, fmt.Errorf("Wrong device name or device not registered")
+		}
+		registration, err = b.decoyRegistrations(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	b.Logger().Debug("SignRequest", "registration", registration)
-	c, err := u2f.NewChallenge(appID, trustedFacets, registration)
+	c, err := u2f.NewChallenge(config.AppID, config.TrustedFacets, registration)
 	if err != nil {
 		b.Logger().Debug("SignRequest", "error", err)
 		return nil, err
 	}
 
-	dEntry.Challenge = c
-
-	err = b.setDevice(ctx, req.Storage, name, dEntry)
-	if err != nil {
-		return nil, err
+	var challengeID string
+	if config.StatelessChallenges {
+		challengeID, err = b.signChallenge(ctx, req.Storage, config, challengeTypeSign, name, c)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		cEntry := &ChallengeEntry{
+			Type:       challengeTypeSign,
+			DeviceName: name,
+			Challenge:  c,
+		}
+		err = b.issueChallenge(ctx, req.Storage, config, cEntry)
+		if err != nil {
+			return nil, err
+		}
+		challengeID = cEntry.ID
 	}
 
-	u2fReq := c.SignRequest()
+	u2fReq := signRequestMessage{
+		SignRequestMessage: c.SignRequest(),
+		ChallengeID:        challengeID,
+	}
 	b.Logger().Debug("SignRequest", "challenge", c)
 	b.Logger().Debug("SignRequest", "u2fReq", u2fReq)
 	mJSON, err := json.Marshal(u2fReq)
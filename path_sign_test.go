@@ -0,0 +1,436 @@
+package u2fauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/ryankurte/go-u2f"
+)
+
+func registerDevice(t *testing.T, b logical.Backend, s logical.Storage, vk *virtualKey, name, roleName string) {
+	resp, err := tryRegisterDevice(t, b, s, vk, name, roleName)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+}
+
+func tryRegisterDevice(t *testing.T, b logical.Backend, s logical.Storage, vk *virtualKey, name, roleName string) (*logical.Response, error) {
+	return tryRegisterUserDevice(t, b, s, vk, name, roleName, "")
+}
+
+func tryRegisterUserDevice(t *testing.T, b logical.Backend, s logical.Storage, vk *virtualKey, name, roleName, userName string) (*logical.Response, error) {
+	return tryRegisterDeviceWith(t, b, s, vk, name, map[string]interface{}{
+		"role_name": roleName,
+		"user_name": userName,
+	})
+}
+
+// tryRegisterDeviceWith registers vk with the given registerRequest data.
+func tryRegisterDeviceWith(t *testing.T, b logical.Backend, s logical.Storage, vk *virtualKey, name string, data map[string]interface{}) (*logical.Response, error) {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "registerRequest/" + name,
+		Storage:   s,
+		Data:      data,
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	var registerReq registerRequestMessage
+	if err := json.Unmarshal([]byte(resp.Data[logical.HTTPRawBody].(string)), &registerReq); err != nil {
+		t.Fatal(err)
+	}
+
+	vkResp, err := vk.HandleRegisterRequest(*registerReq.RegisterRequestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "registerResponse/" + name,
+		Storage:   s,
+		// Set by Vault from the token that made the request
+		DisplayName:         "token-admin",
+		ClientTokenAccessor: "admin-accessor",
+		Data: map[string]interface{}{
+			"challengeId":      registerReq.ChallengeID,
+			"registrationData": vkResp.RegistrationData,
+			"clientData":       vkResp.ClientData,
+		},
+	}
+	return b.HandleRequest(context.Background(), req)
+}
+
+func signRequest(t *testing.T, b logical.Backend, s logical.Storage, name string) *signRequestMessage {
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "signRequest/" + name,
+		Storage:   s,
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	var signReq signRequestMessage
+	if err := json.Unmarshal([]byte(resp.Data[logical.HTTPRawBody].(string)), &signReq); err != nil {
+		t.Fatal(err)
+	}
+	return &signReq
+}
+
+func signResponse(b logical.Backend, s logical.Storage, name, challengeID string, signResp *u2f.SignResponse) (*logical.Response, error) {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "signResponse/" + name,
+		Storage:   s,
+		Connection: &logical.Connection{
+			RemoteAddr: "192.0.2.10",
+		},
+		Data: map[string]interface{}{
+			"challengeId":   challengeID,
+			"keyHandle":     signResp.KeyHandle,
+			"signatureData": signResp.SignatureData,
+			"clientData":    signResp.ClientData,
+		},
+	}
+	return b.HandleRequest(context.Background(), req)
+}
+
+func login(t *testing.T, b logical.Backend, s logical.Storage, vk *virtualKey, name string) (*logical.Response, error) {
+	signReq := signRequest(t, b, s, name)
+	signResp, err := vk.HandleAuthenticationRequest(*signReq.SignRequestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signResponse(b, s, name, signReq.ChallengeID, signResp)
+}
+
+func setupDevice(t *testing.T, name string) (logical.Backend, logical.Storage, *virtualKey) {
+	b, storage := getBackend(t)
+	configureBackend(t, b, storage)
+	createRole(t, b, storage, "my-role", "c,d")
+
+	vk, err := newVirtualKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerDevice(t, b, storage, vk, name, "my-role")
+	return b, storage, vk
+}
+
+func TestSignResponse_Replay(t *testing.T) {
+	b, storage, vk := setupDevice(t, "my-device")
+
+	signReq := signRequest(t, b, storage, "my-device")
+	signResp, err := vk.HandleAuthenticationRequest(*signReq.SignRequestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := signResponse(b, storage, "my-device", signReq.ChallengeID, signResp)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	resp, err = signResponse(b, storage, "my-device", signReq.ChallengeID, signResp)
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected replay to be rejected, got err:%v resp:%#v", err, resp)
+	}
+	if resp.Error().Error() != errChallengeNotFound.Error() {
+		t.Fatalf("bad: error: %v", resp.Error())
+	}
+}
+
+func TestSignResponse_ExpiredChallenge(t *testing.T) {
+	b, storage, vk := setupDevice(t, "my-device")
+
+	signReq := signRequest(t, b, storage, "my-device")
+	signResp, err := vk.HandleAuthenticationRequest(*signReq.SignRequestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cEntry, err := b.(*backend).challenge(context.Background(), storage, signReq.ChallengeID)
+	if err != nil || cEntry == nil {
+		t.Fatalf("err:%v challenge:%#v", err, cEntry)
+	}
+	cEntry.ExpiresAt = time.Now().Add(-time.Second)
+	if err := b.(*backend).setChallenge(context.Background(), storage, cEntry); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := signResponse(b, storage, "my-device", signReq.ChallengeID, signResp)
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected expired challenge to be rejected, got err:%v resp:%#v", err, resp)
+	}
+	if resp.Error().Error() != errChallengeExpired.Error() {
+		t.Fatalf("bad: error: %v", resp.Error())
+	}
+
+	// The periodic tidy removes challenges that were never answered
+	signRequest(t, b, storage, "my-device")
+	cEntry.ID = "00000000-0000-0000-0000-000000000000"
+	if err := b.(*backend).setChallenge(context.Background(), storage, cEntry); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.(*backend).tidyChallenges(context.Background(), storage); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := storage.List(context.Background(), "challenges/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 {
+		t.Fatalf("bad: challenges after tidy: %v", ids)
+	}
+}
+
+func TestSignRequest_OutstandingChallenges(t *testing.T) {
+	b, storage, vk := setupDevice(t, "my-device")
+
+	first := signRequest(t, b, storage, "my-device")
+	second := signRequest(t, b, storage, "my-device")
+	if first.ChallengeID == second.ChallengeID || first.Challenge == second.Challenge {
+		t.Fatalf("bad: challenges are not distinct")
+	}
+
+	for _, signReq := range []*signRequestMessage{first, second} {
+		signResp, err := vk.HandleAuthenticationRequest(*signReq.SignRequestMessage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := signResponse(b, storage, "my-device", signReq.ChallengeID, signResp)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v", err, resp)
+		}
+	}
+}
+
+func TestSignResponse_WrongDevice(t *testing.T) {
+	b, storage, vk := setupDevice(t, "my-device")
+	registerDevice(t, b, storage, vk, "other-device", "my-role")
+
+	signReq := signRequest(t, b, storage, "my-device")
+	signResp, err := vk.HandleAuthenticationRequest(*signReq.SignRequestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := signResponse(b, storage, "other-device", signReq.ChallengeID, signResp)
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected challenge for another device to be rejected, got err:%v resp:%#v", err, resp)
+	}
+}
+
+func setCounterPolicy(t *testing.T, b logical.Backend, s logical.Storage, policy string) {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"counter_policy": policy,
+		},
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+}
+
+func bumpStoredCounter(t *testing.T, b logical.Backend, s logical.Storage, name string, counter uint) {
+	dEntry, err := b.(*backend).device(context.Background(), s, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range dEntry.Registration {
+		dEntry.Registration[i].Counter = counter
+	}
+	if err := b.(*backend).setDevice(context.Background(), s, name, dEntry); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignResponse_CounterUpdatedInPlace(t *testing.T) {
+	b, storage, vk := setupDevice(t, "my-device")
+
+	for i := 0; i < 3; i++ {
+		resp, err := login(t, b, storage, vk, "my-device")
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v", err, resp)
+		}
+	}
+
+	dEntry, err := b.(*backend).device(context.Background(), storage, "my-device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dEntry.Registration) != 1 {
+		t.Fatalf("bad: registrations: %d", len(dEntry.Registration))
+	}
+	if dEntry.Registration[0].Counter != 3 {
+		t.Fatalf("bad: counter: %d", dEntry.Registration[0].Counter)
+	}
+}
+
+func TestSignResponse_CounterPolicyStrict(t *testing.T) {
+	b, storage, vk := setupDevice(t, "my-device")
+	bumpStoredCounter(t, b, storage, "my-device", 100)
+
+	resp, err := login(t, b, storage, vk, "my-device")
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected counter regression, got err:%v resp:%#v", err, resp)
+	}
+	if resp.Error().Error() != errCounterRegression.Error() {
+		t.Fatalf("bad: error: %v", resp.Error())
+	}
+
+	dEntry, err := b.(*backend).device(context.Background(), storage, "my-device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dEntry.Registration[0].Quarantined {
+		t.Fatalf("bad: key handle was not quarantined")
+	}
+
+	// A quarantined key handle is no longer offered
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "signRequest/my-device",
+		Storage:   storage,
+	}
+	_, err = b.HandleRequest(context.Background(), req)
+	if err == nil {
+		t.Fatalf("expected sign request to fail")
+	}
+}
+
+func TestSignResponse_CounterPolicyWarn(t *testing.T) {
+	b, storage, vk := setupDevice(t, "my-device")
+	setCounterPolicy(t, b, storage, counterPolicyWarn)
+	bumpStoredCounter(t, b, storage, "my-device", 100)
+
+	resp, err := login(t, b, storage, vk, "my-device")
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	dEntry, err := b.(*backend).device(context.Background(), storage, "my-device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dEntry.Registration[0].Quarantined || dEntry.Registration[0].Counter != 100 {
+		t.Fatalf("bad: registration: %#v", dEntry.Registration[0])
+	}
+}
+
+func TestSignResponse_UserVerification(t *testing.T) {
+	b, storage, vk := setupDevice(t, "my-device")
+
+	resp, err := login(t, b, storage, vk, "my-device")
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if resp.Auth.Metadata["user_verification"] != "preferred" || resp.Auth.Metadata["user_verified"] != "false" {
+		t.Fatalf("bad: metadata: %#v", resp.Auth.Metadata)
+	}
+
+	setUserVerification(t, b, storage, "my-role", "required")
+	resp, err = login(t, b, storage, vk, "my-device")
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected u2f login to be refused, got err:%v resp:%#v", err, resp)
+	}
+	if resp.Error().Error() != errUserVerificationRequired.Error() {
+		t.Fatalf("bad: error: %v", resp.Error())
+	}
+}
+
+// impostorLogin answers the sign request with a key holding the first key
+// handle offered but another private key, as someone probing names would.
+func impostorLogin(t *testing.T, b logical.Backend, s logical.Storage, name string) *logical.Response {
+	signReq := signRequest(t, b, s, name)
+	if len(signReq.RegisteredKeys) == 0 {
+		t.Fatalf("bad: sign request: %#v", signReq)
+	}
+	keyHandle, err := decodeWebSafe(signReq.RegisteredKeys[0].KeyHandle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	impostor := &virtualKey{keys: []*virtualCredential{{
+		appID:     signReq.AppID,
+		keyHandle: keyHandle,
+		private:   private,
+	}}}
+	signResp, err := impostor.HandleAuthenticationRequest(*signReq.SignRequestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := signResponse(b, s, name, signReq.ChallengeID, signResp)
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected the login to fail, got err:%v resp:%#v", err, resp)
+	}
+	return resp
+}
+
+func TestSignRequest_HideUnknownNames(t *testing.T) {
+	b, storage, _ := setupDevice(t, "my-device")
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"hide_unknown_names": true,
+		},
+	}
+	if resp, err := b.HandleRequest(context.Background(), req); err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	// The same key handles are offered every time
+	first := signRequest(t, b, storage, "nobody")
+	second := signRequest(t, b, storage, "nobody")
+	if len(first.RegisteredKeys) == 0 || !reflect.DeepEqual(first.RegisteredKeys, second.RegisteredKeys) {
+		t.Fatalf("bad: sign requests:\n%#v\n%#v", first.RegisteredKeys, second.RegisteredKeys)
+	}
+	if other := signRequest(t, b, storage, "somebody"); reflect.DeepEqual(first.RegisteredKeys, other.RegisteredKeys) {
+		t.Fatal("expected other names to get other key handles")
+	}
+
+	known := impostorLogin(t, b, storage, "my-device")
+	unknown := impostorLogin(t, b, storage, "nobody")
+	if known.Data["error"] != unknown.Data["error"] {
+		t.Fatalf("expected the same error, got %q and %q", known.Data["error"], unknown.Data["error"])
+	}
+}
+
+func TestSignResponse_HideLockout(t *testing.T) {
+	b, storage, vk := setupDevice(t, "my-device")
+	writeConfig(t, b, storage, map[string]interface{}{
+		"hide_unknown_names": true,
+		"lockout_threshold":  1,
+		"lockout_duration":   "1h",
+	})
+
+	unknown := impostorLogin(t, b, storage, "nobody")
+	impostorLogin(t, b, storage, "my-device")
+
+	// The locked out key fails like a wrong signature, even when it signs
+	resp, err := login(t, b, storage, vk, "my-device")
+	if err != nil || resp == nil || resp.Data["error"] != unknown.Data["error"] {
+		t.Fatalf("expected %q, got err:%v resp:%#v", unknown.Data["error"], err, resp)
+	}
+}
@@ -0,0 +1,375 @@
+package u2fauth
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// UserEntry is a person owning one or more registered devices. Logins with
+// any of them resolve to the same entity alias.
+type UserEntry struct {
+	Name string `json:"name"`
+
+	// ID is generated when the user is created and does not change when
+	// the user is renamed
+	ID string `json:"id"`
+
+	// Devices are the names of the devices owned by the user
+	Devices []string `json:"devices"`
+}
+
+func pathUsersList(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "users/?$",
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.pathUserList,
+				Summary:  "List users",
+			},
+		},
+
+		HelpSynopsis:    pathUsersHelpSyn,
+		HelpDescription: pathUsersHelpDesc,
+	}
+}
+
+func pathUsers(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "users/" + framework.GenericNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "User name.",
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathUserRead,
+				Summary:  "Read a user and the devices it owns",
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.pathUserDelete,
+				Summary:  "Delete a user and all its devices",
+			},
+		},
+
+		HelpSynopsis:    pathUsersHelpSyn,
+		HelpDescription: pathUsersHelpDesc,
+	}
+}
+
+func (b *backend) pathUserList(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	users, err := req.Storage.List(ctx, "users/")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(users)
+	return logical.ListResponse(users), nil
+}
+
+func (b *backend) pathUserRead(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(d.Get("name").(string))
+	uEntry, err := b.user(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if uEntry == nil {
+		return nil, nil
+	}
+
+	devices := map[string]interface{}{}
+	for _, deviceName := range uEntry.Devices {
+		dEntry, err := b.device(ctx, req.Storage, deviceName)
+		if err != nil {
+			return nil, err
+		}
+		if dEntry == nil {
+			continue
+		}
+		devices[deviceName] = map[string]interface{}{
+			"role_name":    dEntry.RoleName,
+			"state":        dEntry.state(),
+			"last_used_at": formatTime(dEntry.LastUsedAt),
+		}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"name":    uEntry.Name,
+			"id":      uEntry.ID,
+			"devices": devices,
+		},
+	}, nil
+}
+
+func (b *backend) pathUserDelete(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(d.Get("name").(string))
+	uEntry, unlock, err := b.lockUser(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if uEntry == nil {
+		return nil, nil
+	}
+	b.Logger().Info("pathUserDelete", "user", name, "devices", uEntry.Devices)
+
+	for _, deviceName := range uEntry.Devices {
+		dEntry, err := b.device(ctx, req.Storage, deviceName)
+		if err != nil {
+			return nil, err
+		}
+		if dEntry == nil {
+			continue
+		}
+		if err := b.releaseKeys(ctx, req.Storage, deviceName, dEntry); err != nil {
+			return nil, err
+		}
+		if err := b.deleteDevice(ctx, req.Storage, deviceName); err != nil {
+			return nil, err
+		}
+	}
+	if err := req.Storage.Delete(ctx, "recovery-codes/"+name); err != nil {
+		return nil, err
+	}
+	return nil, req.Storage.Delete(ctx, "users/"+name)
+}
+
+func (b *backend) user(ctx context.Context, s logical.Storage, name string) (*UserEntry, error) {
+	if name == "" {
+		return nil, fmt.Errorf("missing name")
+	}
+
+	entry, err := s.Get(ctx, "users/"+strings.ToLower(name))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result UserEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (b *backend) setUser(ctx context.Context, s logical.Storage, name string, uEntry *UserEntry) error {
+	entry, err := logical.StorageEntryJSON("users/"+name, uEntry)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+// userDevices returns the devices owned by the user. A device registered
+// before users were introduced and not migrated yet is a user of its own.
+func (b *backend) userDevices(ctx context.Context, s logical.Storage, name string) ([]*DeviceData, error) {
+	uEntry, err := b.user(ctx, s, name)
+	if err != nil {
+		return nil, err
+	}
+	if uEntry == nil {
+		dEntry, err := b.device(ctx, s, name)
+		if err != nil || dEntry == nil || dEntry.UserName != "" {
+			return nil, err
+		}
+		return []*DeviceData{dEntry}, nil
+	}
+
+	var devices []*DeviceData
+	for _, deviceName := range uEntry.Devices {
+		dEntry, err := b.device(ctx, s, deviceName)
+		if err != nil {
+			return nil, err
+		}
+		if dEntry != nil {
+			devices = append(devices, dEntry)
+		}
+	}
+	return devices, nil
+}
+
+// addUserDevice makes the user, created if needed, the owner of the device.
+// The caller stores the device.
+func (b *backend) addUserDevice(ctx context.Context, s logical.Storage, name string, dEntry *DeviceData) error {
+	uEntry, err := b.user(ctx, s, name)
+	if err != nil {
+		return err
+	}
+	if uEntry == nil {
+		id, err := uuid.GenerateUUID()
+		if err != nil {
+			return err
+		}
+		uEntry = &UserEntry{Name: name, ID: id}
+
+		// A device named after the user and registered before users were
+		// introduced is theirs
+		if dEntry.Name != name {
+			legacy, err := b.device(ctx, s, name)
+			if err != nil {
+				return err
+			}
+			if legacy != nil && legacy.UserName == "" {
+				legacy.UserName = name
+				if err := b.setDevice(ctx, s, name, legacy); err != nil {
+					return err
+				}
+				uEntry.Devices = append(uEntry.Devices, name)
+			}
+		}
+	}
+
+	if !strutil.StrListContains(uEntry.Devices, dEntry.Name) {
+		uEntry.Devices = append(uEntry.Devices, dEntry.Name)
+	}
+	dEntry.UserName = name
+	return b.setUser(ctx, s, name, uEntry)
+}
+
+// removeUserDevice removes the device from the devices of its owner.
+func (b *backend) removeUserDevice(ctx context.Context, s logical.Storage, dEntry *DeviceData) error {
+	if dEntry.UserName == "" {
+		return nil
+	}
+	uEntry, err := b.user(ctx, s, dEntry.UserName)
+	if err != nil || uEntry == nil {
+		return err
+	}
+	uEntry.Devices = strutil.StrListDelete(uEntry.Devices, dEntry.Name)
+	return b.setUser(ctx, s, dEntry.UserName, uEntry)
+}
+
+// deviceUserName returns the user a device is registered for: the owner of
+// an existing device, otherwise the requested user, which defaults to the
+// device name.
+func deviceUserName(dEntry *DeviceData, name, userName string) (string, error) {
+	if dEntry != nil && dEntry.UserName != "" {
+		if userName != "" && userName != dEntry.UserName {
+			return "", fmt.Errorf("device %q belongs to another user", name)
+		}
+		return dEntry.UserName, nil
+	}
+	if userName == "" {
+		return name, nil
+	}
+	return userName, nil
+}
+
+// deviceWithKey returns the device holding the u2f registration or WebAuthn
+// credential with the given key handle.
+func deviceWithKey(devices []*DeviceData, keyHandle string) *DeviceData {
+	for _, dEntry := range devices {
+		if dEntry.registration(keyHandle) != nil || dEntry.credential(keyHandle) != nil {
+			return dEntry
+		}
+	}
+	return nil
+}
+
+// aliasName returns the name of the entity alias for logins of the user.
+func (b *backend) aliasName(ctx context.Context, s logical.Storage, config *ConfigEntry, name string) (string, error) {
+	if config.aliasNameSource() == aliasNameSourceUserID {
+		uEntry, err := b.user(ctx, s, name)
+		if err != nil {
+			return "", err
+		}
+		if uEntry != nil && uEntry.ID != "" {
+			return uEntry.ID, nil
+		}
+	}
+	return "u2f_" + name, nil
+}
+
+// initialize moves the devices registered before users were introduced
+// into a user of the same name, which keeps the "u2f_<name>" alias of their
+// logins, and gives an ID to users created before users had one. The keys of
+// devices registered before the key index existed are added to it.
+func (b *backend) initialize(ctx context.Context, req *logical.InitializationRequest) error {
+	users, err := req.Storage.List(ctx, "users/")
+	if err != nil {
+		return err
+	}
+	for _, name := range users {
+		uEntry, err := b.user(ctx, req.Storage, name)
+		if err != nil {
+			return err
+		}
+		if uEntry == nil || uEntry.ID != "" {
+			continue
+		}
+		if uEntry.ID, err = uuid.GenerateUUID(); err != nil {
+			return err
+		}
+		if err := b.setUser(ctx, req.Storage, name, uEntry); err != nil {
+			return err
+		}
+	}
+
+	names, err := req.Storage.List(ctx, "devices/")
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		dEntry, err := b.device(ctx, req.Storage, name)
+		if err != nil {
+			return err
+		}
+		if dEntry == nil {
+			continue
+		}
+		if err := b.indexKeys(ctx, req.Storage, name, dEntry); err != nil {
+			return err
+		}
+		if dEntry.UserName != "" {
+			continue
+		}
+
+		dEntry.Name = name
+		if err := b.addUserDevice(ctx, req.Storage, name, dEntry); err != nil {
+			return err
+		}
+		if err := b.setDevice(ctx, req.Storage, name, dEntry); err != nil {
+			return err
+		}
+		b.Logger().Info("initialize", "migrated device to user", name)
+	}
+	return nil
+}
+
+const pathUsersHelpSyn = `
+List, read and delete users
+`
+
+const pathUsersHelpDesc = `
+A user owns one or more devices, for example a primary and a backup key.
+Users are created when a device is registered with "user_name", which
+defaults to the device name. The login endpoints take the user name: a sign
+request offers every active key of the user, and logins with any of them
+resolve to the same "u2f_<user>" entity alias.
+
+Reading "users/<name>" returns the role, state and last login time of each
+device of the user. Deleting it removes the user, all of its devices and its
+recovery codes.
+Devices registered before users were introduced are moved into a user of the
+same name when the backend is mounted.
+`
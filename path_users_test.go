@@ -0,0 +1,223 @@
+package u2fauth
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func registerUserDevice(t *testing.T, b logical.Backend, s logical.Storage, vk *virtualKey, name, roleName, userName string) {
+	resp, err := tryRegisterUserDevice(t, b, s, vk, name, roleName, userName)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+}
+
+func readUser(t *testing.T, b logical.Backend, s logical.Storage, name string) map[string]interface{} {
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "users/" + name,
+		Storage:   s,
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if resp == nil {
+		return nil
+	}
+	return resp.Data
+}
+
+func TestUsers_SeveralDevices(t *testing.T) {
+	b, storage := getBackend(t)
+	configureBackend(t, b, storage)
+	createRole(t, b, storage, "my-role", "c,d")
+
+	primary, err := newVirtualKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup, err := newVirtualKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerUserDevice(t, b, storage, primary, "alice-primary", "my-role", "alice")
+	registerUserDevice(t, b, storage, backup, "alice-backup", "my-role", "alice")
+
+	if keys := signRequest(t, b, storage, "alice").RegisteredKeys; len(keys) != 2 {
+		t.Fatalf("bad: registered keys: %#v", keys)
+	}
+	for device, vk := range map[string]*virtualKey{"alice-primary": primary, "alice-backup": backup} {
+		resp, err := login(t, b, storage, vk, "alice")
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v", err, resp)
+		}
+		if resp.Auth.Alias.Name != "u2f_alice" || resp.Auth.Metadata["user_name"] != "alice" || resp.Auth.Metadata["device_name"] != device {
+			t.Fatalf("bad: auth: %#v", resp.Auth)
+		}
+	}
+
+	// A device cannot change owner through registration
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "registerRequest/alice-backup",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"role_name": "my-role",
+			"user_name": "bob",
+		},
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err == nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected registration for another user to be refused, got err:%v resp:%#v", err, resp)
+	}
+
+	req = &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      "users/",
+		Storage:   storage,
+	}
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if keys := resp.Data["keys"].([]string); !reflect.DeepEqual(keys, []string{"alice"}) {
+		t.Fatalf("bad: users: %v", keys)
+	}
+	if devices := readUser(t, b, storage, "alice")["devices"].(map[string]interface{}); len(devices) != 2 {
+		t.Fatalf("bad: devices: %#v", devices)
+	}
+
+	req = &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "devices/alice-backup",
+		Storage:   storage,
+	}
+	if resp, err := b.HandleRequest(context.Background(), req); err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	devices := readUser(t, b, storage, "alice")["devices"].(map[string]interface{})
+	if _, ok := devices["alice-primary"]; !ok || len(devices) != 1 {
+		t.Fatalf("bad: devices after delete: %#v", devices)
+	}
+
+	req = &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "users/alice",
+		Storage:   storage,
+	}
+	if resp, err := b.HandleRequest(context.Background(), req); err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if keys, err := storage.List(context.Background(), "devices/"); err != nil || len(keys) != 0 {
+		t.Fatalf("bad: devices after user delete: %v, err:%v", keys, err)
+	}
+}
+
+// makeLegacyDevice turns the device into one registered before users were
+// introduced.
+func makeLegacyDevice(t *testing.T, b logical.Backend, s logical.Storage, name string) {
+	dEntry, err := b.(*backend).device(context.Background(), s, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dEntry.UserName = ""
+	if err := b.(*backend).setDevice(context.Background(), s, name, dEntry); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(context.Background(), "users/"+name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUsers_MigrateDevices(t *testing.T) {
+	b, storage, vk := setupDevice(t, "legacy")
+	makeLegacyDevice(t, b, storage, "legacy")
+
+	carol, err := newVirtualKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerDevice(t, b, storage, carol, "carol", "my-role")
+	makeLegacyDevice(t, b, storage, "carol")
+
+	// Not migrated yet, the device is its own user
+	resp, err := login(t, b, storage, vk, "legacy")
+	if err != nil || (resp != nil && resp.IsError()) || resp.Auth.Alias.Name != "u2f_legacy" {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	// A backup key for a legacy device adopts it into a new user
+	backup, err := newVirtualKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerUserDevice(t, b, storage, backup, "carol-backup", "my-role", "carol")
+	if devices := readUser(t, b, storage, "carol")["devices"].(map[string]interface{}); len(devices) != 2 {
+		t.Fatalf("bad: carol devices: %#v", devices)
+	}
+
+	if err := b.Initialize(context.Background(), &logical.InitializationRequest{Storage: storage}); err != nil {
+		t.Fatal(err)
+	}
+	devices := readUser(t, b, storage, "legacy")["devices"].(map[string]interface{})
+	if _, ok := devices["legacy"]; !ok || len(devices) != 1 {
+		t.Fatalf("bad: legacy devices: %#v", devices)
+	}
+
+	resp, err = login(t, b, storage, vk, "legacy")
+	if err != nil || (resp != nil && resp.IsError()) || resp.Auth.Alias.Name != "u2f_legacy" {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	resp, err = login(t, b, storage, carol, "carol")
+	if err != nil || (resp != nil && resp.IsError()) || resp.Auth.Alias.Name != "u2f_carol" {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+}
+
+func TestUsers_DeleteWaitsForDevices(t *testing.T) {
+	b, storage := getBackend(t)
+	configureBackend(t, b, storage)
+	createRole(t, b, storage, "my-role", "c,d")
+
+	vk, err := newVirtualKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerUserDevice(t, b, storage, vk, "alice-primary", "my-role", "alice")
+
+	// A login holding the device must finish before the user is deleted
+	unlock := b.(*backend).lockKeys(deviceLockKey("alice-primary"))
+	done := make(chan error)
+	go func() {
+		_, err := handle(b, &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "users/alice",
+			Storage:   storage,
+		})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		unlock()
+		t.Fatalf("expected the delete to wait for the device lock, err:%v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if dEntry, err := b.(*backend).device(context.Background(), storage, "alice-primary"); err != nil || dEntry == nil {
+		t.Fatalf("expected the device to survive while it is locked, err:%v", err)
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	dEntry, err := b.(*backend).device(context.Background(), storage, "alice-primary")
+	if err != nil || dEntry != nil || readUser(t, b, storage, "alice") != nil {
+		t.Fatalf("expected the user and its devices to be deleted, err:%v", err)
+	}
+}
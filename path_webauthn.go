@@ -0,0 +1,838 @@
+package u2fauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/ryankurte/go-u2f"
+)
+
+// The WebAuthn options are serialized as in the JSON form of the WebAuthn
+// Level 3 specification: binary fields are base64url encoded strings.
+
+type publicKeyCredentialRPEntity struct {
+	ID string `json:"id"`
+
+	Name string `json:"name"`
+}
+
+type publicKeyCredentialUserEntity struct {
+	ID string `json:"id"`
+
+	Name string `json:"name"`
+
+	DisplayName string `json:"displayName"`
+}
+
+type publicKeyCredentialParameters struct {
+	Type string `json:"type"`
+
+	Alg int `json:"alg"`
+}
+
+type publicKeyCredentialDescriptor struct {
+	Type string `json:"type"`
+
+	ID string `json:"id"`
+}
+
+type authenticatorSelectionCriteria struct {
+	UserVerification string `json:"userVerification,omitempty"`
+}
+
+type publicKeyCredentialCreationOptions struct {
+	RP publicKeyCredentialRPEntity `json:"rp"`
+
+	User publicKeyCredentialUserEntity `json:"user"`
+
+	Challenge string `json:"challenge"`
+
+	PubKeyCredParams []publicKeyCredentialParameters `json:"pubKeyCredParams"`
+
+	Timeout int64 `json:"timeout,omitempty"`
+
+	ExcludeCredentials []publicKeyCredentialDescriptor `json:"excludeCredentials"`
+
+	AuthenticatorSelection authenticatorSelectionCriteria `json:"authenticatorSelection"`
+
+	Attestation string `json:"attestation,omitempty"`
+
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+type publicKeyCredentialRequestOptions struct {
+	Challenge string `json:"challenge"`
+
+	Timeout int64 `json:"timeout,omitempty"`
+
+	RPID string `json:"rpId"`
+
+	AllowCredentials []publicKeyCredentialDescriptor `json:"allowCredentials"`
+
+	UserVerification string `json:"userVerification,omitempty"`
+
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// webauthnCreationMessage is returned by registerBegin, the options are
+// passed as is to navigator.credentials.create().
+type webauthnCreationMessage struct {
+	PublicKey publicKeyCredentialCreationOptions `json:"publicKey"`
+
+	ChallengeID string `json:"challengeId"`
+}
+
+// webauthnRequestMessage is returned by loginBegin, the options are passed
+// as is to navigator.credentials.get().
+type webauthnRequestMessage struct {
+	PublicKey publicKeyCredentialRequestOptions `json:"publicKey"`
+
+	ChallengeID string `json:"challengeId"`
+}
+
+func pathWebAuthnRegisterBegin(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "webauthn/registerBegin/" + framework.GenericNameRegex("name"),
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.WebAuthnRegisterBegin,
+				Summary:  "Returns the options to create a WebAuthn credential",
+			},
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Device name.",
+			},
+			"role_name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Role assigned to the device.",
+			},
+			"user_name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "User owning the device. Defaults to the device name.",
+			},
+		},
+
+		HelpSynopsis:    pathWebAuthnHelpSyn,
+		HelpDescription: pathWebAuthnHelpDesc,
+	}
+}
+
+func pathWebAuthnRegisterFinish(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "webauthn/registerFinish/" + framework.GenericNameRegex("name"),
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.WebAuthnRegisterFinish,
+				Summary:  "Registers a WebAuthn credential",
+			},
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Device name.",
+			},
+			"challengeId": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "ID of the challenge returned by registerBegin.",
+			},
+			"id": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "base64url encoded credential ID.",
+			},
+			"clientDataJSON": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "base64url encoded clientDataJSON of the credential.",
+			},
+			"attestationObject": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "base64url encoded attestationObject of the credential.",
+			},
+		},
+
+		HelpSynopsis:    pathWebAuthnHelpSyn,
+		HelpDescription: pathWebAuthnHelpDesc,
+	}
+}
+
+func pathWebAuthnLoginBegin(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "webauthn/loginBegin/" + framework.GenericNameRegex("name"),
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.rateLimited("webauthn/loginBegin", b.WebAuthnLoginBegin),
+				Summary:  "Returns the options to authenticate with a WebAuthn credential",
+			},
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "User name.",
+			},
+		},
+
+		HelpSynopsis:    pathWebAuthnHelpSyn,
+		HelpDescription: pathWebAuthnHelpDesc,
+	}
+}
+
+func pathWebAuthnLoginFinish(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "webauthn/loginFinish/" + framework.GenericNameRegex("name"),
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.rateLimited("webauthn/loginFinish", b.WebAuthnLoginFinish),
+				Summary:  "Authenticates with a WebAuthn assertion",
+			},
+		},
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "User name.",
+			},
+			"challengeId": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "ID of the challenge returned by loginBegin.",
+			},
+			"id": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "base64url encoded credential ID.",
+			},
+			"clientDataJSON": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "base64url encoded clientDataJSON of the assertion.",
+			},
+			"authenticatorData": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "base64url encoded authenticatorData of the assertion.",
+			},
+			"signature": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "base64url encoded signature of the assertion.",
+			},
+			"userHandle": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "base64url encoded userHandle of the assertion, if any.",
+			},
+		},
+
+		HelpSynopsis:    pathWebAuthnHelpSyn,
+		HelpDescription: pathWebAuthnHelpDesc,
+	}
+}
+
+func (b *backend) WebAuthnRegisterBegin(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(d.Get("name").(string))
+	roleName := strings.ToLower(d.Get("role_name").(string))
+	userName := strings.ToLower(d.Get("user_name").(string))
+
+	if name == "" {
+		return nil, fmt.Errorf("missing device name")
+	}
+	if roleName == "" {
+		return nil, fmt.Errorf("missing device role name")
+	}
+
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return logical.ErrorResponse("u2f backend has not been configured"), nil
+	}
+
+	roleEntry, err := b.role(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, err
+	}
+	if roleEntry == nil {
+		return nil, fmt.Errorf("Specified role name not found")
+	}
+
+	dEntry, err := b.device(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	userName, err = deviceUserName(dEntry, name, userName)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
+	// Exclude the keys of every device of the user, so the same
+	// authenticator is not registered twice
+	devices, err := b.userDevices(ctx, req.Storage, userName)
+	if err != nil {
+		return nil, err
+	}
+	if dEntry != nil && dEntry.UserName == "" && userName != name {
+		devices = append(devices, dEntry)
+	}
+
+	var userHandle []byte
+	var extensions map[string]interface{}
+	exclude := []publicKeyCredentialDescriptor{}
+	if dEntry != nil {
+		userHandle = dEntry.UserHandle
+	}
+	for _, device := range devices {
+		for _, cred := range device.Credentials {
+			exclude = append(exclude, publicKeyCredentialDescriptor{Type: "public-key", ID: cred.ID})
+		}
+		// u2f registrations are only recognized under their app ID
+		for _, reg := range device.Registration {
+			exclude = append(exclude, publicKeyCredentialDescriptor{Type: "public-key", ID: reg.KeyHandle})
+		}
+		if len(device.Registration) > 0 {
+			extensions = map[string]interface{}{"appidExclude": config.AppID}
+		}
+	}
+	if len(userHandle) == 0 {
+		userHandle = make([]byte, 32)
+		if _, err := rand.Read(userHandle); err != nil {
+			return nil, err
+		}
+	}
+
+	c, err := u2f.NewChallenge(config.AppID, config.TrustedFacets, nil)
+	if err != nil {
+		return nil, err
+	}
+	cEntry := &ChallengeEntry{
+		Type:       challengeTypeWebAuthnRegister,
+		DeviceName: name,
+		RoleName:   roleName,
+		UserName:   userName,
+		UserHandle: userHandle,
+		Challenge:  c,
+	}
+	if err := b.issueChallenge(ctx, req.Storage, config, cEntry); err != nil {
+		return nil, err
+	}
+
+	return webauthnResponse(webauthnCreationMessage{
+		PublicKey: publicKeyCredentialCreationOptions{
+			RP: publicKeyCredentialRPEntity{
+				ID:   config.rpID(),
+				Name: config.rpID(),
+			},
+			User: publicKeyCredentialUserEntity{
+				ID:          base64.RawURLEncoding.EncodeToString(userHandle),
+				Name:        userName,
+				DisplayName: userName,
+			},
+			Challenge: base64.RawURLEncoding.EncodeToString(c.Challenge),
+			PubKeyCredParams: []publicKeyCredentialParameters{
+				{Type: "public-key", Alg: coseAlgES256},
+				{Type: "public-key", Alg: coseAlgRS256},
+			},
+			Timeout:            config.challengeTTL().Milliseconds(),
+			ExcludeCredentials: exclude,
+			AuthenticatorSelection: authenticatorSelectionCriteria{
+				UserVerification: roleEntry.userVerification(),
+			},
+			Attestation: "direct",
+			Extensions:  extensions,
+		},
+		ChallengeID: cEntry.ID,
+	})
+}
+
+func (b *backend) WebAuthnRegisterFinish(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(d.Get("name").(string))
+	if name == "" {
+		return nil, fmt.Errorf("missing device name")
+	}
+
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return logical.ErrorResponse("u2f backend has not been configured"), nil
+	}
+
+	cEntry, err := b.consumeChallenge(ctx, req.Storage, d.Get("challengeId").(string), challengeTypeWebAuthnRegister, name)
+	switch {
+	case err == errChallengeNotFound || err == errChallengeExpired:
+		b.Logger().Error("WebAuthnRegisterFinish", "device", name, "error", err)
+		return logical.ErrorResponse(err.Error()), nil
+	case err != nil:
+		return nil, err
+	}
+
+	roleEntry, err := b.role(ctx, req.Storage, cEntry.RoleName)
+	if err != nil {
+		return nil, err
+	}
+	if roleEntry == nil {
+		return nil, fmt.Errorf("Specified role name not found")
+	}
+
+	clientDataJSON, err := decodeBase64URL(d.Get("clientDataJSON").(string))
+	if err != nil {
+		return logical.ErrorResponse("invalid clientDataJSON encoding"), logical.ErrInvalidRequest
+	}
+	rawAttestation, err := decodeBase64URL(d.Get("attestationObject").(string))
+	if err != nil {
+		return logical.ErrorResponse("invalid attestationObject encoding"), logical.ErrInvalidRequest
+	}
+
+	if err := verifyClientData(clientDataJSON, webauthnTypeCreate, cEntry.Challenge.Challenge, config.webauthnOrigins()); err != nil {
+		b.Logger().Error("WebAuthnRegisterFinish", "device", name, "error", err)
+		return logical.ErrorResponse("Registration failed: " + err.Error()), nil
+	}
+
+	var obj attestationObject
+	if err := cbor.Unmarshal(rawAttestation, &obj); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("invalid attestationObject: %v", err)), logical.ErrInvalidRequest
+	}
+	authData, err := parseAuthenticatorData(obj.AuthData)
+	if err == nil && authData.CredentialID == nil {
+		err = fmt.Errorf("authenticator data does not contain a credential")
+	}
+	if err == nil {
+		err = authData.verify(config.rpID(), "", roleEntry.userVerification() == userVerificationRequired)
+	}
+	if err != nil {
+		b.Logger().Error("WebAuthnRegisterFinish", "device", name, "error", err)
+		return logical.ErrorResponse("Registration failed: " + err.Error()), nil
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	cert, intermediates, err := verifyAttestationStatement(&obj, authData, clientDataHash[:])
+	if err != nil {
+		b.Logger().Error("WebAuthnRegisterFinish", "device", name, "error", err)
+		return logical.ErrorResponse("Registration failed: " + err.Error()), nil
+	}
+
+	cred := WebAuthnCredential{
+		ID:                base64.RawURLEncoding.EncodeToString(authData.CredentialID),
+		PublicKey:         authData.CredentialPublicKey,
+		SignCount:         authData.SignCount,
+		AAGUID:            authData.aaguid(),
+		AttestationFormat: obj.Format,
+	}
+	if err := b.verifyAttestation(ctx, req.Storage, roleEntry, cert, intermediates, &cred.Attestation); err != nil {
+		b.Logger().Error("WebAuthnRegisterFinish", "device", name, "error", err)
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	// The AAGUID is reported by the authenticator itself, it only identifies
+	// it when the verified attestation certificate carries the same one
+	var aaguid string
+	if cred.AttestationVerified {
+		certAAGUID, err := certificateAAGUID(cert)
+		if err == nil && certAAGUID != nil && bytes.Equal(certAAGUID, authData.AAGUID) {
+			aaguid = cred.AAGUID
+		}
+	}
+	if err := b.checkAuthenticatorPolicy(ctx, req.Storage, roleEntry, &cred.Attestation, aaguid); err != nil {
+		b.Logger().Error("WebAuthnRegisterFinish", "device", name, "error", err)
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	var keys []string
+	if cEntry.UserName != "" {
+		keys = append(keys, userLockKey(cEntry.UserName))
+	}
+	dEntry, unlock, err := b.lockDevice(ctx, req.Storage, name, keys...)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if dEntry == nil {
+		b.Logger().Info("WebAuthnRegisterFinish", "Creating new registration for device", name)
+		dEntry = &DeviceData{Name: name}
+	}
+	pub, err := credentialPublicKey(&cred)
+	if err != nil {
+		return nil, err
+	}
+	claim, owner, err := b.claimKey(ctx, req.Storage, name, cred.ID, pub)
+	if err != nil {
+		return nil, err
+	}
+	if owner != nil {
+		return b.duplicateKeyResponse(owner, cred.ID, true), nil
+	}
+	defer claim.release(ctx, req.Storage)
+	if len(dEntry.UserHandle) == 0 {
+		dEntry.UserHandle = cEntry.UserHandle
+	}
+	dEntry.RoleName = cEntry.RoleName
+	cred.enrolled(req)
+	dEntry.Credentials = append(dEntry.Credentials, cred)
+
+	userName, err := deviceUserName(dEntry, name, cEntry.UserName)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err := b.addUserDevice(ctx, req.Storage, userName, dEntry); err != nil {
+		return nil, err
+	}
+
+	if err := b.setDevice(ctx, req.Storage, name, dEntry); err != nil {
+		return nil, err
+	}
+	claim.keep()
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			logical.HTTPContentType: "application/json",
+			logical.HTTPRawBody:     `{"ok":true}`,
+			logical.HTTPStatusCode:  200,
+		},
+	}, nil
+}
+
+func (b *backend) WebAuthnLoginBegin(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(d.Get("name").(string))
+	if name == "" {
+		return nil, fmt.Errorf("missing device name")
+	}
+
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return logical.ErrorResponse("u2f backend has not been configured"), nil
+	}
+
+	devices, err := b.userDevices(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	var extensions map[string]interface{}
+	var userVerification string
+	allow := []publicKeyCredentialDescriptor{}
+	for _, dEntry := range devices {
+		roleEntry, err := b.role(ctx, req.Storage, dEntry.RoleName)
+		if err != nil {
+			return nil, err
+		}
+		if roleEntry != nil {
+			userVerification = strongerUserVerification(userVerification, roleEntry.userVerification())
+		}
+
+		for _, cred := range dEntry.activeCredentials() {
+			allow = append(allow, publicKeyCredentialDescriptor{Type: "public-key", ID: cred.ID})
+			if cred.AppID != "" {
+				extensions = map[string]interface{}{"appid": cred.AppID}
+			}
+		}
+		// u2f registrations sign with their app ID as RP ID, which the
+		// client only uses when asked to through the appid extension
+		for _, reg := range dEntry.activeRegistrations() {
+			allow = append(allow, publicKeyCredentialDescriptor{Type: "public-key", ID: reg.KeyHandle})
+			extensions = map[string]interface{}{"appid": config.AppID}
+		}
+	}
+	if len(allow) == 0 {
+		if !config.HideUnknownNames {
+			return nil, fmt.Errorf("Wrong device name or device not registered")
+		}
+		// The fake key handles look like u2f registrations
+		registrations, err := b.decoyRegistrations(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, reg := range registrations {
+			allow = append(allow, publicKeyCredentialDescriptor{Type: "public-key", ID: reg.KeyHandle})
+		}
+		extensions = map[string]interface{}{"appid": config.AppID}
+	}
+	if userVerification == "" {
+		userVerification = userVerificationPreferred
+	}
+
+	c, err := u2f.NewChallenge(config.AppID, config.TrustedFacets, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var challengeID string
+	if config.StatelessChallenges {
+		challengeID, err = b.signChallenge(ctx, req.Storage, config, challengeTypeWebAuthnLogin, name, c)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		cEntry := &ChallengeEntry{
+			Type:       challengeTypeWebAuthnLogin,
+			DeviceName: name,
+			Challenge:  c,
+		}
+		if err := b.issueChallenge(ctx, req.Storage, config, cEntry); err != nil {
+			return nil, err
+		}
+		challengeID = cEntry.ID
+	}
+
+	return webauthnResponse(webauthnRequestMessage{
+		PublicKey: publicKeyCredentialRequestOptions{
+			Challenge:        base64.RawURLEncoding.EncodeToString(c.Challenge),
+			Timeout:          config.challengeTTL().Milliseconds(),
+			RPID:             config.rpID(),
+			AllowCredentials: allow,
+			UserVerification: userVerification,
+			Extensions:       extensions,
+		},
+		ChallengeID: challengeID,
+	})
+}
+
+func (b *backend) WebAuthnLoginFinish(
+	ctx context.Context,
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := strings.ToLower(d.Get("name").(string))
+	if name == "" {
+		return nil, fmt.Errorf("missing device name")
+	}
+
+	config, err := b.config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return logical.ErrorResponse("u2f backend has not been configured"), nil
+	}
+
+	var cEntry *ChallengeEntry
+	challengeID := d.Get("challengeId").(string)
+	if config.StatelessChallenges && strings.Contains(challengeID, ".") {
+		cEntry, err = b.verifySignedChallenge(ctx, req.Storage, config, challengeID, challengeTypeWebAuthnLogin, name)
+	} else {
+		cEntry, err = b.consumeChallenge(ctx, req.Storage, challengeID, challengeTypeWebAuthnLogin, name)
+	}
+	switch {
+	case err == errChallengeNotFound || err == errChallengeExpired:
+		b.Logger().Error("WebAuthnLoginFinish", "device", name, "error", err)
+		return logical.ErrorResponse(err.Error()), nil
+	case err != nil:
+		return nil, err
+	}
+
+	unlock := b.lockKeys(userLockKey(name))
+	defer unlock()
+
+	devices, err := b.userDevices(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if config.HideUnknownNames && !hasActiveKeys(devices) {
+		return b.decoyWebAuthnAuthenticate(ctx, req, config, name, cEntry, d)
+	}
+	if len(devices) == 0 {
+		b.Logger().Error("WebAuthnLoginFinish", "Device not registered:", name)
+		return logical.ErrorResponse("Device not registered"), nil
+	}
+
+	credID := strings.TrimRight(d.Get("id").(string), "=")
+	dEntry := deviceWithKey(devices, credID)
+	if dEntry == nil {
+		b.Logger().Error("WebAuthnLoginFinish", "user", name, "error", "unknown credential")
+		return logical.ErrorResponse("Authentication failed: unknown credential"), nil
+	}
+	deviceName := dEntry.Name
+	if dEntry.Disabled {
+		b.Logger().Error("WebAuthnLoginFinish", "device", deviceName, "error", errDeviceDisabled)
+		return logical.ErrorResponse(errDeviceDisabled.Error()), nil
+	}
+
+	roleEntry, err := b.role(ctx, req.Storage, dEntry.RoleName)
+	if err != nil {
+		return nil, err
+	}
+	if roleEntry == nil {
+		b.Logger().Error("WebAuthnLoginFinish", "device", deviceName, "error", "role not found", "role", dEntry.RoleName)
+		return logical.ErrorResponse("Specified role name not found"), nil
+	}
+
+	cred := dEntry.credential(credID)
+
+	// A u2f registration is verified as a credential scoped to the app ID
+	var regEntry *RegistrationEntry
+	if cred == nil {
+		regEntry = dEntry.registration(credID)
+		cred, err = legacyCredential(regEntry, config.AppID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cred.Quarantined {
+		b.Logger().Error("WebAuthnLoginFinish", "device", deviceName, "credential", credID, "error", errKeyQuarantined)
+		return logical.ErrorResponse(errKeyQuarantined.Error()), nil
+	}
+	if cred.Disabled {
+		b.Logger().Error("WebAuthnLoginFinish", "device", deviceName, "credential", credID, "error", errKeyDisabled)
+		return logical.ErrorResponse(errKeyDisabled.Error()), nil
+	}
+	if cred.retired(time.Now()) {
+		b.Logger().Error("WebAuthnLoginFinish", "device", deviceName, "credential", credID, "error", errKeyReplaced)
+		return logical.ErrorResponse(errKeyReplaced.Error()), nil
+	}
+	lockedOut := dEntry.lockedOut(credID)
+	if lockedOut {
+		b.Logger().Error("WebAuthnLoginFinish", "device", deviceName, "credential", credID, "error", errLockedOut)
+		if !config.HideUnknownNames {
+			return logical.ErrorResponse(errLockedOut.Error()), nil
+		}
+	}
+
+	clientDataJSON, rawAuthData, signature, userHandle, errResp := decodeAssertion(d)
+	if errResp != nil {
+		return errResp, logical.ErrInvalidRequest
+	}
+
+	err = verifyClientData(clientDataJSON, webauthnTypeGet, cEntry.Challenge.Challenge, config.webauthnOrigins())
+	var authData *authenticatorData
+	if err == nil {
+		authData, err = parseAuthenticatorData(rawAuthData)
+	}
+	if err == nil {
+		err = authData.verify(config.rpID(), cred.AppID, roleEntry.userVerification() == userVerificationRequired)
+	}
+	if err == nil && len(userHandle) > 0 && string(userHandle) != string(dEntry.UserHandle) {
+		err = fmt.Errorf("user handle does not match the device")
+	}
+	if err == nil {
+		err = verifyAssertion(cred, rawAuthData, clientDataJSON, signature)
+	}
+	if lockedOut {
+		// Decoys are never locked out, so a locked out key fails like a
+		// wrong signature after the same work when names are hidden
+		if err == nil {
+			err = errWebAuthnVerification
+		}
+		return logical.ErrorResponse("Authentication failed: " + err.Error()), nil
+	}
+	if err != nil {
+		b.Logger().Error("WebAuthnLoginFinish", "device", deviceName, "error", err)
+		if dEntry.loginFailed(lockoutPolicyFor(config, roleEntry), credID) {
+			b.Logger().Warn("WebAuthnLoginFinish", "device", deviceName, "credential", credID, "failed logins", dEntry.FailedLogins, "locked until", dEntry.LockedUntil)
+			if serr := b.setDevice(ctx, req.Storage, deviceName, dEntry); serr != nil {
+				return nil, serr
+			}
+		}
+		return logical.ErrorResponse("Authentication failed: " + err.Error()), nil
+	}
+
+	if err := b.checkCounter(config, deviceName, cred.ID, uint(cred.SignCount), uint(authData.SignCount)); err != nil {
+		cred.quarantine()
+		if regEntry != nil {
+			regEntry.quarantine()
+		}
+		if serr := b.setDevice(ctx, req.Storage, deviceName, dEntry); serr != nil {
+			return nil, serr
+		}
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if authData.SignCount > cred.SignCount {
+		cred.SignCount = authData.SignCount
+	}
+	cred.used(req)
+	dEntry.LastUsedAt = time.Now()
+	if regEntry != nil {
+		if config.UpgradeU2FRegistrations {
+			b.Logger().Info("WebAuthnLoginFinish", "device", deviceName, "upgraded u2f registration", regEntry.KeyHandle)
+			dEntry.upgradeRegistration(cred)
+		} else {
+			regEntry.Counter = uint(cred.SignCount)
+			regEntry.KeyUsage = cred.KeyUsage
+		}
+	}
+	dEntry.loginSucceeded(credID)
+
+	if err := b.setDevice(ctx, req.Storage, deviceName, dEntry); err != nil {
+		return nil, err
+	}
+
+	alias, err := b.aliasName(ctx, req.Storage, config, name)
+	if err != nil {
+		return nil, err
+	}
+	return loginResponse(name, alias, dEntry, roleEntry, authData.Flags&authDataFlagUserVerified != 0), nil
+}
+
+// decodeAssertion decodes the fields of an assertion. A non-nil response
+// tells which one is invalid.
+func decodeAssertion(d *framework.FieldData) (clientDataJSON, rawAuthData, signature, userHandle []byte, errResp *logical.Response) {
+	var err error
+	if clientDataJSON, err = decodeBase64URL(d.Get("clientDataJSON").(string)); err != nil {
+		return nil, nil, nil, nil, logical.ErrorResponse("invalid clientDataJSON encoding")
+	}
+	if rawAuthData, err = decodeBase64URL(d.Get("authenticatorData").(string)); err != nil {
+		return nil, nil, nil, nil, logical.ErrorResponse("invalid authenticatorData encoding")
+	}
+	if signature, err = decodeBase64URL(d.Get("signature").(string)); err != nil {
+		return nil, nil, nil, nil, logical.ErrorResponse("invalid signature encoding")
+	}
+	if userHandle, err = decodeBase64URL(d.Get("userHandle").(string)); err != nil {
+		return nil, nil, nil, nil, logical.ErrorResponse("invalid userHandle encoding")
+	}
+	return clientDataJSON, rawAuthData, signature, userHandle, nil
+}
+
+// verifyAssertion checks the assertion signature over the authenticator data
+// and the hash of clientDataJSON with the stored credential key.
+func verifyAssertion(cred *WebAuthnCredential, rawAuthData, clientDataJSON, signature []byte) error {
+	pub, alg, err := parseCOSEKey(cred.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	return verifySignature(pub, alg, signed, signature)
+}
+
+func webauthnResponse(message interface{}) (*logical.Response, error) {
+	mJSON, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			logical.HTTPContentType: "application/json",
+			logical.HTTPRawBody:     string(mJSON),
+			logical.HTTPStatusCode:  200,
+		},
+	}, nil
+}
+
+const pathWebAuthnHelpSyn = `
+Register and authenticate devices with WebAuthn
+`
+
+const pathWebAuthnHelpDesc = `
+These endpoints implement the WebAuthn ceremonies next to the legacy u2f
+ones. "webauthn/registerBegin" returns PublicKeyCredentialCreationOptions
+for navigator.credentials.create(), and "webauthn/registerFinish" verifies
+the resulting attestation object and stores the credential with the device.
+"webauthn/loginBegin" returns PublicKeyCredentialRequestOptions for
+navigator.credentials.get(), and "webauthn/loginFinish" verifies the
+assertion and issues a token through the role of the device.
+
+The relying party ID is the host of "app_id". Responses are accepted from the
+origin of "app_id" and from the web origins among the trusted facets. The
+none, packed and fido-u2f attestation formats are supported, with ES256 and
+RS256 credential keys.
+`
@@ -0,0 +1,669 @@
+package u2fauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const webauthnOrigin = "https://localhost"
+
+func webauthnRegisterBegin(t *testing.T, b logical.Backend, s logical.Storage, name, roleName string) *webauthnCreationMessage {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "webauthn/registerBegin/" + name,
+		Storage:   s,
+		Data: map[string]interface{}{
+			"role_name": roleName,
+		},
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	var message webauthnCreationMessage
+	if err := json.Unmarshal([]byte(resp.Data[logical.HTTPRawBody].(string)), &message); err != nil {
+		t.Fatal(err)
+	}
+	return &message
+}
+
+func webauthnRegisterFinish(b logical.Backend, s logical.Storage, name, challengeID string, cred *webauthnAttestationResponse) (*logical.Response, error) {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "webauthn/registerFinish/" + name,
+		Storage:   s,
+		Data: map[string]interface{}{
+			"challengeId":       challengeID,
+			"id":                cred.ID,
+			"clientDataJSON":    cred.ClientDataJSON,
+			"attestationObject": cred.AttestationObject,
+		},
+	}
+	return b.HandleRequest(context.Background(), req)
+}
+
+func tryWebAuthnRegister(t *testing.T, b logical.Backend, s logical.Storage, va *virtualAuthenticator, name, roleName string) (*logical.Response, error) {
+	message := webauthnRegisterBegin(t, b, s, name, roleName)
+	cred, err := va.create(webauthnOrigin, message.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return webauthnRegisterFinish(b, s, name, message.ChallengeID, cred)
+}
+
+func webauthnRegister(t *testing.T, b logical.Backend, s logical.Storage, va *virtualAuthenticator, name, roleName string) {
+	resp, err := tryWebAuthnRegister(t, b, s, va, name, roleName)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+}
+
+func webauthnLoginBegin(t *testing.T, b logical.Backend, s logical.Storage, name string) *webauthnRequestMessage {
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "webauthn/loginBegin/" + name,
+		Storage:   s,
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	var message webauthnRequestMessage
+	if err := json.Unmarshal([]byte(resp.Data[logical.HTTPRawBody].(string)), &message); err != nil {
+		t.Fatal(err)
+	}
+	return &message
+}
+
+func webauthnLoginFinish(b logical.Backend, s logical.Storage, name, challengeID string, assertion *webauthnAssertionResponse) (*logical.Response, error) {
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "webauthn/loginFinish/" + name,
+		Storage:   s,
+		Data: map[string]interface{}{
+			"challengeId":       challengeID,
+			"id":                assertion.ID,
+			"clientDataJSON":    assertion.ClientDataJSON,
+			"authenticatorData": assertion.AuthenticatorData,
+			"signature":         assertion.Signature,
+			"userHandle":        assertion.UserHandle,
+		},
+	}
+	return b.HandleRequest(context.Background(), req)
+}
+
+func webauthnLogin(t *testing.T, b logical.Backend, s logical.Storage, va *virtualAuthenticator, name string) (*logical.Response, error) {
+	message := webauthnLoginBegin(t, b, s, name)
+	assertion, err := va.get(webauthnOrigin, message.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return webauthnLoginFinish(b, s, name, message.ChallengeID, assertion)
+}
+
+func TestWebAuthn_RegisterAndLogin(t *testing.T) {
+	b, storage := getBackend(t)
+	configureBackend(t, b, storage)
+	createRole(t, b, storage, "my-role", "c,d")
+
+	packed, err := newVirtualAuthenticator(attestationFormatPacked, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fidoU2F, err := newVirtualAuthenticator(attestationFormatFIDOU2F, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	none, err := newVirtualAuthenticator(attestationFormatNone, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	self, err := newSelfAttestingAuthenticator()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authenticators := map[string]*virtualAuthenticator{
+		"packed-device":   packed,
+		"fido-u2f-device": fidoU2F,
+		"none-device":     none,
+		"self-device":     self,
+	}
+	for name, va := range authenticators {
+		webauthnRegister(t, b, storage, va, name, "my-role")
+
+		for i := 0; i < 2; i++ {
+			resp, err := webauthnLogin(t, b, storage, va, name)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("%s: err:%v resp:%#v", name, err, resp)
+			}
+			if resp.Auth == nil || !reflect.DeepEqual(resp.Auth.Policies, []string{"c", "d"}) {
+				t.Fatalf("%s: bad: auth: %#v", name, resp.Auth)
+			}
+			if resp.Auth.Metadata["device_name"] != name || resp.Auth.Alias.Name != "u2f_"+name {
+				t.Fatalf("%s: bad: auth: %#v", name, resp.Auth)
+			}
+		}
+
+		dEntry, err := b.(*backend).device(context.Background(), storage, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(dEntry.Credentials) != 1 || dEntry.Credentials[0].SignCount != 2 {
+			t.Fatalf("%s: bad: credentials: %#v", name, dEntry.Credentials)
+		}
+		cred := dEntry.Credentials[0]
+		if cred.AttestationFormat != va.format || cred.AAGUID == "" {
+			t.Fatalf("%s: bad: credential: %#v", name, cred)
+		}
+		if (va.attestationCert != nil) != (cred.AttestationSubject != "") {
+			t.Fatalf("%s: bad: attestation: %#v", name, cred.Attestation)
+		}
+	}
+
+	// The same authenticator cannot register twice for a device
+	message := webauthnRegisterBegin(t, b, storage, "packed-device", "my-role")
+	if len(message.PublicKey.ExcludeCredentials) != 1 {
+		t.Fatalf("bad: excludeCredentials: %#v", message.PublicKey.ExcludeCredentials)
+	}
+	if _, err := packed.create(webauthnOrigin, message.PublicKey); err == nil {
+		t.Fatalf("expected excluded credential to be refused")
+	}
+}
+
+func TestWebAuthn_Replay(t *testing.T) {
+	b, storage := getBackend(t)
+	configureBackend(t, b, storage)
+	createRole(t, b, storage, "my-role", "c,d")
+
+	va, err := newVirtualAuthenticator(attestationFormatPacked, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webauthnRegister(t, b, storage, va, "my-device", "my-role")
+
+	message := webauthnLoginBegin(t, b, storage, "my-device")
+	assertion, err := va.get(webauthnOrigin, message.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := webauthnLoginFinish(b, storage, "my-device", message.ChallengeID, assertion)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	resp, err = webauthnLoginFinish(b, storage, "my-device", message.ChallengeID, assertion)
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected replay to be rejected, got err:%v resp:%#v", err, resp)
+	}
+
+	// A cloned authenticator replaying an old counter is quarantined
+	message = webauthnLoginBegin(t, b, storage, "my-device")
+	va.credentials[0].signCount = 0
+	assertion, err = va.get(webauthnOrigin, message.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = webauthnLoginFinish(b, storage, "my-device", message.ChallengeID, assertion)
+	if err != nil || resp == nil || !resp.IsError() || resp.Error().Error() != errCounterRegression.Error() {
+		t.Fatalf("expected counter regression, got err:%v resp:%#v", err, resp)
+	}
+}
+
+func TestWebAuthn_Verification(t *testing.T) {
+	b, storage := getBackend(t)
+	configureBackend(t, b, storage)
+	createRole(t, b, storage, "my-role", "c,d")
+
+	va, err := newVirtualAuthenticator(attestationFormatPacked, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Registration from an untrusted origin
+	message := webauthnRegisterBegin(t, b, storage, "my-device", "my-role")
+	cred, err := va.create("https://evil.example.com", message.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := webauthnRegisterFinish(b, storage, "my-device", message.ChallengeID, cred)
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected untrusted origin to be refused, got err:%v resp:%#v", err, resp)
+	}
+
+	// Registration for another relying party
+	message = webauthnRegisterBegin(t, b, storage, "my-device", "my-role")
+	message.PublicKey.RP.ID = "evil.example.com"
+	cred, err = va.create(webauthnOrigin, message.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = webauthnRegisterFinish(b, storage, "my-device", message.ChallengeID, cred)
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected other relying party to be refused, got err:%v resp:%#v", err, resp)
+	}
+
+	webauthnRegister(t, b, storage, va, "my-device", "my-role")
+
+	// Assertion signed by another key
+	other, err := newVirtualAuthenticator(attestationFormatPacked, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webauthnRegister(t, b, storage, other, "other-device", "my-role")
+
+	message2 := webauthnLoginBegin(t, b, storage, "my-device")
+	assertion, err := va.get(webauthnOrigin, message2.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherMessage := webauthnLoginBegin(t, b, storage, "other-device")
+	otherAssertion, err := other.get(webauthnOrigin, otherMessage.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertion.Signature = otherAssertion.Signature
+	resp, err = webauthnLoginFinish(b, storage, "my-device", message2.ChallengeID, assertion)
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected bad signature to be refused, got err:%v resp:%#v", err, resp)
+	}
+
+	// Credential of another device
+	resp, err = webauthnLoginFinish(b, storage, "my-device", otherMessage.ChallengeID, otherAssertion)
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected challenge of another device to be refused, got err:%v resp:%#v", err, resp)
+	}
+}
+
+func TestWebAuthn_RequireAttestation(t *testing.T) {
+	b, storage := getBackend(t)
+	configureBackend(t, b, storage)
+	createRole(t, b, storage, "my-role", "c,d")
+
+	ca, caKey, err := newAttestationCA("Test WebAuthn Root CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config/attestation",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"trust_roots":         string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})),
+			"require_attestation": true,
+		},
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	trusted, err := newVirtualAuthenticator(attestationFormatPacked, ca, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webauthnRegister(t, b, storage, trusted, "trusted-device", "my-role")
+
+	dEntry, err := b.(*backend).device(context.Background(), storage, "trusted-device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dEntry.Credentials[0].AttestationVerified {
+		t.Fatalf("bad: credential: %#v", dEntry.Credentials[0])
+	}
+
+	none, err := newVirtualAuthenticator(attestationFormatNone, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = tryWebAuthnRegister(t, b, storage, none, "none-device", "my-role")
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected missing attestation to be refused, got err:%v resp:%#v", err, resp)
+	}
+
+	untrusted, err := newVirtualAuthenticator(attestationFormatFIDOU2F, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = tryWebAuthnRegister(t, b, storage, untrusted, "untrusted-device", "my-role")
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected untrusted attestation to be refused, got err:%v resp:%#v", err, resp)
+	}
+}
+
+func TestWebAuthn_StatelessLogin(t *testing.T) {
+	b, storage := getBackend(t)
+	configureBackend(t, b, storage)
+	createRole(t, b, storage, "my-role", "c,d")
+	enableStatelessChallenges(t, b, storage)
+
+	va, err := newVirtualAuthenticator(attestationFormatNone, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webauthnRegister(t, b, storage, va, "my-device", "my-role")
+
+	resp, err := webauthnLogin(t, b, storage, va, "my-device")
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	ids, err := storage.List(context.Background(), "challenges/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Fatalf("bad: stored challenges: %v", ids)
+	}
+}
+
+func legacyWebAuthnLogin(t *testing.T, b logical.Backend, s logical.Storage, vk *virtualKey, name string) (*logical.Response, error) {
+	message := webauthnLoginBegin(t, b, s, name)
+	if message.PublicKey.Extensions["appid"] != app_id {
+		t.Fatalf("bad: extensions: %#v", message.PublicKey.Extensions)
+	}
+	assertion, err := vk.getAssertion(webauthnOrigin, message.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return webauthnLoginFinish(b, s, name, message.ChallengeID, assertion)
+}
+
+func TestWebAuthn_LegacyU2FRegistration(t *testing.T) {
+	b, storage, vk := setupDevice(t, "my-device")
+
+	resp, err := legacyWebAuthnLogin(t, b, storage, vk, "my-device")
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if resp.Auth == nil || !reflect.DeepEqual(resp.Auth.Policies, []string{"c", "d"}) {
+		t.Fatalf("bad: auth: %#v", resp.Auth)
+	}
+
+	// The registration is left in place and keeps working with u2f
+	resp, err = login(t, b, storage, vk, "my-device")
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	dEntry, err := b.(*backend).device(context.Background(), storage, "my-device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dEntry.Registration) != 1 || dEntry.Registration[0].Counter != 2 || len(dEntry.Credentials) != 0 {
+		t.Fatalf("bad: device: %#v", dEntry)
+	}
+
+	// New credentials must not be created on the same key
+	message := webauthnRegisterBegin(t, b, storage, "my-device", "my-role")
+	if message.PublicKey.Extensions["appidExclude"] != app_id || len(message.PublicKey.ExcludeCredentials) != 1 {
+		t.Fatalf("bad: options: %#v", message.PublicKey)
+	}
+}
+
+func TestWebAuthn_UpgradeLegacyU2FRegistration(t *testing.T) {
+	b, storage, vk := setupDevice(t, "my-device")
+
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"upgrade_u2f_registrations": true,
+		},
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	for i := 0; i < 2; i++ {
+		resp, err = legacyWebAuthnLogin(t, b, storage, vk, "my-device")
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v", err, resp)
+		}
+	}
+
+	dEntry, err := b.(*backend).device(context.Background(), storage, "my-device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dEntry.Registration) != 0 || len(dEntry.Credentials) != 1 {
+		t.Fatalf("bad: device: %#v", dEntry)
+	}
+	cred := dEntry.Credentials[0]
+	if cred.AppID != app_id || cred.SignCount != 2 || cred.AttestationFormat != attestationFormatFIDOU2F || cred.AttestationSubject == "" {
+		t.Fatalf("bad: credential: %#v", cred)
+	}
+
+	// The upgraded key is no longer offered to the u2f endpoints
+	req = &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "signRequest/my-device",
+		Storage:   storage,
+	}
+	if _, err := b.HandleRequest(context.Background(), req); err == nil {
+		t.Fatalf("expected u2f sign request to fail")
+	}
+}
+
+func TestWebAuthn_UserVerification(t *testing.T) {
+	b, storage := getBackend(t)
+	configureBackend(t, b, storage)
+	createRole(t, b, storage, "uv-role", "c,d")
+	setUserVerification(t, b, storage, "uv-role", "required")
+
+	va, err := newVirtualAuthenticator(attestationFormatPacked, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := webauthnRegisterBegin(t, b, storage, "my-device", "uv-role")
+	if message.PublicKey.AuthenticatorSelection.UserVerification != userVerificationRequired {
+		t.Fatalf("bad: options: %#v", message.PublicKey)
+	}
+	cred, err := va.create(webauthnOrigin, message.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := webauthnRegisterFinish(b, storage, "my-device", message.ChallengeID, cred)
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected registration without user verification to be refused, got err:%v resp:%#v", err, resp)
+	}
+
+	va.userVerified = true
+	webauthnRegister(t, b, storage, va, "my-device", "uv-role")
+
+	loginMessage := webauthnLoginBegin(t, b, storage, "my-device")
+	if loginMessage.PublicKey.UserVerification != userVerificationRequired {
+		t.Fatalf("bad: options: %#v", loginMessage.PublicKey)
+	}
+	assertion, err := va.get(webauthnOrigin, loginMessage.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = webauthnLoginFinish(b, storage, "my-device", loginMessage.ChallengeID, assertion)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if resp.Auth.Metadata["user_verification"] != "required" || resp.Auth.Metadata["user_verified"] != "true" {
+		t.Fatalf("bad: metadata: %#v", resp.Auth.Metadata)
+	}
+
+	va.userVerified = false
+	resp, err = webauthnLogin(t, b, storage, va, "my-device")
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected login without user verification to be refused, got err:%v resp:%#v", err, resp)
+	}
+
+	// u2f devices only prove presence
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "registerRequest/u2f-device",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"role_name": "uv-role",
+		},
+	}
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected u2f registration to be refused, got err:%v resp:%#v", err, resp)
+	}
+}
+
+// webauthnImpostorLogin answers a WebAuthn login for the name with the first
+// offered key handle and a key of its own.
+func webauthnImpostorLogin(t *testing.T, b logical.Backend, s logical.Storage, name string) *logical.Response {
+	message := webauthnLoginBegin(t, b, s, name)
+	if len(message.PublicKey.AllowCredentials) == 0 {
+		t.Fatalf("bad: login options: %#v", message.PublicKey)
+	}
+	keyHandle, err := decodeWebSafe(message.PublicKey.AllowCredentials[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appID, _ := message.PublicKey.Extensions["appid"].(string)
+	impostor := &virtualKey{keys: []*virtualCredential{{
+		appID:     appID,
+		keyHandle: keyHandle,
+		private:   private,
+	}}}
+	assertion, err := impostor.getAssertion(webauthnOrigin, message.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := webauthnLoginFinish(b, s, name, message.ChallengeID, assertion)
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected the login to fail, got err:%v resp:%#v", err, resp)
+	}
+	return resp
+}
+
+func TestWebAuthn_HideUnknownNames(t *testing.T) {
+	b, storage, vk := setupDevice(t, "my-device")
+	writeConfig(t, b, storage, map[string]interface{}{
+		"hide_unknown_names": true,
+		"lockout_threshold":  2,
+		"lockout_duration":   "1h",
+	})
+
+	first := webauthnLoginBegin(t, b, storage, "nobody")
+	second := webauthnLoginBegin(t, b, storage, "nobody")
+	if !reflect.DeepEqual(first.PublicKey.AllowCredentials, second.PublicKey.AllowCredentials) {
+		t.Fatalf("bad: login options:\n%#v\n%#v", first.PublicKey, second.PublicKey)
+	}
+
+	unknown := webauthnImpostorLogin(t, b, storage, "nobody")
+	if known := webauthnImpostorLogin(t, b, storage, "my-device"); known.Data["error"] != unknown.Data["error"] {
+		t.Fatalf("expected the same error, got %q and %q", known.Data["error"], unknown.Data["error"])
+	}
+
+	// The locked out key fails like a wrong signature, even when it signs
+	webauthnImpostorLogin(t, b, storage, "my-device")
+	message := webauthnLoginBegin(t, b, storage, "my-device")
+	assertion, err := vk.getAssertion(webauthnOrigin, message.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := webauthnLoginFinish(b, storage, "my-device", message.ChallengeID, assertion)
+	if err != nil || resp == nil || resp.Data["error"] != unknown.Data["error"] {
+		t.Fatalf("expected %q, got err:%v resp:%#v", unknown.Data["error"], err, resp)
+	}
+}
+
+func TestWebAuthn_AllowedAuthenticators(t *testing.T) {
+	b, storage := getBackend(t)
+	configureBackend(t, b, storage)
+
+	ca, caKey, err := newAttestationCA("Test WebAuthn Root CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config/attestation",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"trust_roots": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})),
+		},
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	approved, err := newVirtualAuthenticator(attestationFormatPacked, ca, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := approved.certifyAAGUID(ca, caKey); err != nil {
+		t.Fatal(err)
+	}
+	aaguid, err := uuid.FormatUUID(approved.aaguid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "roles/approved-only",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"token_policies":         "c,d",
+			"allowed_authenticators": aaguid,
+		},
+	}
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	webauthnRegister(t, b, storage, approved, "approved-device", "approved-only")
+
+	// The others claim the approved AAGUID, but no trusted certificate
+	// vouches for it
+	none, err := newVirtualAuthenticator(attestationFormatNone, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	self, err := newSelfAttestingAuthenticator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	selfSigned, err := newVirtualAuthenticator(attestationFormatPacked, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(selfSigned.aaguid, approved.aaguid)
+	if err := selfSigned.certifyAAGUID(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	uncertified, err := newVirtualAuthenticator(attestationFormatPacked, ca, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, va := range map[string]*virtualAuthenticator{
+		"none-device":        none,
+		"self-device":        self,
+		"self-signed-device": selfSigned,
+		"uncertified-device": uncertified,
+	} {
+		copy(va.aaguid, approved.aaguid)
+		resp, err := tryWebAuthnRegister(t, b, storage, va, name, "approved-only")
+		if err != nil || resp == nil || !resp.IsError() {
+			t.Fatalf("%s: expected a claimed AAGUID to be refused, got err:%v resp:%#v", name, err, resp)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package u2fauth
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultRateLimitBurst = 10
+
+	// rateLimiterIdleTTL is how long the bucket of a name or address is kept
+	// after its last call
+	rateLimiterIdleTTL = 10 * time.Minute
+)
+
+const (
+	rateLimitName    = "name"
+	rateLimitAddress = "address"
+)
+
+// rateLimiters holds the token buckets of the unauthenticated endpoints,
+// keyed by device name and by client address. They live in memory, each
+// node enforces its own limits.
+type rateLimiters struct {
+	lock     sync.Mutex
+	limiters map[string]*rateLimiter
+}
+
+type rateLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// reserve takes a token from the bucket of key, created with the given
+// rate and burst if needed. It returns zero when the call is allowed, and
+// otherwise how long to wait before a token is available.
+func (r *rateLimiters) reserve(key string, limit rate.Limit, burst int) time.Duration {
+	now := time.Now()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.limiters == nil {
+		r.limiters = make(map[string]*rateLimiter)
+	}
+	l, ok := r.limiters[key]
+	// The configuration may have changed since the bucket was created
+	if !ok || l.limiter.Limit() != limit || l.limiter.Burst() != burst {
+		l = &rateLimiter{limiter: rate.NewLimiter(limit, burst)}
+		r.limiters[key] = l
+	}
+	l.lastSeen = now
+
+	reservation := l.limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		return rateLimiterIdleTTL
+	}
+	delay := reservation.DelayFrom(now)
+	if delay > 0 {
+		reservation.CancelAt(now)
+	}
+	return delay
+}
+
+// tidy drops the buckets that have not been used for a while, they are
+// full again by then.
+func (r *rateLimiters) tidy(now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for key, l := range r.limiters {
+		if now.Sub(l.lastSeen) > rateLimiterIdleTTL {
+			delete(r.limiters, key)
+		}
+	}
+}
+
+// rateLimited wraps the callback of an unauthenticated endpoint to refuse
+// calls over the rates configured for the device name and for the client
+// address, before any device is read.
+func (b *backend) rateLimited(path string, callback framework.OperationFunc) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+		config, err := b.config(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+		if config == nil {
+			return callback(ctx, req, d)
+		}
+
+		burst := config.rateLimitBurst()
+		if config.RateLimitPerName > 0 {
+			name := strings.ToLower(d.Get("name").(string))
+			delay := b.rateLimiters.reserve(rateLimitName+":"+name, perMinute(config.RateLimitPerName), burst)
+			if delay > 0 {
+				return b.rateLimitExceeded(path, rateLimitName, name, delay), nil
+			}
+		}
+		if config.RateLimitPerAddress > 0 && req.Connection != nil && req.Connection.RemoteAddr != "" {
+			addr := req.Connection.RemoteAddr
+			delay := b.rateLimiters.reserve(rateLimitAddress+":"+addr, perMinute(config.RateLimitPerAddress), burst)
+			if delay > 0 {
+				return b.rateLimitExceeded(path, rateLimitAddress, addr, delay), nil
+			}
+		}
+
+		return callback(ctx, req, d)
+	}
+}
+
+// rateLimitExceeded records and logs the rejection and builds a 429 response
+// telling the client when to retry. Vault only passes the Retry-After header
+// on when the mount allows it, so the delay is also part of the body.
+func (b *backend) rateLimitExceeded(path, limit, key string, delay time.Duration) *logical.Response {
+	metrics.IncrCounterWithLabels([]string{"u2f", "rate_limit", "rejected"}, 1, []metrics.Label{
+		{Name: "endpoint", Value: path},
+		{Name: "limit", Value: limit},
+	})
+	b.Logger().Warn("rateLimited", "endpoint", path, "limit", limit, "key", key, "retry after", delay)
+
+	retryAfter := int(math.Ceil(delay.Seconds()))
+	body, _ := json.Marshal(map[string]interface{}{
+		"errors":      []string{"rate limit exceeded"},
+		"retry_after": retryAfter,
+	})
+	return &logical.Response{
+		Data: map[string]interface{}{
+			logical.HTTPContentType: "application/json",
+			logical.HTTPRawBody:     string(body),
+			logical.HTTPStatusCode:  http.StatusTooManyRequests,
+		},
+		Headers: map[string][]string{
+			"Retry-After": []string{strconv.Itoa(retryAfter)},
+		},
+	}
+}
+
+// perMinute converts a number of requests per minute into a token rate.
+func perMinute(n int) rate.Limit {
+	return rate.Limit(float64(n) / 60)
+}
@@ -0,0 +1,140 @@
+package u2fauth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func rawSignRequest(b logical.Backend, s logical.Storage, name, remoteAddr string) (*logical.Response, error) {
+	req := &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "signRequest/" + name,
+		Storage:   s,
+		Connection: &logical.Connection{
+			RemoteAddr: remoteAddr,
+		},
+	}
+	return b.HandleRequest(context.Background(), req)
+}
+
+func rateLimitedResponse(resp *logical.Response) bool {
+	return resp != nil && resp.Data[logical.HTTPStatusCode] == http.StatusTooManyRequests
+}
+
+func TestRateLimit_PerName(t *testing.T) {
+	b, storage, _ := setupDevice(t, "my-device")
+	other, err := newVirtualKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerDevice(t, b, storage, other, "other-device", "my-role")
+	writeConfig(t, b, storage, map[string]interface{}{
+		"rate_limit_per_name": 1,
+		"rate_limit_burst":    2,
+	})
+
+	for i := 0; i < 2; i++ {
+		if resp, err := rawSignRequest(b, storage, "my-device", "192.0.2.10"); err != nil || rateLimitedResponse(resp) {
+			t.Fatalf("bad: call %d: err:%v resp:%#v", i, err, resp)
+		}
+	}
+
+	// The client moving to another address does not reset the name
+	resp, err := rawSignRequest(b, storage, "my-device", "192.0.2.11")
+	if err != nil || !rateLimitedResponse(resp) {
+		t.Fatalf("expected the call to be rate limited, got %#v", resp)
+	}
+	if retryAfter := resp.Headers["Retry-After"]; len(retryAfter) != 1 || retryAfter[0] != "60" {
+		t.Fatalf("bad: Retry-After: %#v", resp.Headers)
+	}
+	if body := resp.Data[logical.HTTPRawBody].(string); !strings.Contains(body, `"retry_after":60`) {
+		t.Fatalf("bad: body: %s", body)
+	}
+
+	if resp, err := rawSignRequest(b, storage, "other-device", "192.0.2.10"); err != nil || rateLimitedResponse(resp) {
+		t.Fatalf("expected another name not to be rate limited, got err:%v resp:%#v", err, resp)
+	}
+}
+
+func TestRateLimit_PerAddress(t *testing.T) {
+	b, storage, _ := setupDevice(t, "my-device")
+	writeConfig(t, b, storage, map[string]interface{}{
+		"rate_limit_per_address": 1,
+		"rate_limit_burst":       1,
+	})
+
+	if resp, err := rawSignRequest(b, storage, "my-device", "192.0.2.10"); err != nil || rateLimitedResponse(resp) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if resp, err := rawSignRequest(b, storage, "other-device", "192.0.2.10"); err != nil || !rateLimitedResponse(resp) {
+		t.Fatalf("expected the call to be rate limited, got err:%v resp:%#v", err, resp)
+	}
+	if resp, err := rawSignRequest(b, storage, "my-device", "192.0.2.11"); err != nil || rateLimitedResponse(resp) {
+		t.Fatalf("expected another address not to be rate limited, got err:%v resp:%#v", err, resp)
+	}
+}
+
+// inmemMetrics sends the global metrics to an in-memory sink for the rest
+// of the test.
+func inmemMetrics(t *testing.T) *metrics.InmemSink {
+	sink := metrics.NewInmemSink(time.Hour, time.Hour)
+	config := metrics.DefaultConfig("")
+	config.EnableHostname = false
+	config.EnableRuntimeMetrics = false
+	if _, err := metrics.NewGlobal(config, sink); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		metrics.NewGlobal(metrics.DefaultConfig(""), &metrics.BlackholeSink{})
+	})
+	return sink
+}
+
+// rejections returns the rate limit rejections counted for the endpoint and
+// limit.
+func rejections(sink *metrics.InmemSink, endpoint, limit string) int {
+	count := 0
+	for _, interval := range sink.Data() {
+		for _, counter := range interval.Counters {
+			if counter.Name != "u2f.rate_limit.rejected" {
+				continue
+			}
+			labels := map[string]string{}
+			for _, label := range counter.Labels {
+				labels[label.Name] = label.Value
+			}
+			if labels["endpoint"] == endpoint && labels["limit"] == limit {
+				count += counter.Count
+			}
+		}
+	}
+	return count
+}
+
+func TestRateLimit_Metrics(t *testing.T) {
+	sink := inmemMetrics(t)
+	b, storage, _ := setupDevice(t, "my-device")
+	writeConfig(t, b, storage, map[string]interface{}{
+		"rate_limit_per_name": 1,
+		"rate_limit_burst":    1,
+	})
+
+	if resp, err := rawSignRequest(b, storage, "my-device", "192.0.2.10"); err != nil || rateLimitedResponse(resp) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if count := rejections(sink, "signRequest", rateLimitName); count != 0 {
+		t.Fatalf("expected no rejection yet, got %d", count)
+	}
+	if resp, err := rawSignRequest(b, storage, "my-device", "192.0.2.10"); err != nil || !rateLimitedResponse(resp) {
+		t.Fatalf("expected the call to be rate limited, got err:%v resp:%#v", err, resp)
+	}
+	if count := rejections(sink, "signRequest", rateLimitName); count != 1 {
+		t.Fatalf("expected one rejection, got %d", count)
+	}
+}
@@ -27,6 +27,21 @@ var challenge *u2f.Challenge
 
 var registrations []u2f.Registration
 
+// challengeID is the ID of the last challenge returned by Vault, it has to be
+// sent back with the response to that challenge.
+var challengeID string
+
+func saveChallengeID(body string) {
+	var msg struct {
+		ChallengeID string `json:"challengeId"`
+	}
+	if err := json.Unmarshal([]byte(body), &msg); err != nil {
+		log.Printf("unable to read challengeId: %v", err)
+		return
+	}
+	challengeID = msg.ChallengeID
+}
+
 func registerRequest(w http.ResponseWriter, r *http.Request) {
 	// c, err := u2f.NewChallenge(appID, trustedFacets, registrations)
 	// if err != nil {
@@ -45,6 +60,7 @@ func registerRequest(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "registerRequest response", statusCode)
 	}
 	log.Printf("1 registerRequest: %s", req)
+	saveChallengeID(req)
 	w.Write([]byte(req))
 
 }
@@ -67,10 +83,12 @@ func registerResponse(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("registerResponse regResp: %v", regResp)
 	dataJSON, err := json.Marshal(struct {
+		ChallengeID      string `json:"challengeId"`
 		ClientData       string `json:"clientData"`
 		RegistrationData string `json:"registrationData"`
 		Name             string `json:"name"`
 	}{
+		challengeID,
 		regResp.ClientData,
 		regResp.RegistrationData,
 		"mydevice",
@@ -96,6 +114,7 @@ func signRequest(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid response: "+req, err)
 	}
 	log.Printf("1 signRequest: %s", req)
+	saveChallengeID(req)
 	w.Write([]byte(req))
 }
 
@@ -110,11 +129,13 @@ func signResponse(w http.ResponseWriter, r *http.Request) {
 	log.Printf("signResponse: %+v", signResp)
 
 	dataJSON, err := json.Marshal(struct {
+		ChallengeID   string `json:"challengeId"`
 		KeyHandle     string `json:"keyHandle"`
 		SignatureData string `json:"signatureData"`
 		ClientData    string `json:"clientData"`
 		Name          string `json:"name"`
 	}{
+		challengeID,
 		signResp.KeyHandle,
 		signResp.SignatureData,
 		signResp.ClientData,
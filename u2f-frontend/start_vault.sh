@@ -7,6 +7,8 @@ unset VAULT_TOKEN
 sleep 3s
 vault auth enable u2f
 sleep 1s
+vault write auth/u2f/config app_id="https://localhost:3483"
+sleep 1s
 vault write auth/u2f/roles/my-role token_policies="polA,polB"
 sleep 1s
 vault read auth/u2f/roles/my-role
@@ -0,0 +1,275 @@
+package u2fauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// virtualAuthenticator is a software WebAuthn authenticator for tests. It
+// produces attestations in the none, packed and fido-u2f formats; packed
+// attestation without a certificate is self attestation.
+type virtualAuthenticator struct {
+	format          string
+	aaguid          []byte
+	attestationKey  *ecdsa.PrivateKey
+	attestationCert []byte
+	credentials     []*virtualWebAuthnCredential
+
+	// userVerified sets the UV flag in the authenticator data
+	userVerified bool
+}
+
+type virtualWebAuthnCredential struct {
+	rpID       string
+	id         []byte
+	userHandle []byte
+	private    *ecdsa.PrivateKey
+	signCount  uint32
+}
+
+// webauthnAttestationResponse holds the fields sent to registerFinish.
+type webauthnAttestationResponse struct {
+	ID                string
+	ClientDataJSON    string
+	AttestationObject string
+}
+
+// webauthnAssertionResponse holds the fields sent to loginFinish.
+type webauthnAssertionResponse struct {
+	ID                string
+	ClientDataJSON    string
+	AuthenticatorData string
+	Signature         string
+	UserHandle        string
+}
+
+// newVirtualAuthenticator returns an authenticator attesting with the given
+// format. For the packed and fido-u2f formats the attestation certificate is
+// issued by ca, or self-signed when it is nil.
+func newVirtualAuthenticator(format string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (*virtualAuthenticator, error) {
+	va := &virtualAuthenticator{
+		format: format,
+		aaguid: make([]byte, 16),
+	}
+	if _, err := rand.Read(va.aaguid); err != nil {
+		return nil, err
+	}
+	if format == attestationFormatNone {
+		return va, nil
+	}
+
+	var err error
+	va.attestationKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	va.attestationCert, err = newAttestationCert("Virtual WebAuthn Authenticator", va.attestationKey, ca, caKey)
+	if err != nil {
+		return nil, err
+	}
+	return va, nil
+}
+
+// certifyAAGUID issues the attestation certificate of a packed or fido-u2f
+// authenticator again, by ca or self-signed when it is nil, carrying its
+// AAGUID in the id-fido-gen-ce-aaguid extension.
+func (va *virtualAuthenticator) certifyAAGUID(ca *x509.Certificate, caKey *ecdsa.PrivateKey) error {
+	ext, err := asn1.Marshal(va.aaguid)
+	if err != nil {
+		return err
+	}
+	va.attestationCert, err = newAttestationCert("Virtual WebAuthn Authenticator", va.attestationKey, ca, caKey, pkix.Extension{
+		Id:    oidFIDOGenCeAAGUID,
+		Value: ext,
+	})
+	return err
+}
+
+// newSelfAttestingAuthenticator returns an authenticator using packed self
+// attestation.
+func newSelfAttestingAuthenticator() (*virtualAuthenticator, error) {
+	va, err := newVirtualAuthenticator(attestationFormatNone, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	va.format = attestationFormatPacked
+	return va, nil
+}
+
+func (va *virtualAuthenticator) authenticatorData(rpID string, signCount uint32, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	flags := byte(authDataFlagUserPresent)
+	if va.userVerified {
+		flags |= authDataFlagUserVerified
+	}
+	if attested != nil {
+		flags |= authDataFlagAttestedCredentialData
+	}
+
+	var data []byte
+	data = append(data, rpIDHash[:]...)
+	data = append(data, flags)
+	counter := make([]byte, 4)
+	binary.BigEndian.PutUint32(counter, signCount)
+	data = append(data, counter...)
+	return append(data, attested...)
+}
+
+func clientDataJSON(typ, challenge, origin string) ([]byte, error) {
+	return json.Marshal(collectedClientData{
+		Type:      typ,
+		Challenge: challenge,
+		Origin:    origin,
+	})
+}
+
+func (va *virtualAuthenticator) create(origin string, opts publicKeyCredentialCreationOptions) (*webauthnAttestationResponse, error) {
+	for _, excluded := range opts.ExcludeCredentials {
+		for _, c := range va.credentials {
+			if c.rpID == opts.RP.ID && base64.RawURLEncoding.EncodeToString(c.id) == excluded.ID {
+				return nil, fmt.Errorf("credential already registered for %s", opts.RP.ID)
+			}
+		}
+	}
+
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	userHandle, err := decodeBase64URL(opts.User.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	point := elliptic.Marshal(elliptic.P256(), private.X, private.Y)
+	coseKey, err := cbor.Marshal(map[int]interface{}{
+		1:  coseKeyTypeEC2,
+		3:  coseAlgES256,
+		-1: coseCurveP256,
+		-2: point[1:33],
+		-3: point[33:],
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var attested []byte
+	attested = append(attested, va.aaguid...)
+	attested = append(attested, byte(len(id)>>8), byte(len(id)))
+	attested = append(attested, id...)
+	attested = append(attested, coseKey...)
+	authData := va.authenticatorData(opts.RP.ID, 0, attested)
+
+	clientData, err := clientDataJSON(webauthnTypeCreate, opts.Challenge, origin)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(clientData)
+
+	attStmt := map[string]interface{}{}
+	switch {
+	case va.format == attestationFormatPacked && va.attestationKey == nil:
+		sig, err := signDigest(private, append(append([]byte{}, authData...), clientDataHash[:]...))
+		if err != nil {
+			return nil, err
+		}
+		attStmt["alg"] = coseAlgES256
+		attStmt["sig"] = sig
+
+	case va.format == attestationFormatPacked:
+		sig, err := signDigest(va.attestationKey, append(append([]byte{}, authData...), clientDataHash[:]...))
+		if err != nil {
+			return nil, err
+		}
+		attStmt["alg"] = coseAlgES256
+		attStmt["sig"] = sig
+		attStmt["x5c"] = [][]byte{va.attestationCert}
+
+	case va.format == attestationFormatFIDOU2F:
+		rpIDHash := sha256.Sum256([]byte(opts.RP.ID))
+		var signed []byte
+		signed = append(signed, 0x00)
+		signed = append(signed, rpIDHash[:]...)
+		signed = append(signed, clientDataHash[:]...)
+		signed = append(signed, id...)
+		signed = append(signed, point...)
+		sig, err := signDigest(va.attestationKey, signed)
+		if err != nil {
+			return nil, err
+		}
+		attStmt["sig"] = sig
+		attStmt["x5c"] = [][]byte{va.attestationCert}
+	}
+
+	attestation, err := cbor.Marshal(map[string]interface{}{
+		"fmt":      va.format,
+		"attStmt":  attStmt,
+		"authData": authData,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	va.credentials = append(va.credentials, &virtualWebAuthnCredential{
+		rpID:       opts.RP.ID,
+		id:         id,
+		userHandle: userHandle,
+		private:    private,
+	})
+
+	return &webauthnAttestationResponse{
+		ID:                base64.RawURLEncoding.EncodeToString(id),
+		ClientDataJSON:    base64.RawURLEncoding.EncodeToString(clientData),
+		AttestationObject: base64.RawURLEncoding.EncodeToString(attestation),
+	}, nil
+}
+
+func (va *virtualAuthenticator) get(origin string, opts publicKeyCredentialRequestOptions) (*webauthnAssertionResponse, error) {
+	var cred *virtualWebAuthnCredential
+	for _, allowed := range opts.AllowCredentials {
+		for _, c := range va.credentials {
+			if c.rpID == opts.RPID && base64.RawURLEncoding.EncodeToString(c.id) == allowed.ID {
+				cred = c
+			}
+		}
+	}
+	if cred == nil {
+		return nil, fmt.Errorf("no credential registered for %s", opts.RPID)
+	}
+
+	cred.signCount++
+	authData := va.authenticatorData(opts.RPID, cred.signCount, nil)
+
+	clientData, err := clientDataJSON(webauthnTypeGet, opts.Challenge, origin)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(clientData)
+	sig, err := signDigest(cred.private, append(append([]byte{}, authData...), clientDataHash[:]...))
+	if err != nil {
+		return nil, err
+	}
+
+	return &webauthnAssertionResponse{
+		ID:                base64.RawURLEncoding.EncodeToString(cred.id),
+		ClientDataJSON:    base64.RawURLEncoding.EncodeToString(clientData),
+		AuthenticatorData: base64.RawURLEncoding.EncodeToString(authData),
+		Signature:         base64.RawURLEncoding.EncodeToString(sig),
+		UserHandle:        base64.RawURLEncoding.EncodeToString(cred.userHandle),
+	}, nil
+}
@@ -0,0 +1,311 @@
+package u2fauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ryankurte/go-u2f"
+)
+
+// virtualKey is a software u2f authenticator for tests. Unlike
+// u2f.VirtualKey it keeps a real usage counter per key and generates random
+// key handles, so several instances never collide.
+type virtualKey struct {
+	attestationKey  *ecdsa.PrivateKey
+	attestationCert []byte
+	keys            []*virtualCredential
+
+	// reuseKey makes the key answer register requests with its first
+	// credential, ignoring the keys already registered, like a client that
+	// does not pass them to the authenticator.
+	reuseKey bool
+}
+
+type virtualCredential struct {
+	appID     string
+	keyHandle []byte
+	private   *ecdsa.PrivateKey
+	counter   uint32
+}
+
+// newVirtualKey returns a virtual key with a self-signed attestation
+// certificate.
+func newVirtualKey() (*virtualKey, error) {
+	return newAttestedVirtualKey(nil, nil)
+}
+
+// newAttestedVirtualKey returns a virtual key whose attestation certificate
+// is issued by the given CA.
+func newAttestedVirtualKey(ca *x509.Certificate, caKey *ecdsa.PrivateKey) (*virtualKey, error) {
+	attestationKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := newAttestationCert("Virtual U2F Device", attestationKey, ca, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &virtualKey{
+		attestationKey:  attestationKey,
+		attestationCert: cert,
+	}, nil
+}
+
+// newAttestationCert returns an attestation certificate for the key, issued
+// by the given CA or self-signed when it is nil, with the extra extensions.
+func newAttestationCert(name string, key *ecdsa.PrivateKey, ca *x509.Certificate, caKey *ecdsa.PrivateKey, extensions ...pkix.Extension) ([]byte, error) {
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(time.Now().UnixNano()),
+		Subject:         pkix.Name{CommonName: name},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(24 * time.Hour),
+		ExtraExtensions: extensions,
+	}
+	parent, parentKey := template, key
+	if ca != nil {
+		parent, parentKey = ca, caKey
+	}
+	return x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+}
+
+func encodeWebSafe(buf []byte) string {
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(buf), "=")
+}
+
+func decodeWebSafe(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func signDigest(key *ecdsa.PrivateKey, data []byte) ([]byte, error) {
+	digest := sha256.Sum256(data)
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(struct{ R, S *big.Int }{r, s})
+}
+
+func (vk *virtualKey) credential(appID string, keyHandle []byte) *virtualCredential {
+	for _, c := range vk.keys {
+		if c.appID == appID && string(c.keyHandle) == string(keyHandle) {
+			return c
+		}
+	}
+	return nil
+}
+
+func (vk *virtualKey) HandleRegisterRequest(req u2f.RegisterRequestMessage) (*u2f.RegisterResponse, error) {
+	reused := vk.reuseKey && len(vk.keys) > 0
+	for _, k := range req.RegisteredKeys {
+		kh, err := decodeWebSafe(k.KeyHandle)
+		if err == nil && vk.credential(req.AppID, kh) != nil && !reused {
+			return nil, fmt.Errorf("key already registered for %s", req.AppID)
+		}
+	}
+
+	var private *ecdsa.PrivateKey
+	var keyHandle []byte
+	if reused {
+		private, keyHandle = vk.keys[0].private, vk.keys[0].keyHandle
+	} else {
+		var err error
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		keyHandle = make([]byte, 32)
+		if _, err := rand.Read(keyHandle); err != nil {
+			return nil, err
+		}
+	}
+
+	clientData, err := json.Marshal(u2f.ClientData{
+		Typ:       "navigator.id.finishEnrollment",
+		Origin:    req.AppID,
+		Challenge: req.RegisterRequests[0].Challenge,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	appParam := sha256.Sum256([]byte(req.AppID))
+	challengeParam := sha256.Sum256(clientData)
+	publicKey := elliptic.Marshal(elliptic.P256(), private.X, private.Y)
+
+	var signed []byte
+	signed = append(signed, 0x00)
+	signed = append(signed, appParam[:]...)
+	signed = append(signed, challengeParam[:]...)
+	signed = append(signed, keyHandle...)
+	signed = append(signed, publicKey...)
+	sig, err := signDigest(vk.attestationKey, signed)
+	if err != nil {
+		return nil, err
+	}
+
+	var regData []byte
+	regData = append(regData, 0x05)
+	regData = append(regData, publicKey...)
+	regData = append(regData, byte(len(keyHandle)))
+	regData = append(regData, keyHandle...)
+	regData = append(regData, vk.attestationCert...)
+	regData = append(regData, sig...)
+
+	if !reused {
+		vk.keys = append(vk.keys, &virtualCredential{
+			appID:     req.AppID,
+			keyHandle: keyHandle,
+			private:   private,
+		})
+	}
+
+	return &u2f.RegisterResponse{
+		RegistrationData: encodeWebSafe(regData),
+		ClientData:       encodeWebSafe(clientData),
+	}, nil
+}
+
+func (vk *virtualKey) HandleAuthenticationRequest(req u2f.SignRequestMessage) (*u2f.SignResponse, error) {
+	var cred *virtualCredential
+	for _, k := range req.RegisteredKeys {
+		kh, err := decodeWebSafe(k.KeyHandle)
+		if err != nil {
+			continue
+		}
+		if cred = vk.credential(req.AppID, kh); cred != nil {
+			break
+		}
+	}
+	if cred == nil {
+		return nil, fmt.Errorf("no key registered for %s", req.AppID)
+	}
+
+	clientData, err := json.Marshal(u2f.ClientData{
+		Typ:       "navigator.id.getAssertion",
+		Origin:    req.AppID,
+		Challenge: req.Challenge,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cred.counter++
+	var sigData []byte
+	sigData = append(sigData, 0x01)
+	counter := make([]byte, 4)
+	binary.BigEndian.PutUint32(counter, cred.counter)
+	sigData = append(sigData, counter...)
+
+	appParam := sha256.Sum256([]byte(req.AppID))
+	challengeParam := sha256.Sum256(clientData)
+	var signed []byte
+	signed = append(signed, appParam[:]...)
+	signed = append(signed, sigData...)
+	signed = append(signed, challengeParam[:]...)
+	sig, err := signDigest(cred.private, signed)
+	if err != nil {
+		return nil, err
+	}
+	sigData = append(sigData, sig...)
+
+	return &u2f.SignResponse{
+		KeyHandle:     encodeWebSafe(cred.keyHandle),
+		SignatureData: encodeWebSafe(sigData),
+		ClientData:    encodeWebSafe(clientData),
+	}, nil
+}
+
+// newAttestationCA returns a CA certificate and key to issue attestation
+// certificates from.
+func newAttestationCA(name string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, key, nil
+}
+
+// getAssertion answers WebAuthn request options the way a browser does for a
+// u2f key: when the appid extension is set the key signs with the app ID
+// instead of the RP ID.
+func (vk *virtualKey) getAssertion(origin string, opts publicKeyCredentialRequestOptions) (*webauthnAssertionResponse, error) {
+	appID, _ := opts.Extensions["appid"].(string)
+
+	var cred *virtualCredential
+	for _, allowed := range opts.AllowCredentials {
+		kh, err := decodeWebSafe(allowed.ID)
+		if err != nil {
+			continue
+		}
+		if cred = vk.credential(appID, kh); cred != nil {
+			break
+		}
+	}
+	if cred == nil {
+		return nil, fmt.Errorf("no key registered for %s", appID)
+	}
+
+	clientData, err := json.Marshal(collectedClientData{
+		Type:      webauthnTypeGet,
+		Challenge: opts.Challenge,
+		Origin:    origin,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cred.counter++
+	appParam := sha256.Sum256([]byte(appID))
+	var authData []byte
+	authData = append(authData, appParam[:]...)
+	authData = append(authData, authDataFlagUserPresent)
+	counter := make([]byte, 4)
+	binary.BigEndian.PutUint32(counter, cred.counter)
+	authData = append(authData, counter...)
+
+	clientDataHash := sha256.Sum256(clientData)
+	sig, err := signDigest(cred.private, append(append([]byte{}, authData...), clientDataHash[:]...))
+	if err != nil {
+		return nil, err
+	}
+
+	return &webauthnAssertionResponse{
+		ID:                encodeWebSafe(cred.keyHandle),
+		ClientDataJSON:    encodeWebSafe(clientData),
+		AuthenticatorData: encodeWebSafe(authData),
+		Signature:         encodeWebSafe(sig),
+	}, nil
+}
@@ -0,0 +1,458 @@
+package u2fauth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	uuid "github.com/hashicorp/go-uuid"
+)
+
+const (
+	webauthnTypeCreate = "webauthn.create"
+	webauthnTypeGet    = "webauthn.get"
+
+	authDataFlagUserPresent            = 0x01
+	authDataFlagUserVerified           = 0x04
+	authDataFlagAttestedCredentialData = 0x40
+	authDataFlagExtensionData          = 0x80
+
+	coseKeyTypeEC2 = 2
+	coseKeyTypeRSA = 3
+	coseCurveP256  = 1
+
+	coseAlgES256 = -7
+	coseAlgRS256 = -257
+
+	attestationFormatNone    = "none"
+	attestationFormatPacked  = "packed"
+	attestationFormatFIDOU2F = "fido-u2f"
+)
+
+// oidFIDOGenCeAAGUID is the certificate extension carrying the AAGUID of a
+// packed attestation certificate.
+var oidFIDOGenCeAAGUID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+var errWebAuthnVerification = errors.New("webauthn verification failed")
+
+// collectedClientData is the clientDataJSON assembled by the browser.
+type collectedClientData struct {
+	Type string `json:"type"`
+
+	Challenge string `json:"challenge"`
+
+	Origin string `json:"origin"`
+
+	CrossOrigin bool `json:"crossOrigin,omitempty"`
+}
+
+// authenticatorData is the parsed authenticator data of an attestation or
+// assertion.
+type authenticatorData struct {
+	Raw []byte
+
+	RPIDHash []byte
+
+	Flags byte
+
+	SignCount uint32
+
+	AAGUID []byte
+
+	CredentialID []byte
+
+	CredentialPublicKey []byte
+}
+
+// attestationObject is the CBOR structure returned by
+// navigator.credentials.create().
+type attestationObject struct {
+	Format string `cbor:"fmt"`
+
+	AttStmt cbor.RawMessage `cbor:"attStmt"`
+
+	AuthData []byte `cbor:"authData"`
+}
+
+// attestationStatement holds the fields of the packed and fido-u2f formats.
+type attestationStatement struct {
+	Alg int `cbor:"alg,omitempty"`
+
+	Sig []byte `cbor:"sig"`
+
+	X5C [][]byte `cbor:"x5c,omitempty"`
+}
+
+// rpID returns the WebAuthn relying party ID, the host of the application ID.
+func (c *ConfigEntry) rpID() string {
+	u, err := url.Parse(c.AppID)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// webauthnOrigins returns the origins WebAuthn responses may come from: the
+// origin of the application ID and every trusted facet that is a web origin.
+func (c *ConfigEntry) webauthnOrigins() []string {
+	var origins []string
+	if u, err := url.Parse(c.AppID); err == nil {
+		origins = append(origins, u.Scheme+"://"+u.Host)
+	}
+	for _, facet := range c.TrustedFacets {
+		if strings.HasPrefix(facet, "https://") {
+			origins = append(origins, strings.TrimSuffix(facet, "/"))
+		}
+	}
+	return origins
+}
+
+// verifyClientData checks the type, challenge and origin of clientDataJSON.
+func verifyClientData(raw []byte, typ string, challenge []byte, origins []string) error {
+	var clientData collectedClientData
+	if err := json.Unmarshal(raw, &clientData); err != nil {
+		return fmt.Errorf("invalid clientDataJSON: %v", err)
+	}
+	if clientData.Type != typ {
+		return fmt.Errorf("clientDataJSON has type %q, expected %q", clientData.Type, typ)
+	}
+
+	received, err := decodeBase64URL(clientData.Challenge)
+	if err != nil || subtle.ConstantTimeCompare(received, challenge) != 1 {
+		return fmt.Errorf("clientDataJSON does not match the challenge")
+	}
+
+	for _, origin := range origins {
+		if clientData.Origin == origin {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin %q is not trusted", clientData.Origin)
+}
+
+// parseAuthenticatorData parses the authenticator data, including the
+// attested credential data when it is present.
+func parseAuthenticatorData(raw []byte) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, fmt.Errorf("authenticator data is too short")
+	}
+
+	authData := &authenticatorData{
+		Raw:       raw,
+		RPIDHash:  raw[:32],
+		Flags:     raw[32],
+		SignCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+	rest := raw[37:]
+
+	if authData.Flags&authDataFlagAttestedCredentialData != 0 {
+		if len(rest) < 18 {
+			return nil, fmt.Errorf("attested credential data is too short")
+		}
+		authData.AAGUID = rest[:16]
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < idLen {
+			return nil, fmt.Errorf("credential ID is truncated")
+		}
+		authData.CredentialID = rest[:idLen]
+		rest = rest[idLen:]
+
+		// The public key is followed by the extensions, decode it to find
+		// where it ends.
+		dec := cbor.NewDecoder(bytes.NewReader(rest))
+		var key cbor.RawMessage
+		if err := dec.Decode(&key); err != nil {
+			return nil, fmt.Errorf("invalid credential public key: %v", err)
+		}
+		authData.CredentialPublicKey = key
+		rest = rest[dec.NumBytesRead():]
+	}
+
+	if authData.Flags&authDataFlagExtensionData != 0 {
+		var extensions map[string]interface{}
+		dec := cbor.NewDecoder(bytes.NewReader(rest))
+		if err := dec.Decode(&extensions); err != nil {
+			return nil, fmt.Errorf("invalid extension data: %v", err)
+		}
+		rest = rest[dec.NumBytesRead():]
+	}
+
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("authenticator data has trailing bytes")
+	}
+
+	return authData, nil
+}
+
+// verify checks the relying party ID hash and the user presence flag, and
+// user verification when it is required. Credentials created through the u2f
+// API hash their app ID instead of the RP ID; it is accepted when appID is
+// set.
+func (a *authenticatorData) verify(rpID, appID string, requireUV bool) error {
+	hash := sha256.Sum256([]byte(rpID))
+	appIDHash := sha256.Sum256([]byte(appID))
+	if subtle.ConstantTimeCompare(a.RPIDHash, hash[:]) != 1 &&
+		(appID == "" || subtle.ConstantTimeCompare(a.RPIDHash, appIDHash[:]) != 1) {
+		return fmt.Errorf("authenticator data is for another relying party")
+	}
+	if a.Flags&authDataFlagUserPresent == 0 {
+		return fmt.Errorf("user was not present")
+	}
+	if requireUV && a.Flags&authDataFlagUserVerified == 0 {
+		return fmt.Errorf("user was not verified")
+	}
+	return nil
+}
+
+// aaguid returns the AAGUID formatted as a UUID, or an empty string for
+// authenticators that do not disclose it.
+func (a *authenticatorData) aaguid() string {
+	if len(a.AAGUID) != 16 || bytes.Equal(a.AAGUID, make([]byte, 16)) {
+		return ""
+	}
+	id, err := uuid.FormatUUID(a.AAGUID)
+	if err != nil {
+		return ""
+	}
+	return id
+}
+
+// parseCOSEKey returns the public key and algorithm of a COSE_Key. ES256 and
+// RS256 keys are supported.
+func parseCOSEKey(raw []byte) (crypto.PublicKey, int, error) {
+	var key map[int]interface{}
+	if err := cbor.Unmarshal(raw, &key); err != nil {
+		return nil, 0, fmt.Errorf("invalid COSE key: %v", err)
+	}
+	kty, _ := coseInt(key[1])
+	alg, _ := coseInt(key[3])
+
+	switch {
+	case kty == coseKeyTypeEC2 && alg == coseAlgES256:
+		crv, _ := coseInt(key[-1])
+		x, _ := key[-2].([]byte)
+		y, _ := key[-3].([]byte)
+		if crv != coseCurveP256 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, fmt.Errorf("invalid ES256 COSE key")
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, 0, fmt.Errorf("invalid ES256 COSE key")
+		}
+		return pub, alg, nil
+
+	case kty == coseKeyTypeRSA && alg == coseAlgRS256:
+		n, _ := key[-1].([]byte)
+		e, _ := key[-2].([]byte)
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, fmt.Errorf("invalid RS256 COSE key")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, alg, nil
+	}
+
+	return nil, 0, fmt.Errorf("unsupported COSE key type %d with algorithm %d", kty, alg)
+}
+
+// legacyCredential returns the WebAuthn view of a u2f registration: its
+// P-256 public key as a COSE key, scoped to the u2f app ID.
+func legacyCredential(regEntry *RegistrationEntry, appID string) (*WebAuthnCredential, error) {
+	point, err := decodeBase64URL(regEntry.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if x, _ := elliptic.Unmarshal(elliptic.P256(), point); x == nil {
+		return nil, fmt.Errorf("invalid u2f public key")
+	}
+	coseKey, err := cbor.Marshal(map[int]interface{}{
+		1:  coseKeyTypeEC2,
+		3:  coseAlgES256,
+		-1: coseCurveP256,
+		-2: point[1:33],
+		-3: point[33:],
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebAuthnCredential{
+		ID:                regEntry.KeyHandle,
+		PublicKey:         coseKey,
+		SignCount:         uint32(regEntry.Counter),
+		AttestationFormat: attestationFormatFIDOU2F,
+		AppID:             appID,
+		Quarantined:       regEntry.Quarantined,
+		QuarantinedAt:     regEntry.QuarantinedAt,
+		Attestation:       regEntry.Attestation,
+		KeyUsage:          regEntry.KeyUsage,
+		DisabledState:     regEntry.DisabledState,
+		Rotation:          regEntry.Rotation,
+		LoginFailures:     regEntry.LoginFailures,
+	}, nil
+}
+
+func coseInt(v interface{}) (int, bool) {
+	switch i := v.(type) {
+	case int64:
+		return int(i), true
+	case uint64:
+		return int(i), true
+	}
+	return 0, false
+}
+
+// verifySignature checks a signature made with a COSE algorithm.
+func verifySignature(pub crypto.PublicKey, alg int, data, sig []byte) error {
+	digest := sha256.Sum256(data)
+
+	switch alg {
+	case coseAlgES256:
+		key, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return errWebAuthnVerification
+		}
+		var esig struct{ R, S *big.Int }
+		if rest, err := asn1.Unmarshal(sig, &esig); err != nil || len(rest) != 0 {
+			return errWebAuthnVerification
+		}
+		if !ecdsa.Verify(key, digest[:], esig.R, esig.S) {
+			return errWebAuthnVerification
+		}
+		return nil
+
+	case coseAlgRS256:
+		key, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return errWebAuthnVerification
+		}
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+			return errWebAuthnVerification
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported signature algorithm %d", alg)
+}
+
+// certificateAAGUID returns the AAGUID carried by the id-fido-gen-ce-aaguid
+// extension of an attestation certificate, nil if it has none.
+func certificateAAGUID(cert *x509.Certificate) ([]byte, error) {
+	if cert == nil {
+		return nil, nil
+	}
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidFIDOGenCeAAGUID) {
+			continue
+		}
+		var aaguid []byte
+		if _, err := asn1.Unmarshal(ext.Value, &aaguid); err != nil {
+			return nil, err
+		}
+		return aaguid, nil
+	}
+	return nil, nil
+}
+
+// verifyAttestationStatement checks the attestation statement of a new
+// credential and returns its attestation certificate and intermediates. Self
+// attestation and the none format return no certificate.
+func verifyAttestationStatement(obj *attestationObject, authData *authenticatorData, clientDataHash []byte) (*x509.Certificate, []*x509.Certificate, error) {
+	if obj.Format == attestationFormatNone {
+		var stmt map[string]interface{}
+		if err := cbor.Unmarshal(obj.AttStmt, &stmt); err != nil || len(stmt) != 0 {
+			return nil, nil, fmt.Errorf("none attestation must have an empty statement")
+		}
+		return nil, nil, nil
+	}
+
+	var stmt attestationStatement
+	if err := cbor.Unmarshal(obj.AttStmt, &stmt); err != nil {
+		return nil, nil, fmt.Errorf("invalid attestation statement: %v", err)
+	}
+	var chain []*x509.Certificate
+	for _, der := range stmt.X5C {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid attestation certificate: %v", err)
+		}
+		chain = append(chain, cert)
+	}
+
+	credentialKey, credentialAlg, err := parseCOSEKey(authData.CredentialPublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch obj.Format {
+	case attestationFormatPacked:
+		signed := append(append([]byte{}, authData.Raw...), clientDataHash...)
+
+		// Self attestation is signed with the credential key itself
+		if len(chain) == 0 {
+			if stmt.Alg != credentialAlg {
+				return nil, nil, fmt.Errorf("self attestation algorithm does not match the credential key")
+			}
+			if err := verifySignature(credentialKey, stmt.Alg, signed, stmt.Sig); err != nil {
+				return nil, nil, err
+			}
+			return nil, nil, nil
+		}
+
+		if err := verifySignature(chain[0].PublicKey, stmt.Alg, signed, stmt.Sig); err != nil {
+			return nil, nil, err
+		}
+		aaguid, err := certificateAAGUID(chain[0])
+		if err != nil || (aaguid != nil && !bytes.Equal(aaguid, authData.AAGUID)) {
+			return nil, nil, fmt.Errorf("attestation certificate AAGUID does not match the authenticator")
+		}
+		return chain[0], chain[1:], nil
+
+	case attestationFormatFIDOU2F:
+		if len(chain) != 1 {
+			return nil, nil, fmt.Errorf("fido-u2f attestation must carry exactly one certificate")
+		}
+		key, ok := credentialKey.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, nil, fmt.Errorf("fido-u2f attestation requires an ES256 credential key")
+		}
+
+		var signed []byte
+		signed = append(signed, 0x00)
+		signed = append(signed, authData.RPIDHash...)
+		signed = append(signed, clientDataHash...)
+		signed = append(signed, authData.CredentialID...)
+		signed = append(signed, elliptic.Marshal(elliptic.P256(), key.X, key.Y)...)
+		if err := verifySignature(chain[0].PublicKey, coseAlgES256, signed, stmt.Sig); err != nil {
+			return nil, nil, err
+		}
+		return chain[0], nil, nil
+	}
+
+	return nil, nil, fmt.Errorf("unsupported attestation format %q", obj.Format)
+}
+
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}